@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"taran1s.share/models"
+)
+
+// Maintenance commands that can be run instead of the web server,
+// e.g. `goshare gc -dry-run`
+type commands struct {
+	GalleryService *models.GalleryService
+}
+
+func (c commands) Run(args []string) error {
+	switch args[0] {
+	case "gc":
+		return c.gc(args[1:])
+	case "reconcile":
+		return c.reconcile(args[1:])
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// Remove gallery images that no longer have a gallery row
+func (c commands) gc(args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "list orphaned gallery prefixes without removing them")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		orphans, err := c.GalleryService.OrphanedPrefixes()
+		if err != nil {
+			return fmt.Errorf("gc: %w", err)
+		}
+		for _, prefix := range orphans {
+			fmt.Println("orphaned:", prefix)
+		}
+		return nil
+	}
+
+	removed, err := c.GalleryService.RemoveOrphanedPrefixes()
+	for _, prefix := range removed {
+		fmt.Println("removed:", prefix)
+	}
+	if err != nil {
+		return fmt.Errorf("gc: %w", err)
+	}
+
+	return nil
+}
+
+// Import images already in the store into the images table and report rows
+// whose contents have gone missing
+func (c commands) reconcile(args []string) error {
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	prune := flags.Bool("prune", false, "delete rows for images missing from the store")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	imported, err := c.GalleryService.ImportImages()
+	for _, image := range imported {
+		fmt.Println("imported:", image.Key)
+	}
+	if err != nil {
+		return fmt.Errorf("reconcile: %w", err)
+	}
+
+	missing, err := c.GalleryService.MissingImages()
+	if err != nil {
+		return fmt.Errorf("reconcile: %w", err)
+	}
+
+	for _, image := range missing {
+		if !*prune {
+			fmt.Println("missing:", image.Key)
+			continue
+		}
+
+		err := c.GalleryService.DeleteImage(image.GalleryID, image.Filename)
+		if err != nil {
+			return fmt.Errorf("reconcile: %w", err)
+		}
+		fmt.Println("pruned:", image.Key)
+	}
+
+	return nil
+}
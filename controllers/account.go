@@ -0,0 +1,188 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"taran1s.share/context"
+	"taran1s.share/errors"
+	"taran1s.share/models"
+)
+
+func (u Users) renderAccount(w http.ResponseWriter, r *http.Request, notice string, errs ...error) {
+	user := context.User(r.Context())
+
+	var data struct {
+		Email         string
+		EmailVerified bool
+		Forename      string
+		Surname       string
+		// Accounts made with an identity provider have no password until
+		// they reset it
+		HasPassword bool
+		Notice      string
+	}
+	data.Email = user.Email
+	data.EmailVerified = user.EmailVerified()
+	data.Forename = user.Forename
+	data.Surname = user.Surname
+	data.HasPassword = user.PasswordHash != ""
+	data.Notice = notice
+
+	u.Templates.Account.Execute(w, r, data, errs...)
+}
+
+// The account settings page
+func (u Users) Account(w http.ResponseWriter, r *http.Request) {
+	u.renderAccount(w, r, "")
+}
+
+// Check the signed in user's password before a change that could be used
+// to take over the account. Wrong guesses count towards the same lockout
+// as signing in. field is the form field the password was typed into
+func (u Users) checkCurrentPassword(r *http.Request, user *models.User, password, field string) error {
+	err := u.reserveAttempt(r, user.Email)
+	if err != nil {
+		return err
+	}
+
+	err = u.UserService.VerifyPassword(user, password)
+	if errors.Is(err, models.ErrInvalidCredentials) {
+		u.signInFailed(r, user.Email)
+		return errors.Field(err, field, "That isn't your current password")
+	}
+	u.releaseAttempt(r, user.Email)
+	return err
+}
+
+func (u Users) UpdateName(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	err := u.UserService.UpdateName(user, r.FormValue("forename"), r.FormValue("surname"))
+	if err != nil {
+		if errors.Is(err, models.ErrNameRequired) {
+			err = errors.Field(err, "name", err.Error())
+		}
+		u.renderAccount(w, r, "", err)
+		return
+	}
+
+	u.renderAccount(w, r, "Your name has been updated")
+}
+
+func (u Users) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	password := r.FormValue("password")
+
+	if password != r.FormValue("confirm") {
+		u.renderAccount(w, r, "", passwordError(models.ErrPasswordMatch))
+		return
+	}
+
+	err := u.checkCurrentPassword(r, user, r.FormValue("current_password"), "current_password")
+	if err != nil {
+		u.renderAccount(w, r, "", err)
+		return
+	}
+
+	err = u.UserService.UpdatePassword(user, password)
+	if err != nil {
+		u.renderAccount(w, r, "", passwordError(err))
+		return
+	}
+
+	err = u.rotateSessions(w, r, user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+
+	u.renderAccount(w, r, "Your password has been changed and your other devices have been signed out")
+}
+
+// Send a link to the new address, which has to be followed before the
+// change happens, and let the old address know
+func (u Users) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	newEmail := strings.ToLower(strings.TrimSpace(r.FormValue("new_email")))
+
+	if newEmail == user.Email {
+		err := errors.Field(fmt.Errorf("change email: unchanged"), "new_email", "That's already your email address")
+		u.renderAccount(w, r, "", err)
+		return
+	}
+
+	err := u.checkCurrentPassword(r, user, r.FormValue("email_password"), "email_password")
+	if err != nil {
+		u.renderAccount(w, r, "", err)
+		return
+	}
+
+	base := baseURL(r)
+	change, err := u.EmailChangeService.Create(user.ID, newEmail)
+	switch {
+	case err == nil:
+		vals := url.Values{
+			"token": {change.Token},
+		}
+		confirmURL := base + "/confirm-email?" + vals.Encode()
+		sendInBackground(func() error {
+			return u.EmailService.ConfirmEmailChange(newEmail, confirmURL)
+		})
+	case errors.Is(err, models.ErrEmailExists):
+		// Looks the same as a change that went ahead, so this can't be
+		// used to find out who has an account
+	case errors.Is(err, models.ErrInvalidEmail):
+		u.renderAccount(w, r, "", errors.Field(err, "new_email", err.Error()))
+		return
+	case errors.Is(err, models.ErrResendTooSoon):
+		err = errors.Public(err, "We sent a link recently, please check your inbox or try again in a minute")
+		u.renderAccount(w, r, "", err)
+		return
+	default:
+		u.renderAccount(w, r, "", err)
+		return
+	}
+
+	vals := url.Values{
+		"email": {user.Email},
+	}
+	resetURL := base + "/forgot-pw?" + vals.Encode()
+	oldEmail := user.Email
+	sendInBackground(func() error {
+		return u.EmailService.EmailChangeRequested(oldEmail, newEmail, resetURL)
+	})
+
+	u.renderAccount(w, r, fmt.Sprintf(
+		"We've sent a link to %s. Your email address will change once you follow it", newEmail))
+}
+
+// The link from the email sent to the new address. Like verification
+// links it works without being signed in
+func (u Users) ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	_, err := u.EmailChangeService.Consume(r.FormValue("token"))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound), errors.Is(err, models.ErrTokenExpired):
+			err = errors.Public(err, "That link is invalid or has expired")
+		case errors.Is(err, models.ErrEmailExists):
+			err = errors.Public(err, "That email address can't be used, please choose another")
+		}
+
+		if context.User(r.Context()) == nil {
+			u.renderSignIn(w, r, &models.NewUser{}, err)
+			return
+		}
+		u.renderAccount(w, r, "", err)
+		return
+	}
+
+	if context.User(r.Context()) == nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
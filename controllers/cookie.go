@@ -9,22 +9,48 @@ const (
 	CookieSession = "session"
 )
 
-func newCookie(name, value string) *http.Cookie {
+// How cookies are set, shared by every controller that sets them
+type CookiePolicy struct {
+	// Only send cookies over HTTPS
+	Secure bool
+	// Defaults to Lax when unset
+	SameSite http.SameSite
+	// Name cookies with the __Host- prefix, or __Secure- for those scoped
+	// to a path, so browsers refuse ones that weren't set over HTTPS by this
+	// host. Only applies to secure cookies
+	Prefix bool
+}
+
+// The name a cookie is actually stored under
+func (policy CookiePolicy) name(name, path string) string {
+	if !policy.Secure || !policy.Prefix {
+		return name
+	}
+	if path == "/" {
+		return "__Host-" + name
+	}
+	return "__Secure-" + name
+}
+
+func (policy CookiePolicy) newCookie(name, value, path string) *http.Cookie {
+	sameSite := policy.SameSite
+	if sameSite == 0 {
+		sameSite = http.SameSiteLaxMode
+	}
+
 	cookie := http.Cookie{
-		Name:     name,
+		Name:     policy.name(name, path),
 		Value:    value,
-		Path:     "/",
+		Path:     path,
 		HttpOnly: true,
+		Secure:   policy.Secure,
+		SameSite: sameSite,
 	}
 	return &cookie
 }
 
-func setCookie(w http.ResponseWriter, name, value string) {
-	http.SetCookie(w, newCookie(name, value))
-}
-
-func readCookie(r *http.Request, name string) (string, error) {
-	c, err := r.Cookie(name)
+func (policy CookiePolicy) readCookie(r *http.Request, name, path string) (string, error) {
+	c, err := r.Cookie(policy.name(name, path))
 	if err != nil {
 		return "", fmt.Errorf("%s: %w", name, err)
 	}
@@ -32,8 +58,8 @@ func readCookie(r *http.Request, name string) (string, error) {
 	return c.Value, nil
 }
 
-func deleteCookie(w http.ResponseWriter, name string) {
-	cookie := newCookie(name, "")
+func (policy CookiePolicy) deleteCookie(w http.ResponseWriter, name string) {
+	cookie := policy.newCookie(name, "", "/")
 	cookie.MaxAge = -1
 	http.SetCookie(w, cookie)
 }
@@ -1,10 +1,18 @@
 package controllers
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"net/url"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"taran1s.share/context"
@@ -12,14 +20,40 @@ import (
 	"taran1s.share/models"
 )
 
+const (
+	// Maximum size of the multipart form accepted by UploadImage
+	MaxUploadSize = 32 << 20
+	// How long a visitor stays signed in to a password protected gallery
+	UnlockDuration = 2 * time.Hour
+)
+
+// Errors from GalleryService.CreateImage that are the uploader's fault and
+// safe to show them
+var uploadErrors = []error{
+	models.ErrInvalidFilename,
+	models.ErrInvalidExtension,
+	models.ErrInvalidImage,
+	models.ErrContentMismatch,
+	models.ErrImageTooLarge,
+	models.ErrPolyglotImage,
+	models.ErrImageExists,
+}
+
 type Galleries struct {
 	Templates struct {
-		Show  Template
-		New   Template
-		Edit  Template
-		Index Template
+		Show   Template
+		New    Template
+		Edit   Template
+		Index  Template
+		Public Template
+		Unlock Template
 	}
-	GalleryService *models.GalleryService
+	GalleryService   *models.GalleryService
+	ShareLinkService *models.ShareLinkService
+	EmailService     *models.EmailService
+	// Signs the cookies that remember a gallery's passphrase was entered
+	UnlockKey []byte
+	Cookies   CookiePolicy
 }
 
 func (g Galleries) New(w http.ResponseWriter, r *http.Request) {
@@ -52,66 +86,156 @@ func (g Galleries) Create(w http.ResponseWriter, r *http.Request) {
 }
 
 func (g Galleries) Edit(w http.ResponseWriter, r *http.Request) {
-	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	gallery, role := g.galleryFor(w, r, models.ActionUpload)
+	if gallery == nil {
+		return
+	}
+
+	g.renderEdit(w, r, gallery, role, "", "")
+}
+
+// Render the edit page, showing only the parts the user's role allows. The
+// URL of a newly created share link is passed in since only its hash is
+// stored and this is the one chance to show it
+func (g Galleries) renderEdit(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, role, shareURL, memberNotice string, errs ...error) {
+	type Image struct {
+		GalleryID    int
+		Filename     string
+		FilenameSafe string
+	}
+
+	type ShareLink struct {
+		ID        int
+		ExpiresAt time.Time
+		Expired   bool
+		MaxViews  int
+		Views     int
+	}
+
+	type Member struct {
+		UserID int
+		Name   string
+		Email  string
+		Role   string
+	}
+
+	var data struct {
+		ID             int
+		Title          string
+		Role           string
+		CanEdit        bool
+		CanManage      bool
+		KeepCameraInfo bool
+		Visibility     string
+		HasPassword    bool
+		Images         []Image
+		ShareURL       string
+		ShareLinks     []ShareLink
+		Members        []Member
+		MemberNotice   string
+	}
+
+	data.ID = gallery.ID
+	data.Role = role
+	data.CanEdit = models.RoleAllows(role, models.ActionEdit)
+	data.CanManage = models.RoleAllows(role, models.ActionManage)
+	data.Title = gallery.Title
+	data.KeepCameraInfo = gallery.KeepCameraInfo
+	data.Visibility = gallery.Visibility
+	data.HasPassword = gallery.HasPassword()
+	data.ShareURL = shareURL
+	data.MemberNotice = memberNotice
+	images, err := g.GalleryService.Images(gallery.ID)
 	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusNotFound)
+		fmt.Println(err)
+		http.Error(w, "Something went wrong...", http.StatusInternalServerError)
 		return
 	}
 
-	gallery, err := g.GalleryService.ByID(id)
+	for _, image := range images {
+		data.Images = append(data.Images, Image{
+			GalleryID:    image.GalleryID,
+			Filename:     image.Filename,
+			FilenameSafe: url.PathEscape(image.Filename),
+		})
+	}
+
+	if !data.CanManage {
+		g.Templates.Edit.Execute(w, r, data, errs...)
+		return
+	}
+
+	links, err := g.ShareLinkService.ByGalleryID(gallery.ID)
 	if err != nil {
-		if err == models.ErrNotFound {
-			http.Error(w, "Gallery not found", http.StatusNotFound)
-			return
-		}
 		fmt.Println(err)
-		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		http.Error(w, "Something went wrong...", http.StatusInternalServerError)
 		return
 	}
 
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "You are not authorized to edit this gallery", http.StatusForbidden)
+	for _, link := range links {
+		data.ShareLinks = append(data.ShareLinks, ShareLink{
+			ID:        link.ID,
+			ExpiresAt: link.ExpiresAt,
+			Expired: time.Now().After(link.ExpiresAt) ||
+				(link.MaxViews > 0 && link.Views >= link.MaxViews),
+			MaxViews: link.MaxViews,
+			Views:    link.Views,
+		})
+	}
+
+	members, err := g.GalleryService.Members(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong...", http.StatusInternalServerError)
 		return
 	}
 
-	data := struct {
-		ID    int
-		Title string
-	}{
-		ID:    gallery.ID,
-		Title: gallery.Title,
+	for _, member := range members {
+		data.Members = append(data.Members, Member{
+			UserID: member.UserID,
+			Name:   member.Forename + " " + member.Surname,
+			Email:  member.Email,
+			Role:   member.Role,
+		})
 	}
-	g.Templates.Edit.Execute(w, r, data)
+
+	g.Templates.Edit.Execute(w, r, data, errs...)
 }
 
 func (g Galleries) Update(w http.ResponseWriter, r *http.Request) {
-	id, err := strconv.Atoi(chi.URLParam(r, "id"))
-	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusNotFound)
+	gallery, role := g.galleryFor(w, r, models.ActionEdit)
+	if gallery == nil {
 		return
 	}
 
-	gallery, err := g.GalleryService.ByID(id)
+	title := r.FormValue("title")
+	gallery.Title = title
+
+	// Editors can rename the gallery, everything else is up to the owner
+	manage := models.RoleAllows(role, models.ActionManage)
+	if manage {
+		gallery.KeepCameraInfo = r.FormValue("keep_camera_info") == "on"
+		gallery.Visibility = r.FormValue("visibility")
+	}
+
+	err := g.GalleryService.Update(gallery)
 	if err != nil {
-		if errors.Is(err, models.ErrNotFound) {
-			http.Error(w, "Gallery not found", http.StatusNotFound)
+		if errors.Is(err, models.ErrInvalidVisibility) {
+			http.Error(w, models.ErrInvalidVisibility.Error(), http.StatusBadRequest)
 			return
 		}
 		http.Error(w, "Something went wrong...", http.StatusInternalServerError)
 		return
 	}
 
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "You are not authorized to edit this gallery", http.StatusForbidden)
-		return
+	// A blank password leaves the current one alone
+	if manage && r.FormValue("remove_password") == "on" {
+		err = g.GalleryService.SetPassword(gallery, "")
+	} else if password := r.FormValue("password"); manage && password != "" {
+		err = g.GalleryService.SetPassword(gallery, password)
 	}
-
-	title := r.FormValue("title")
-	gallery.Title = title
-	err = g.GalleryService.Update(gallery)
 	if err != nil {
+		fmt.Println(err)
 		http.Error(w, "Something went wrong...", http.StatusInternalServerError)
 		return
 	}
@@ -121,13 +245,12 @@ func (g Galleries) Update(w http.ResponseWriter, r *http.Request) {
 }
 
 func (g Galleries) Delete(w http.ResponseWriter, r *http.Request) {
-	id, err := strconv.Atoi(chi.URLParam(r, "id"))
-	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusNotFound)
+	gallery, _ := g.galleryFor(w, r, models.ActionManage)
+	if gallery == nil {
 		return
 	}
 
-	err = g.GalleryService.DeleteID(id)
+	err := g.GalleryService.DeleteID(gallery.ID)
 	if err != nil {
 		if errors.Is(models.ErrNotFound, err) {
 			http.Error(w, "Gallery not found", http.StatusNotFound)
@@ -142,12 +265,21 @@ func (g Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 
 func (g Galleries) Index(w http.ResponseWriter, r *http.Request) {
 	type Gallery struct {
-		ID    int
-		Title string
+		ID         int
+		Title      string
+		Visibility string
+	}
+
+	type SharedGallery struct {
+		ID      int
+		Title   string
+		Role    string
+		CanEdit bool
 	}
 
 	var data struct {
 		Galleries []Gallery
+		Shared    []SharedGallery
 	}
 
 	user := context.User(r.Context())
@@ -159,34 +291,217 @@ func (g Galleries) Index(w http.ResponseWriter, r *http.Request) {
 
 	for _, gallery := range galleries {
 		data.Galleries = append(data.Galleries, Gallery{
+			ID:         gallery.ID,
+			Title:      gallery.Title,
+			Visibility: gallery.Visibility,
+		})
+	}
+
+	shared, err := g.GalleryService.SharedWith(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong..", http.StatusInternalServerError)
+		return
+	}
+
+	for _, gallery := range shared {
+		data.Shared = append(data.Shared, SharedGallery{
 			ID:    gallery.ID,
 			Title: gallery.Title,
+			Role:  gallery.Role,
+			// Contributors use the edit page to upload
+			CanEdit: models.RoleAllows(gallery.Role, models.ActionUpload),
 		})
 	}
 
 	g.Templates.Index.Execute(w, r, data)
 }
 
-func (g Galleries) Show(w http.ResponseWriter, r *http.Request) {
+func (g Galleries) Public(w http.ResponseWriter, r *http.Request) {
+	type Gallery struct {
+		ID    int
+		Title string
+	}
+
+	var data struct {
+		Galleries []Gallery
+	}
+
+	galleries, err := g.GalleryService.Public()
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong..", http.StatusInternalServerError)
+		return
+	}
+
+	for _, gallery := range galleries {
+		data.Galleries = append(data.Galleries, Gallery{
+			ID:    gallery.ID,
+			Title: gallery.Title,
+		})
+	}
+
+	g.Templates.Public.Execute(w, r, data)
+}
+
+// Load the gallery named in the URL and check the current user may perform
+// action on it, returning the gallery and the user's role. Every handler
+// goes through here so permissions live in one place. Writes a response
+// and returns a nil gallery if the user isn't allowed
+func (g Galleries) galleryFor(w http.ResponseWriter, r *http.Request, action models.GalleryAction) (*models.Gallery, string) {
 	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
 		http.Error(w, "Invalid ID", http.StatusNotFound)
-		return
+		return nil, ""
 	}
 
 	gallery, err := g.GalleryService.ByID(id)
 	if err != nil {
-		if errors.Is(models.ErrNotFound, err) {
+		if errors.Is(err, models.ErrNotFound) {
 			http.Error(w, "Gallery not found", http.StatusNotFound)
-			return
+			return nil, ""
 		}
+		fmt.Println(err)
 		http.Error(w, "Something went wrong...", http.StatusInternalServerError)
+		return nil, ""
+	}
+
+	user := context.User(r.Context())
+	role, err := g.GalleryService.Authorize(gallery, user, action)
+	if errors.Is(err, models.ErrForbidden) {
+		switch {
+		case user == nil:
+			// They may be the owner or a member who isn't signed in
+			http.Redirect(w, r, "/signin", http.StatusFound)
+		case role == "" && gallery.Visibility == models.VisibilityPrivate:
+			// Don't reveal that private galleries exist
+			http.Error(w, "Gallery not found", http.StatusNotFound)
+		default:
+			http.Error(w, "You are not authorized to edit this gallery", http.StatusForbidden)
+		}
+		return nil, ""
+	} else if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong...", http.StatusInternalServerError)
+		return nil, ""
+	}
+
+	// Unlisted galleries are for people with the link, not search engines
+	if gallery.Visibility == models.VisibilityUnlisted {
+		w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+	}
+
+	return gallery, role
+}
+
+func unlockCookieName(galleryID int) string {
+	return fmt.Sprintf("gallery_%d", galleryID)
+}
+
+// The signature covers the password hash so changing or removing the
+// passphrase locks out everyone who entered the old one
+func (g Galleries) unlockSignature(gallery *models.Gallery, expires int64) string {
+	mac := hmac.New(sha256.New, g.UnlockKey)
+	fmt.Fprintf(mac, "%d|%d|%s", gallery.ID, expires, gallery.PasswordHash)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Whether the current visitor still needs to enter the gallery's passphrase.
+// The owner and members never do
+func (g Galleries) locked(r *http.Request, gallery *models.Gallery, role string) bool {
+	if !gallery.HasPassword() || role != "" {
+		return false
+	}
+
+	galleryPath := fmt.Sprintf("/galleries/%d", gallery.ID)
+	value, err := g.Cookies.readCookie(r, unlockCookieName(gallery.ID), galleryPath)
+	if err != nil {
+		return true
+	}
+
+	expiresStr, signature, ok := strings.Cut(value, ".")
+	if !ok {
+		return true
+	}
+
+	expires, err := strconv.ParseInt(expiresStr, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return true
+	}
+
+	expected := g.unlockSignature(gallery, expires)
+	return !hmac.Equal([]byte(signature), []byte(expected))
+}
+
+func (g Galleries) renderUnlock(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, errs ...error) {
+	var data struct {
+		ID    int
+		Title string
+	}
+
+	data.ID = gallery.ID
+	data.Title = gallery.Title
+	g.Templates.Unlock.Execute(w, r, data, errs...)
+}
+
+// Check a visitor's passphrase and give them a cookie, scoped to just this
+// gallery, that lets them view it and its images for UnlockDuration
+func (g Galleries) Unlock(w http.ResponseWriter, r *http.Request) {
+	gallery, role := g.galleryFor(w, r, models.ActionView)
+	if gallery == nil {
 		return
 	}
+
+	galleryPath := fmt.Sprintf("/galleries/%d", gallery.ID)
+	if !g.locked(r, gallery, role) {
+		http.Redirect(w, r, galleryPath, http.StatusFound)
+		return
+	}
+
+	ok, err := g.GalleryService.CheckPassword(gallery, r.FormValue("password"))
+	if err != nil {
+		fmt.Println(err)
+		g.renderUnlock(w, r, gallery, ErrGeneric)
+		return
+	}
+	if !ok {
+		err := errors.Public(models.ErrInvalidCredentials, "Incorrect password")
+		g.renderUnlock(w, r, gallery, err)
+		return
+	}
+
+	expires := time.Now().Add(UnlockDuration)
+	cookie := g.Cookies.newCookie(unlockCookieName(gallery.ID),
+		fmt.Sprintf("%d.%s", expires.Unix(), g.unlockSignature(gallery, expires.Unix())),
+		galleryPath)
+	cookie.Expires = expires
+	http.SetCookie(w, cookie)
+
+	http.Redirect(w, r, galleryPath, http.StatusFound)
+}
+
+func (g Galleries) Show(w http.ResponseWriter, r *http.Request) {
+	gallery, role := g.galleryFor(w, r, models.ActionView)
+	if gallery == nil {
+		return
+	}
+
+	if g.locked(r, gallery, role) {
+		g.renderUnlock(w, r, gallery)
+		return
+	}
+
+	g.renderShow(w, r, gallery, fmt.Sprintf("/galleries/%d/images/", gallery.ID))
+}
+
+// Render a gallery read-only with its images served from under imagePath
+func (g Galleries) renderShow(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, imagePath string) {
 	type Image struct {
-		GalleryID    int
-		Filename     string
-		FilenameSafe string
+		URL        string
+		Filename   string
+		Width      int
+		Height     int
+		CameraInfo string
 	}
 
 	var data struct {
@@ -206,9 +521,11 @@ func (g Galleries) Show(w http.ResponseWriter, r *http.Request) {
 
 	for _, image := range images {
 		data.Images = append(data.Images, Image{
-			GalleryID:    image.GalleryID,
-			Filename:     image.Filename,
-			FilenameSafe: url.PathEscape(image.Filename),
+			URL:        imagePath + url.PathEscape(image.Filename),
+			Filename:   image.Filename,
+			Width:      image.Width,
+			Height:     image.Height,
+			CameraInfo: image.CameraInfo,
 		})
 	}
 
@@ -216,12 +533,21 @@ func (g Galleries) Show(w http.ResponseWriter, r *http.Request) {
 }
 
 func (g Galleries) Image(w http.ResponseWriter, r *http.Request) {
-	filename := chi.URLParam(r, "filename")
-	galleryID, err := strconv.Atoi(chi.URLParam(r, "id"))
-	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusNotFound)
+	gallery, role := g.galleryFor(w, r, models.ActionView)
+	if gallery == nil {
+		return
+	}
+
+	if g.locked(r, gallery, role) {
+		http.Error(w, "This gallery is password protected", http.StatusForbidden)
+		return
 	}
 
+	g.serveImage(w, r, gallery.ID, chi.URLParam(r, "filename"))
+}
+
+// Write an image, or the variant asked for with ?size=, to the response
+func (g Galleries) serveImage(w http.ResponseWriter, r *http.Request, galleryID int, filename string) {
 	image, err := g.GalleryService.Image(galleryID, filename)
 	if errors.Is(err, models.ErrNotFound) {
 		http.Error(w, "Image not found", http.StatusNotFound)
@@ -232,5 +558,348 @@ func (g Galleries) Image(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	http.ServeFile(w, r, image.Path)
+	contents, err := g.GalleryService.OpenImageSize(image, r.FormValue("size"))
+	if errors.Is(err, models.ErrInvalidSize) {
+		http.Error(w, "Invalid image size", http.StatusBadRequest)
+		return
+	} else if errors.Is(err, models.ErrNotFound) {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong..", http.StatusInternalServerError)
+		return
+	}
+	defer contents.Close()
+
+	// Never let the browser guess - a sniffed type is how an image that is
+	// also valid HTML ends up executing
+	contentType := image.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(image.Filename))
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+
+	// Local files can be seeked so range requests work, anything else is
+	// streamed straight through
+	if rs, ok := contents.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, image.Filename, image.CreatedAt, rs)
+		return
+	}
+
+	if r.FormValue("size") == "" {
+		w.Header().Set("Content-Length", strconv.FormatInt(image.Size, 10))
+	}
+	w.Header().Set("Last-Modified", image.CreatedAt.UTC().Format(http.TimeFormat))
+	io.Copy(w, contents)
+}
+
+func (g Galleries) UploadImage(w http.ResponseWriter, r *http.Request) {
+	gallery, _ := g.galleryFor(w, r, models.ActionUpload)
+	if gallery == nil {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize)
+	err := r.ParseMultipartForm(MaxUploadSize)
+	if err != nil {
+		http.Error(w, "Upload is too large or malformed", http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	fileHeaders := r.MultipartForm.File["images"]
+	for _, fileHeader := range fileHeaders {
+		file, err := fileHeader.Open()
+		if err != nil {
+			http.Error(w, "Something went wrong...", http.StatusInternalServerError)
+			return
+		}
+
+		err = g.GalleryService.CreateImage(gallery.ID, fileHeader.Filename, file)
+		file.Close()
+		if err != nil {
+			for _, uploadErr := range uploadErrors {
+				if errors.Is(err, uploadErr) {
+					msg := fmt.Sprintf("%v: %v", fileHeader.Filename, uploadErr)
+					http.Error(w, msg, http.StatusBadRequest)
+					return
+				}
+			}
+			fmt.Println(err)
+			http.Error(w, "Something went wrong...", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+func (g Galleries) DeleteImage(w http.ResponseWriter, r *http.Request) {
+	gallery, _ := g.galleryFor(w, r, models.ActionEdit)
+	if gallery == nil {
+		return
+	}
+
+	err := g.GalleryService.DeleteImage(gallery.ID, chi.URLParam(r, "filename"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) ||
+			errors.Is(err, models.ErrInvalidFilename) {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong...", http.StatusInternalServerError)
+		return
+	}
+
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// The scheme and host the request was made to, for building links that are
+// sent out of the app
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+func (g Galleries) CreateShareLink(w http.ResponseWriter, r *http.Request) {
+	gallery, role := g.galleryFor(w, r, models.ActionManage)
+	if gallery == nil {
+		return
+	}
+
+	// Both are optional, falling back to the service's duration and no
+	// view limit
+	days, _ := strconv.Atoi(r.FormValue("expires_days"))
+	maxViews, _ := strconv.Atoi(r.FormValue("max_views"))
+
+	link, err := g.ShareLinkService.Create(gallery.ID, time.Duration(days)*24*time.Hour, maxViews)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong...", http.StatusInternalServerError)
+		return
+	}
+
+	shareURL := baseURL(r) + "/s/" + url.PathEscape(link.Token)
+
+	g.renderEdit(w, r, gallery, role, shareURL, "")
+}
+
+func (g Galleries) RevokeShareLink(w http.ResponseWriter, r *http.Request) {
+	gallery, _ := g.galleryFor(w, r, models.ActionManage)
+	if gallery == nil {
+		return
+	}
+
+	linkID, err := strconv.Atoi(chi.URLParam(r, "linkID"))
+	if err != nil {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+
+	err = g.ShareLinkService.Delete(gallery.ID, linkID)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Share link not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong...", http.StatusInternalServerError)
+		return
+	}
+
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// Keep share tokens out of search engines and Referer headers sent to
+// anything the page links to
+func shareHeaders(w http.ResponseWriter) {
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+}
+
+// Show a gallery to anyone holding a share link, whatever its visibility.
+// Each page load counts as one view
+func (g Galleries) SharedShow(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+	shareHeaders(w)
+
+	link, err := g.ShareLinkService.View(token)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) ||
+			errors.Is(err, models.ErrTokenExpired) ||
+			errors.Is(err, models.ErrShareLinkUsedUp) {
+			http.Error(w, "This link has expired or is no longer valid", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong...", http.StatusInternalServerError)
+		return
+	}
+
+	gallery, err := g.GalleryService.ByID(link.GalleryID)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Gallery not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong...", http.StatusInternalServerError)
+		return
+	}
+
+	imagesPath := "/s/" + url.PathEscape(token) + "/images/"
+	if link.MaxViews > 0 && link.Views >= link.MaxViews {
+		g.grantLastView(w, token, imagesPath, link.GalleryID)
+	}
+
+	g.renderShow(w, r, gallery, imagesPath)
+}
+
+const cookieLastView = "last_view"
+
+func (g Galleries) lastViewSignature(token string, galleryID int, expires int64) string {
+	mac := hmac.New(sha256.New, g.UnlockKey)
+	fmt.Fprintf(mac, "share|%s|%d|%d", token, galleryID, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Once a link's views are used up its images stop loading, except for the
+// page that used the last view which gets a signed cookie to finish with
+func (g Galleries) grantLastView(w http.ResponseWriter, token, imagesPath string, galleryID int) {
+	expires := time.Now().Add(UnlockDuration)
+	cookie := g.Cookies.newCookie(cookieLastView, fmt.Sprintf("%d.%d.%s", galleryID, expires.Unix(),
+		g.lastViewSignature(token, galleryID, expires.Unix())), imagesPath)
+	cookie.Expires = expires
+	http.SetCookie(w, cookie)
+}
+
+// The gallery the request's last view cookie is for, or 0 if it has none
+// that is valid for this link
+func (g Galleries) lastView(r *http.Request, token string) int {
+	imagesPath := "/s/" + url.PathEscape(token) + "/images/"
+	value, err := g.Cookies.readCookie(r, cookieLastView, imagesPath)
+	if err != nil {
+		return 0
+	}
+
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 {
+		return 0
+	}
+
+	galleryID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0
+	}
+
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return 0
+	}
+
+	expected := g.lastViewSignature(token, galleryID, expires)
+	if !hmac.Equal([]byte(parts[2]), []byte(expected)) {
+		return 0
+	}
+	return galleryID
+}
+
+// Serve an image from a shared gallery. Images don't use up views, but
+// stop loading as soon as the link expires, is revoked or runs out of views
+func (g Galleries) SharedImage(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+	shareHeaders(w)
+
+	link, err := g.ShareLinkService.Check(token)
+	if err != nil {
+		if errors.Is(err, models.ErrShareLinkUsedUp) {
+			if galleryID := g.lastView(r, token); galleryID != 0 {
+				g.serveImage(w, r, galleryID, chi.URLParam(r, "filename"))
+				return
+			}
+		}
+		if errors.Is(err, models.ErrNotFound) ||
+			errors.Is(err, models.ErrTokenExpired) ||
+			errors.Is(err, models.ErrShareLinkUsedUp) {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong...", http.StatusInternalServerError)
+		return
+	}
+
+	g.serveImage(w, r, link.GalleryID, chi.URLParam(r, "filename"))
+}
+
+// Give another user a role in the gallery and email them a link to it. Only
+// people who already have an account can be added
+func (g Galleries) AddMember(w http.ResponseWriter, r *http.Request) {
+	gallery, role := g.galleryFor(w, r, models.ActionManage)
+	if gallery == nil {
+		return
+	}
+
+	email := strings.ToLower(strings.TrimSpace(r.FormValue("email")))
+	member, err := g.GalleryService.AddMember(gallery, email, r.FormValue("role"))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			err = errors.Public(err, fmt.Sprintf("There's no account for %s, they need to sign up before they can be added", email))
+		case errors.Is(err, models.ErrInvalidRole), errors.Is(err, models.ErrMemberIsOwner):
+			err = errors.Public(err, err.Error())
+		}
+		g.renderEdit(w, r, gallery, role, "", "", err)
+		return
+	}
+
+	// The member has been added either way, so a failed email is only
+	// logged
+	user := context.User(r.Context())
+	galleryURL := fmt.Sprintf("%s/galleries/%d", baseURL(r), gallery.ID)
+	inviter := user.Forename + " " + user.Surname
+	sendInBackground(func() error {
+		return g.EmailService.GalleryInvite(member.Email, inviter,
+			gallery.Title, member.Role, galleryURL)
+	})
+
+	notice := fmt.Sprintf("%s has been added and sent a link to the gallery", member.Email)
+	g.renderEdit(w, r, gallery, role, "", notice)
+}
+
+func (g Galleries) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	gallery, _ := g.galleryFor(w, r, models.ActionManage)
+	if gallery == nil {
+		return
+	}
+
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+
+	err = g.GalleryService.RemoveMember(gallery.ID, userID)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Member not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong...", http.StatusInternalServerError)
+		return
+	}
+
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
 }
@@ -0,0 +1,62 @@
+package controllers
+
+import (
+	stdcontext "context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"taran1s.share/context"
+	"taran1s.share/errors"
+	"taran1s.share/models"
+)
+
+// An address without an account is refused in so many words rather than
+// looking like it was added
+func TestAddMemberUnknownAddress(t *testing.T) {
+	db := testDB(t)
+	owner := testUser(t, db, "owner@example.com")
+
+	g := Galleries{
+		GalleryService:   &models.GalleryService{DB: db},
+		ShareLinkService: &models.ShareLinkService{DB: db},
+	}
+	edit := &fakeTemplate{}
+	g.Templates.Edit = edit
+
+	gallery, err := g.GalleryService.Create("Holiday", owner.ID)
+	if err != nil {
+		t.Fatalf("Create() err = %v", err)
+	}
+
+	form := url.Values{"email": {" Nobody@Example.com "}, "role": {models.RoleViewer}}
+	r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/galleries/%d/members", gallery.ID),
+		strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	route := chi.NewRouteContext()
+	route.URLParams.Add("id", fmt.Sprint(gallery.ID))
+	ctx := context.WithUser(r.Context(), owner)
+	r = r.WithContext(stdcontext.WithValue(ctx, chi.RouteCtxKey, route))
+	g.AddMember(httptest.NewRecorder(), r)
+
+	if len(edit.errs) != 1 {
+		t.Fatalf("edit page errors = %v, want one", edit.errs)
+	}
+	var pubErr interface{ Public() string }
+	want := "There's no account for nobody@example.com, they need to sign up before they can be added"
+	if !errors.As(edit.errs[0], &pubErr) || pubErr.Public() != want {
+		t.Errorf("error = %v, want %q shown", edit.errs[0], want)
+	}
+
+	members, err := g.GalleryService.Members(gallery.ID)
+	if err != nil {
+		t.Fatalf("Members() err = %v", err)
+	}
+	if len(members) != 0 {
+		t.Errorf("Members() = %+v, want none", members)
+	}
+}
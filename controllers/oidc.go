@@ -0,0 +1,204 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"taran1s.share/context"
+	"taran1s.share/errors"
+	"taran1s.share/models"
+)
+
+const (
+	CookieOIDC = "oidc_state"
+	// The state cookie is only needed by the callback
+	oidcPath = "/auth/oidc"
+)
+
+// The sign in page also offers the identity provider when one is set up
+func (u Users) renderSignIn(w http.ResponseWriter, r *http.Request, data *models.NewUser, errs ...error) {
+	page := struct {
+		*models.NewUser
+		OIDC string
+	}{NewUser: data}
+
+	if u.OIDCService != nil {
+		page.OIDC = u.OIDCService.Name()
+	}
+
+	u.Templates.SignIn.Execute(w, r, page, errs...)
+}
+
+// Send the user to the identity provider. The state cookie has to survive
+// the redirect back from another site, so it is always SameSite=Lax
+func (u Users) beginOIDC(w http.ResponseWriter, r *http.Request, linkUserID int, remember bool) error {
+	login, err := u.OIDCService.Begin(r.Context(), linkUserID, remember)
+	if err != nil {
+		return err
+	}
+
+	cookie := u.Cookies.newCookie(CookieOIDC, login.State, oidcPath)
+	cookie.SameSite = http.SameSiteLaxMode
+	cookie.MaxAge = int(models.DefaultOIDCLoginDuration.Seconds())
+	http.SetCookie(w, cookie)
+
+	http.Redirect(w, r, login.AuthURL, http.StatusFound)
+	return nil
+}
+
+func (u Users) OIDCSignIn(w http.ResponseWriter, r *http.Request) {
+	if u.OIDCService == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	remember := r.FormValue("remember_me") == "on"
+	err := u.beginOIDC(w, r, 0, remember)
+	if err != nil {
+		fmt.Println(err)
+		err = errors.Public(err, models.ErrOIDCFailed.Error())
+		u.renderSignIn(w, r, &models.NewUser{}, err)
+		return
+	}
+}
+
+// Where the identity provider sends the user back to
+func (u Users) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if u.OIDCService == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	expired := u.Cookies.newCookie(CookieOIDC, "", oidcPath)
+	expired.MaxAge = -1
+	http.SetCookie(w, expired)
+
+	if r.FormValue("error") != "" {
+		err := fmt.Errorf("oidc callback: %s: %s", r.FormValue("error"), r.FormValue("error_description"))
+		err = errors.Public(err, "Signing in with "+u.OIDCService.Name()+" was cancelled")
+		u.renderSignIn(w, r, &models.NewUser{}, err)
+		return
+	}
+
+	// The state has to match the cookie so nobody can sign a victim in to
+	// the attacker's account by sending them a callback URL
+	state := r.FormValue("state")
+	cookieState, err := u.Cookies.readCookie(r, CookieOIDC, oidcPath)
+	if err != nil || subtle.ConstantTimeCompare([]byte(state), []byte(cookieState)) != 1 {
+		err = errors.Public(fmt.Errorf("oidc callback: state mismatch"), models.ErrOIDCFailed.Error())
+		u.renderSignIn(w, r, &models.NewUser{}, err)
+		return
+	}
+
+	login, claims, err := u.OIDCService.Finish(r.Context(), state, r.FormValue("code"))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound), errors.Is(err, models.ErrTokenExpired):
+			err = errors.Public(err, "That took too long, please try again")
+		case errors.Is(err, models.ErrOIDCFailed):
+			fmt.Println(err)
+			err = errors.Public(err, models.ErrOIDCFailed.Error())
+		}
+		u.renderSignIn(w, r, &models.NewUser{}, err)
+		return
+	}
+
+	if login.LinkUserID != 0 {
+		err = u.IdentityService.Link(login.LinkUserID, claims)
+		if err != nil {
+			if errors.Is(err, models.ErrIdentityLinked) {
+				err = errors.Public(err, err.Error())
+			}
+			u.renderIdentities(w, r, login.LinkUserID, err)
+			return
+		}
+		http.Redirect(w, r, "/users/me/identities", http.StatusFound)
+		return
+	}
+
+	user, err := u.IdentityService.SignIn(claims)
+	if err != nil {
+		if errors.Is(err, models.ErrIdentityNotLinked) {
+			err = errors.Public(err, err.Error())
+		} else if errors.Is(err, models.ErrOIDCFailed) {
+			fmt.Println(err)
+			err = errors.Public(err, models.ErrOIDCFailed.Error())
+		}
+		u.renderSignIn(w, r, &models.NewUser{Email: claims.Email}, err)
+		return
+	}
+
+	err = u.signIn(w, r, user, login.Remember)
+	if err != nil {
+		u.renderSignIn(w, r, &models.NewUser{}, err)
+		return
+	}
+}
+
+func (u Users) renderIdentities(w http.ResponseWriter, r *http.Request, userID int, errs ...error) {
+	identities, err := u.IdentityService.ByUserID(userID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong..", http.StatusInternalServerError)
+		return
+	}
+
+	var data struct {
+		Provider   string
+		Identities []models.Identity
+	}
+	data.Identities = identities
+	if u.OIDCService != nil {
+		data.Provider = u.OIDCService.Name()
+	}
+
+	u.Templates.Identities.Execute(w, r, data, errs...)
+}
+
+// Accounts at identity providers the user can sign in with
+func (u Users) Identities(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	u.renderIdentities(w, r, user.ID)
+}
+
+func (u Users) LinkIdentity(w http.ResponseWriter, r *http.Request) {
+	if u.OIDCService == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	user := context.User(r.Context())
+	err := u.beginOIDC(w, r, user.ID, false)
+	if err != nil {
+		fmt.Println(err)
+		err = errors.Public(err, models.ErrOIDCFailed.Error())
+		u.renderIdentities(w, r, user.ID, err)
+		return
+	}
+}
+
+func (u Users) UnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+
+	err = u.IdentityService.Unlink(user.ID, id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Linked account not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong..", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/users/me/identities", http.StatusFound)
+}
@@ -0,0 +1,87 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"taran1s.share/errors"
+	"taran1s.share/models"
+)
+
+// Records what a page was rendered with
+type fakeTemplate struct {
+	data interface{}
+	errs []error
+}
+
+func (tpl *fakeTemplate) Execute(w http.ResponseWriter, r *http.Request, data interface{}, errs ...error) {
+	tpl.data = data
+	tpl.errs = errs
+}
+
+// A callback is refused before the code is used unless its state matches
+// the cookie set for this browser, so no database is needed
+func TestOIDCCallbackState(t *testing.T) {
+	tests := map[string]struct {
+		query  string
+		cookie string
+		want   string
+	}{
+		"no cookie": {
+			query: "?state=abc&code=xyz",
+			want:  models.ErrOIDCFailed.Error(),
+		},
+		"different state": {
+			query:  "?state=abc&code=xyz",
+			cookie: "abd",
+			want:   models.ErrOIDCFailed.Error(),
+		},
+		"no state": {
+			query:  "?code=xyz",
+			cookie: "abc",
+			want:   models.ErrOIDCFailed.Error(),
+		},
+		"cancelled at the provider": {
+			query:  "?error=access_denied&state=abc",
+			cookie: "abc",
+			want:   "Signing in with Example ID was cancelled",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			signIn := &fakeTemplate{}
+			u := Users{
+				OIDCService: &models.OIDCService{Config: models.OIDCConfig{Name: "Example ID"}},
+			}
+			u.Templates.SignIn = signIn
+
+			r := httptest.NewRequest(http.MethodGet, "/auth/oidc/callback"+tc.query, nil)
+			if tc.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: CookieOIDC, Value: tc.cookie})
+			}
+			w := httptest.NewRecorder()
+			u.OIDCCallback(w, r)
+
+			if len(signIn.errs) != 1 {
+				t.Fatalf("sign in page errors = %v, want one", signIn.errs)
+			}
+			var pubErr interface{ Public() string }
+			if !errors.As(signIn.errs[0], &pubErr) || pubErr.Public() != tc.want {
+				t.Errorf("error = %v, want %q shown", signIn.errs[0], tc.want)
+			}
+
+			// The state cookie is cleared whatever happens
+			cleared := false
+			for _, cookie := range w.Result().Cookies() {
+				if cookie.Name == CookieOIDC && cookie.MaxAge < 0 {
+					cleared = true
+				}
+			}
+			if !cleared {
+				t.Error("state cookie wasn't cleared")
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"net/url"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+	"taran1s.share/migrations"
+	"taran1s.share/models"
+	"taran1s.share/rand"
+)
+
+// Tests that need a database run against the one in TEST_DATABASE_URL and
+// are skipped when it isn't set, the same as in the models package. Each
+// test gets a freshly migrated schema of its own, which is dropped
+// afterwards
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	admin, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatalf("open test database: %v", err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	suffix, err := rand.Bytes(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := "test_" + hex.EncodeToString(suffix)
+
+	_, err = admin.Exec(`CREATE SCHEMA ` + schema)
+	if err != nil {
+		t.Fatalf("create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		_, err := admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`)
+		if err != nil {
+			t.Errorf("drop schema: %v", err)
+		}
+	})
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatalf("TEST_DATABASE_URL must be a postgres:// URL: %v", err)
+	}
+	query := u.Query()
+	query.Set("search_path", schema)
+	u.RawQuery = query.Encode()
+
+	db, err := sql.Open("pgx", u.String())
+	if err != nil {
+		t.Fatalf("open test schema: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	err = models.MigrateFS(db, migrations.FS, ".")
+	if err != nil {
+		t.Fatalf("migrate test schema: %v", err)
+	}
+
+	return db
+}
+
+// Make a user with the password "correct horse battery", hashed cheaply
+func testUser(t *testing.T, db *sql.DB, email string) *models.User {
+	t.Helper()
+
+	service := &models.UserService{
+		DB:        db,
+		Passwords: &models.PasswordHasher{PasswordConfig: models.PasswordConfig{BcryptCost: bcrypt.MinCost}},
+	}
+	user, err := service.Create(&models.NewUser{
+		Email:       email,
+		Forename:    "Test",
+		Surname:     "User",
+		Password:    "correct horse battery",
+		ConfirmPass: "correct horse battery",
+	})
+	if err != nil {
+		t.Fatalf("create user %s: %v", email, err)
+	}
+	return user
+}
@@ -0,0 +1,94 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"taran1s.share/errors"
+	"taran1s.share/models"
+)
+
+type signInLinkData struct {
+	Email string
+	// Set on the page the link opens, which asks the user to confirm
+	Token string
+}
+
+// Email the user a link that signs them in without their password
+func (u Users) ProcessSignInLink(w http.ResponseWriter, r *http.Request) {
+	data := signInLinkData{
+		Email: r.FormValue("email"),
+	}
+
+	link, err := u.SignInLinkService.Create(data.Email)
+	if err != nil {
+		// Unknown addresses and repeat requests get the same page, so the
+		// form can't be used to find out who has an account
+		if errors.Is(err, models.ErrNotFound) || errors.Is(err, models.ErrResendTooSoon) {
+			u.Templates.SignInLink.Execute(w, r, data)
+			return
+		}
+		u.renderSignIn(w, r, &models.NewUser{Email: data.Email}, err)
+		return
+	}
+
+	vals := url.Values{
+		"token": {link.Token},
+	}
+	signInURL := baseURL(r) + "/signin/link?" + vals.Encode()
+
+	sendInBackground(func() error {
+		return u.EmailService.SignInLink(data.Email, signInURL)
+	})
+
+	u.Templates.SignInLink.Execute(w, r, data)
+}
+
+func signInLinkError(err error) error {
+	if errors.Is(err, models.ErrNotFound) || errors.Is(err, models.ErrTokenExpired) {
+		return errors.Public(err, "That sign in link is invalid or has expired")
+	}
+	return err
+}
+
+// Where the emailed link lands. Mail scanners follow links to check them,
+// so this only asks the user to confirm and the link is used up by the
+// form it posts
+func (u Users) SignInLink(w http.ResponseWriter, r *http.Request) {
+	// Keep the token out of the Referer header sent for the page's assets
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	token := r.FormValue("token")
+	user, err := u.SignInLinkService.User(token)
+	if err != nil {
+		u.renderSignIn(w, r, &models.NewUser{}, signInLinkError(err))
+		return
+	}
+
+	u.Templates.SignInLink.Execute(w, r, signInLinkData{
+		Email: user.Email,
+		Token: token,
+	})
+}
+
+func (u Users) ConfirmSignInLink(w http.ResponseWriter, r *http.Request) {
+	user, err := u.SignInLinkService.Consume(r.FormValue("token"))
+	if err != nil {
+		u.renderSignIn(w, r, &models.NewUser{}, signInLinkError(err))
+		return
+	}
+
+	// Following the link proves the address is theirs
+	err = u.EmailVerificationService.MarkVerified(user.ID)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	remember := r.FormValue("remember_me") == "on"
+	err = u.signIn(w, r, user, remember)
+	if err != nil {
+		u.renderSignIn(w, r, &models.NewUser{}, err)
+		return
+	}
+}
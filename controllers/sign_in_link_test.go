@@ -0,0 +1,66 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"taran1s.share/models"
+)
+
+// Following a sign in link forgets earlier wrong passwords, the same as
+// signing in with the right one
+func TestConfirmSignInLinkResetsThrottle(t *testing.T) {
+	db := testDB(t)
+	user := testUser(t, db, "jo@example.com")
+
+	store := &models.MemoryThrottleStore{}
+	u := Users{
+		SessionService:           &models.SessionService{DB: db},
+		EmailVerificationService: &models.EmailVerificationService{DB: db},
+		SignInLinkService:        &models.SignInLinkService{DB: db},
+		TOTPService:              &models.TOTPService{DB: db},
+		WebAuthnService:          &models.WebAuthnService{DB: db},
+		SignInThrottle:           models.NewSignInThrottle(store),
+	}
+	u.Templates.SignIn = &fakeTemplate{}
+
+	for i := 0; i < 3; i++ {
+		err := u.SignInThrottle.Reserve("10.0.0.1", "Jo@Example.com")
+		if err != nil {
+			t.Fatalf("Reserve() err = %v", err)
+		}
+		_, err = u.SignInThrottle.Fail("Jo@Example.com")
+		if err != nil {
+			t.Fatalf("Fail() err = %v", err)
+		}
+	}
+	// Where the sign in throttle keeps the count for the address
+	state, err := store.Get("signin:email:jo@example.com")
+	if err != nil || state.Attempts != 3 {
+		t.Fatalf("attempts before the link = %+v, %v, want 3", state, err)
+	}
+
+	link, err := u.SignInLinkService.Create(user.Email)
+	if err != nil {
+		t.Fatalf("Create() err = %v", err)
+	}
+
+	form := url.Values{"token": {link.Token}}
+	r := httptest.NewRequest(http.MethodPost, "/signin/link/confirm", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	u.ConfirmSignInLink(w, r)
+
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/users/me" {
+		t.Fatalf("ConfirmSignInLink() = %d to %q, want a redirect to /users/me",
+			w.Code, w.Header().Get("Location"))
+	}
+
+	state, err = store.Get("signin:email:jo@example.com")
+	if err != nil || state.Attempts != 0 {
+		t.Errorf("attempts after the link = %+v, %v, want none", state, err)
+	}
+}
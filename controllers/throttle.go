@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+
+	"taran1s.share/errors"
+	"taran1s.share/models"
+)
+
+// A rough wait such as "30 seconds" or "5 minutes", rounded up
+func retryIn(d time.Duration) string {
+	if d < time.Minute {
+		seconds := int(math.Ceil(d.Seconds()))
+		if seconds <= 1 {
+			return "1 second"
+		}
+		return fmt.Sprintf("%d seconds", seconds)
+	}
+
+	minutes := int(math.Ceil(d.Minutes()))
+	if minutes == 1 {
+		return "1 minute"
+	}
+	return fmt.Sprintf("%d minutes", minutes)
+}
+
+// Tell the user how long to wait when a throttle turns them away
+func throttleError(err error) error {
+	var throttled *models.ThrottleError
+	if !errors.As(err, &throttled) {
+		return err
+	}
+
+	wait := retryIn(throttled.RetryAfter)
+	if errors.Is(err, models.ErrAccountLocked) {
+		return errors.Public(err, fmt.Sprintf(
+			"%s. Try again in %s, or sign in another way", models.ErrAccountLocked, wait))
+	}
+	return errors.Public(err, fmt.Sprintf("Too many attempts, please try again in %s", wait))
+}
+
+// Count an attempt at a password or code against the email address and
+// client before it is checked. The error is ready to show
+func (u Users) reserveAttempt(r *http.Request, email string) error {
+	err := u.SignInThrottle.Reserve(clientIP(r), email)
+	if err != nil {
+		return throttleError(err)
+	}
+	return nil
+}
+
+// Take back a reserved attempt that was right, or that couldn't be checked
+func (u Users) releaseAttempt(r *http.Request, email string) {
+	err := u.SignInThrottle.Release(clientIP(r), email)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// Keep a reserved attempt that was wrong, and warn the account owner when
+// that locks the account
+func (u Users) signInFailed(r *http.Request, email string) {
+	ip := clientIP(r)
+	locked, err := u.SignInThrottle.Fail(email)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if !locked {
+		return
+	}
+
+	vals := url.Values{
+		"email": {email},
+	}
+	resetURL := baseURL(r) + "/forgot-pw?" + vals.Encode()
+	until := time.Now().Add(u.SignInThrottle.Email.LockFor)
+
+	// Addresses without an account are locked too, so only the email
+	// shows which is which
+	sendInBackground(func() error {
+		user, err := u.UserService.ByEmail(email)
+		if errors.Is(err, models.ErrNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		return u.EmailService.AccountLocked(user.Email, ip, until, resetURL)
+	})
+}
@@ -0,0 +1,356 @@
+package controllers
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+
+	"taran1s.share/context"
+	"taran1s.share/errors"
+	"taran1s.share/models"
+)
+
+const (
+	CookieChallenge = "login_challenge"
+	// The challenge cookie is only needed by the second sign in step
+	challengePath = "/signin"
+)
+
+// Park a sign in that passed the password check until the second factor
+// is entered
+func (u Users) startChallenge(w http.ResponseWriter, userID int, remember bool) error {
+	challenge, err := u.LoginChallengeService.Create(userID, remember)
+	if err != nil {
+		return err
+	}
+
+	cookie := u.Cookies.newCookie(CookieChallenge, challenge.Token, challengePath)
+	cookie.Expires = challenge.ExpiresAt
+	http.SetCookie(w, cookie)
+	return nil
+}
+
+func (u Users) endChallenge(w http.ResponseWriter) {
+	cookie := u.Cookies.newCookie(CookieChallenge, "", challengePath)
+	cookie.MaxAge = -1
+	http.SetCookie(w, cookie)
+}
+
+// Which second factors the user has set up. Either one means signing in
+// with a password needs a challenge
+func (u Users) secondFactors(userID int) (totp, keys bool, err error) {
+	totp, err = u.TOTPService.Enabled(userID)
+	if err != nil {
+		return false, false, err
+	}
+
+	keys, err = u.WebAuthnService.Enabled(userID)
+	if err != nil {
+		return false, false, err
+	}
+
+	return totp, keys, nil
+}
+
+func (u Users) loginChallenge(r *http.Request) (*models.LoginChallenge, error) {
+	token, err := u.Cookies.readCookie(r, CookieChallenge, challengePath)
+	if err != nil {
+		return nil, models.ErrNotFound
+	}
+
+	return u.LoginChallengeService.ByToken(token)
+}
+
+// The challenge for the current sign in, or nil if there isn't a usable one
+// in which case the user is sent back to enter their password
+func (u Users) challenge(w http.ResponseWriter, r *http.Request) *models.LoginChallenge {
+	challenge, err := u.loginChallenge(r)
+	if err != nil {
+		if !errors.Is(err, models.ErrNotFound) &&
+			!errors.Is(err, models.ErrTokenExpired) &&
+			!errors.Is(err, models.ErrTooManyAttempts) {
+			fmt.Println(err)
+		}
+		u.endChallenge(w)
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return nil
+	}
+
+	return challenge
+}
+
+// Take one of the challenge's attempts and reserve one with the sign in
+// throttle before an answer is checked, turning the user away while they
+// are locked out. When the challenge is used up it is ended and
+// ErrTooManyAttempts returned
+func (u Users) attemptChallenge(w http.ResponseWriter, r *http.Request, challenge *models.LoginChallenge) error {
+	err := u.reserveAttempt(r, challenge.Email)
+	if err != nil {
+		return err
+	}
+
+	err = u.LoginChallengeService.Attempt(challenge)
+	if err != nil {
+		u.releaseAttempt(r, challenge.Email)
+	}
+	if errors.Is(err, models.ErrTooManyAttempts) {
+		u.endChallenge(w)
+		return errors.Public(err, "Too many attempts, please sign in again")
+	}
+	return err
+}
+
+// Count a wrong answer against the same throttle as a wrong password, so
+// signing in again doesn't give a fresh set of guesses. Returns true if
+// the challenge is used up and the user has to start again
+func (u Users) failChallenge(w http.ResponseWriter, r *http.Request, challenge *models.LoginChallenge) bool {
+	u.signInFailed(r, challenge.Email)
+
+	if challenge.Attempts >= models.MaxChallengeAttempts {
+		u.endChallenge(w)
+		return true
+	}
+
+	return false
+}
+
+// Swap a passed challenge for a session. Only now that both factors are
+// done are earlier failures forgotten
+func (u Users) passChallenge(w http.ResponseWriter, r *http.Request, challenge *models.LoginChallenge) error {
+	err := u.LoginChallengeService.Delete(challenge)
+	if err != nil {
+		fmt.Println(err)
+	}
+	u.endChallenge(w)
+
+	u.releaseAttempt(r, challenge.Email)
+	err = u.SignInThrottle.Reset(challenge.Email)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	return u.startSession(w, r, challenge.UserID, challenge.Remember)
+}
+
+func (u Users) renderChallenge(w http.ResponseWriter, r *http.Request, challenge *models.LoginChallenge, errs ...error) {
+	var data struct {
+		TOTP        bool
+		SecurityKey bool
+	}
+
+	var err error
+	data.TOTP, data.SecurityKey, err = u.secondFactors(challenge.UserID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong..", http.StatusInternalServerError)
+		return
+	}
+
+	u.Templates.Challenge.Execute(w, r, data, errs...)
+}
+
+func (u Users) Challenge(w http.ResponseWriter, r *http.Request) {
+	challenge := u.challenge(w, r)
+	if challenge == nil {
+		return
+	}
+
+	u.renderChallenge(w, r, challenge)
+}
+
+// Second sign in step, accepting a code from the user's authenticator app
+// or a recovery code
+func (u Users) ProcessChallenge(w http.ResponseWriter, r *http.Request) {
+	challenge := u.challenge(w, r)
+	if challenge == nil {
+		return
+	}
+
+	err := u.attemptChallenge(w, r, challenge)
+	if errors.Is(err, models.ErrTooManyAttempts) {
+		u.renderSignIn(w, r, &models.NewUser{}, err)
+		return
+	} else if err != nil {
+		u.renderChallenge(w, r, challenge, err)
+		return
+	}
+
+	err = u.TOTPService.Verify(challenge.UserID, r.FormValue("code"))
+	if err != nil {
+		if !errors.Is(err, models.ErrInvalidCode) {
+			fmt.Println(err)
+			u.releaseAttempt(r, challenge.Email)
+			u.renderChallenge(w, r, challenge, err)
+			return
+		}
+
+		if u.failChallenge(w, r, challenge) {
+			err = errors.Public(models.ErrTooManyAttempts, "Too many attempts, please sign in again")
+			u.renderSignIn(w, r, &models.NewUser{}, err)
+			return
+		}
+
+		err = errors.Public(models.ErrInvalidCode, models.ErrInvalidCode.Error())
+		u.renderChallenge(w, r, challenge, err)
+		return
+	}
+
+	err = u.passChallenge(w, r, challenge)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
+type twoFactorData struct {
+	Enabled           bool
+	RecoveryCodesLeft int
+	// Set while the user is adding the secret to their app
+	Secret string
+	// Built by the TOTP service, so it's safe to use as a link even though
+	// html/template doesn't know the otpauth scheme
+	URI template.URL
+	// Only set straight after they are generated
+	RecoveryCodes []string
+}
+
+func (u Users) renderTwoFactor(w http.ResponseWriter, r *http.Request, data twoFactorData, errs ...error) {
+	user := context.User(r.Context())
+
+	enabled, err := u.TOTPService.Enabled(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong..", http.StatusInternalServerError)
+		return
+	}
+	data.Enabled = enabled
+
+	if enabled {
+		data.RecoveryCodesLeft, err = u.TOTPService.RecoveryCodesLeft(user.ID)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong..", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	u.Templates.TwoFactor.Execute(w, r, data, errs...)
+}
+
+func (u Users) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	u.renderTwoFactor(w, r, twoFactorData{})
+}
+
+// Generate a secret for the user to add to their authenticator app
+func (u Users) SetupTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	enrolment, err := u.TOTPService.Begin(user)
+	if err != nil {
+		if errors.Is(err, models.ErrTOTPEnabled) {
+			err = errors.Public(err, err.Error())
+		}
+		u.renderTwoFactor(w, r, twoFactorData{}, err)
+		return
+	}
+
+	u.renderTwoFactor(w, r, twoFactorData{
+		Secret: enrolment.Secret,
+		URI:    template.URL(enrolment.URI),
+	})
+}
+
+// Turn two-factor authentication on once the user shows their app
+// produces the right codes
+func (u Users) ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	codes, err := u.TOTPService.Confirm(user.ID, r.FormValue("code"))
+	if err != nil {
+		var data twoFactorData
+		enrolment, pendingErr := u.TOTPService.Pending(user)
+		if pendingErr == nil {
+			data.Secret = enrolment.Secret
+			data.URI = template.URL(enrolment.URI)
+		}
+
+		if errors.Is(err, models.ErrInvalidCode) || errors.Is(err, models.ErrTOTPNotEnrolled) {
+			err = errors.Public(err, err.Error())
+		}
+		u.renderTwoFactor(w, r, data, err)
+		return
+	}
+
+	u.renderTwoFactor(w, r, twoFactorData{
+		RecoveryCodes: codes,
+	})
+}
+
+// Check a code from the signed in user's app or one of their recovery
+// codes. Wrong codes count towards the same lockout as signing in, so they
+// can't be guessed at. The error is ready to show
+func (u Users) checkTwoFactorCode(r *http.Request, user *models.User, code string) error {
+	err := u.reserveAttempt(r, user.Email)
+	if err != nil {
+		return err
+	}
+
+	err = u.TOTPService.Verify(user.ID, code)
+	if errors.Is(err, models.ErrInvalidCode) {
+		u.signInFailed(r, user.Email)
+	} else {
+		u.releaseAttempt(r, user.Email)
+	}
+	if errors.Is(err, models.ErrInvalidCode) || errors.Is(err, models.ErrTOTPNotEnrolled) {
+		return errors.Public(err, err.Error())
+	}
+	return err
+}
+
+// Changing two-factor settings needs a current code, so someone who finds
+// the user signed in can't quietly switch it off
+func (u Users) verifyTwoFactor(w http.ResponseWriter, r *http.Request) bool {
+	user := context.User(r.Context())
+
+	err := u.checkTwoFactorCode(r, user, r.FormValue("code"))
+	if err != nil {
+		u.renderTwoFactor(w, r, twoFactorData{}, err)
+		return false
+	}
+
+	return true
+}
+
+func (u Users) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	if !u.verifyTwoFactor(w, r) {
+		return
+	}
+
+	user := context.User(r.Context())
+	codes, err := u.TOTPService.RegenerateRecoveryCodes(user.ID)
+	if err != nil {
+		u.renderTwoFactor(w, r, twoFactorData{}, err)
+		return
+	}
+
+	u.renderTwoFactor(w, r, twoFactorData{
+		RecoveryCodes: codes,
+	})
+}
+
+func (u Users) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if !u.verifyTwoFactor(w, r) {
+		return
+	}
+
+	user := context.User(r.Context())
+	err := u.TOTPService.Disable(user.ID)
+	if err != nil {
+		u.renderTwoFactor(w, r, twoFactorData{}, err)
+		return
+	}
+
+	http.Redirect(w, r, "/users/me/2fa", http.StatusFound)
+}
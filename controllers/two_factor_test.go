@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"taran1s.share/context"
+	"taran1s.share/errors"
+	"taran1s.share/models"
+)
+
+// The code an authenticator app would show for secret right now
+func testTOTPCode(t *testing.T, secret string) string {
+	t.Helper()
+
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(time.Now().Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1_000_000)
+}
+
+// Turning two-factor off needs a code, and guessing at it is throttled
+// like guessing a password
+func TestDisableTwoFactorThrottled(t *testing.T) {
+	db := testDB(t)
+	user := testUser(t, db, "jo@example.com")
+
+	totp := &models.TOTPService{DB: db}
+	enrolment, err := totp.Begin(user)
+	if err != nil {
+		t.Fatalf("Begin() err = %v", err)
+	}
+	recoveryCodes, err := totp.Confirm(user.ID, testTOTPCode(t, enrolment.Secret))
+	if err != nil {
+		t.Fatalf("Confirm() err = %v", err)
+	}
+
+	page := &fakeTemplate{}
+	u := Users{
+		TOTPService: totp,
+		SignInThrottle: &models.Throttle{
+			Store: &models.MemoryThrottleStore{},
+			Name:  "signin",
+			Email: models.ThrottlePolicy{FreeAttempts: 2, BaseDelay: time.Hour, Window: time.Hour},
+			IP:    models.ThrottlePolicy{Window: time.Hour},
+		},
+	}
+	u.Templates.TwoFactor = page
+
+	disable := func(code string) string {
+		t.Helper()
+		page.errs = nil
+
+		form := url.Values{"code": {code}}
+		r := httptest.NewRequest(http.MethodPost, "/users/me/2fa/disable", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r = r.WithContext(context.WithUser(r.Context(), user))
+		u.DisableTwoFactor(httptest.NewRecorder(), r)
+
+		if len(page.errs) != 1 {
+			t.Fatalf("two-factor page errors = %v, want one", page.errs)
+		}
+		var pubErr interface{ Public() string }
+		if !errors.As(page.errs[0], &pubErr) {
+			t.Fatalf("error = %v, want one to show", page.errs[0])
+		}
+		return pubErr.Public()
+	}
+
+	for i := 0; i < 3; i++ {
+		if got := disable("abcdef"); got != models.ErrInvalidCode.Error() {
+			t.Fatalf("wrong code %d shows %q, want %q", i+1, got, models.ErrInvalidCode)
+		}
+	}
+
+	// Even the right code has to wait now
+	got := disable(recoveryCodes[0])
+	if !strings.HasPrefix(got, "Too many attempts") {
+		t.Errorf("right code after guessing shows %q, want too many attempts", got)
+	}
+
+	enabled, err := totp.Enabled(user.ID)
+	if err != nil || !enabled {
+		t.Errorf("Enabled() = %v, %v, want still enabled", enabled, err)
+	}
+}
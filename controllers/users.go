@@ -2,9 +2,14 @@ package controllers
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/go-chi/chi/v5"
 	"taran1s.share/context"
 	"taran1s.share/errors"
 	"taran1s.share/models"
@@ -14,6 +19,9 @@ var ErrGeneric error = fmt.Errorf("Something went wrong... Please try again")
 
 type UserMiddleware struct {
 	SessionService *models.SessionService
+	Cookies        CookiePolicy
+	// What users can do before verifying their email address
+	Unverified VerificationPolicy
 }
 
 // Set up middleware that reads the session cookie from the request
@@ -21,13 +29,21 @@ type UserMiddleware struct {
 // http request context
 func (umw UserMiddleware) SetUser(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token, err := readCookie(r, CookieSession)
+		token, err := umw.Cookies.readCookie(r, CookieSession, "/")
 		if err != nil {
 			next.ServeHTTP(w, r)
 			return
 		}
 		user, err := umw.SessionService.User(token)
 		if err != nil {
+			// Clear cookies for sessions that have ended so the browser
+			// stops sending them
+			if errors.Is(err, models.ErrSessionExpired) ||
+				errors.Is(err, models.ErrNotFound) {
+				umw.Cookies.deleteCookie(w, CookieSession)
+			} else {
+				fmt.Println(err)
+			}
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -55,12 +71,98 @@ type Users struct {
 		ForgotPassword Template
 		CheckYourEmail Template
 		ResetPassword  Template
+		Devices        Template
+		TwoFactor      Template
+		Challenge      Template
+		Passkeys       Template
+		VerifyEmail    Template
+		SignInLink     Template
+		Identities     Template
+		Account        Template
 	}
 
-	UserService          *models.UserService
-	SessionService       *models.SessionService
-	PasswordResetService *models.PasswordResetService
-	EmailService         *models.EmailService
+	UserService              *models.UserService
+	SessionService           *models.SessionService
+	PasswordResetService     *models.PasswordResetService
+	EmailVerificationService *models.EmailVerificationService
+	EmailChangeService       *models.EmailChangeService
+	SignInLinkService        *models.SignInLinkService
+	IdentityService          *models.IdentityService
+	// Nil when no identity provider is configured
+	OIDCService           *models.OIDCService
+	EmailService          *models.EmailService
+	TOTPService           *models.TOTPService
+	LoginChallengeService *models.LoginChallengeService
+	WebAuthnService       *models.WebAuthnService
+	// Limits on password guessing and reset emails
+	SignInThrottle         *models.Throttle
+	ForgotPasswordThrottle *models.Throttle
+	Cookies                CookiePolicy
+}
+
+// Start a new session for the user on the device making the request and
+// set the session cookie. Remembered sessions get a persistent cookie,
+// otherwise it goes when the browser closes. Any session the browser
+// already had is ended so a token planted before sign in is never promoted
+func (u Users) startSession(w http.ResponseWriter, r *http.Request, userID int, remember bool) error {
+	if token, err := u.Cookies.readCookie(r, CookieSession, "/"); err == nil {
+		err = u.SessionService.Delete(token)
+		if err != nil {
+			return err
+		}
+	}
+
+	session, err := u.SessionService.Create(userID, r.UserAgent(), clientIP(r), remember)
+	if err != nil {
+		return err
+	}
+
+	cookie := u.Cookies.newCookie(CookieSession, session.Token, "/")
+	if remember {
+		cookie.Expires = session.ExpiresAt
+	}
+	http.SetCookie(w, cookie)
+	return nil
+}
+
+// Called whenever a user's password changes. Every existing session is
+// ended, so anyone holding the old password or a stolen token loses access,
+// and a fresh session is started on this device
+func (u Users) rotateSessions(w http.ResponseWriter, r *http.Request, userID int) error {
+	err := u.SessionService.DeleteAll(userID)
+	if err != nil {
+		return err
+	}
+
+	return u.startSession(w, r, userID, false)
+}
+
+// The address of the client making the request
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Send an email without waiting for it, so how long a request takes
+// doesn't show whether there was anyone to send it to
+func sendInBackground(send func() error) {
+	go func() {
+		err := send()
+		if err != nil {
+			fmt.Println(err)
+		}
+	}()
+}
+
+// The check your email page shown after signing up or asking for a reset.
+// It reads the same whether or not the address has an account
+type checkEmailData struct {
+	Email string
+	// Signing up rather than resetting a password
+	SignUp bool
 }
 
 func (u Users) New(w http.ResponseWriter, r *http.Request) {
@@ -84,25 +186,40 @@ func (u Users) Create(w http.ResponseWriter, r *http.Request) {
 		ConfirmPass: r.FormValue("confirm"),
 	}
 
+	base := baseURL(r)
 	user, err := u.UserService.Create(data)
 	if err != nil {
-		if errors.Is(models.ErrInvalidEmail, err) ||
-			errors.Is(models.ErrPasswordMatch, err) ||
-			errors.Is(models.ErrEmailExists, err) {
-			err = errors.Public(err, err.Error())
+		if !errors.Is(models.ErrEmailExists, err) {
+			if errors.Is(models.ErrInvalidEmail, err) {
+				err = errors.Field(err, "email", err.Error())
+			}
+			u.Templates.New.Execute(w, r, data, passwordError(err))
+			return
 		}
-		u.Templates.New.Execute(w, r, data, err)
-		return
-	}
 
-	session, err := u.SessionService.Create(user.ID)
-	if err != nil {
-		http.Redirect(w, r, "/signin", http.StatusFound)
-		return
+		// Answer as though the account was created so the form can't be
+		// used to find out who has one, and tell the owner instead
+		vals := url.Values{
+			"email": {data.Email},
+		}
+		sendInBackground(func() error {
+			return u.EmailService.SignUpAttempt(data.Email,
+				base+"/signin?"+vals.Encode(), base+"/forgot-pw?"+vals.Encode())
+		})
+	} else {
+		// The account still works if this fails, they can ask for another
+		// once they sign in
+		sendInBackground(func() error {
+			return u.sendVerification(base, user)
+		})
 	}
 
-	setCookie(w, CookieSession, session.Token)
-	http.Redirect(w, r, "/users/me", http.StatusFound)
+	// Nobody is signed in here, even for a new account, as that would
+	// give away which addresses were already taken
+	u.Templates.CheckYourEmail.Execute(w, r, checkEmailData{
+		Email:  data.Email,
+		SignUp: true,
+	})
 }
 
 func (u Users) SignIn(w http.ResponseWriter, r *http.Request) {
@@ -110,7 +227,7 @@ func (u Users) SignIn(w http.ResponseWriter, r *http.Request) {
 
 	data.Email = r.FormValue("email")
 
-	u.Templates.SignIn.Execute(w, r, data)
+	u.renderSignIn(w, r, data)
 }
 
 func (u Users) Authenticate(w http.ResponseWriter, r *http.Request) {
@@ -119,39 +236,69 @@ func (u Users) Authenticate(w http.ResponseWriter, r *http.Request) {
 		Password: r.FormValue("password"),
 	}
 
+	err := u.reserveAttempt(r, data.Email)
+	if err != nil {
+		u.renderSignIn(w, r, data, err)
+		return
+	}
+
 	user, err := u.UserService.Authenticate(data.Email, data.Password)
 
 	if err != nil {
 		if errors.Is(models.ErrInvalidCredentials, err) {
+			u.signInFailed(r, data.Email)
 			err = errors.Public(err, err.Error())
+		} else {
+			u.releaseAttempt(r, data.Email)
 		}
 
-		u.Templates.SignIn.Execute(w, r, data, err)
+		u.renderSignIn(w, r, data, err)
 		return
 	}
+	u.releaseAttempt(r, data.Email)
 
-	session, err := u.SessionService.Create(user.ID)
+	remember := r.FormValue("remember_me") == "on"
+	err = u.signIn(w, r, user, remember)
 	if err != nil {
-		u.Templates.SignIn.Execute(w, r, data, err)
+		u.renderSignIn(w, r, data, err)
 		return
 	}
-
-	setCookie(w, CookieSession, session.Token)
-	http.Redirect(w, r, "/users/me", http.StatusFound)
 }
 
-func (u Users) CurrentUser(w http.ResponseWriter, r *http.Request) {
-	user := context.User(r.Context())
-	if user == nil {
-		http.Redirect(w, r, "/signin", http.StatusFound)
-		return
+// Finish signing in someone who has proved who they are with their password
+// or a sign in link. Users with two-factor authentication get a challenge
+// instead of a session until they enter a code or use a security key, and
+// failed attempts are only forgotten once that is passed
+func (u Users) signIn(w http.ResponseWriter, r *http.Request, user *models.User, remember bool) error {
+	totp, keys, err := u.secondFactors(user.ID)
+	if err != nil {
+		return err
+	}
+
+	if totp || keys {
+		err = u.startChallenge(w, user.ID, remember)
+		if err != nil {
+			return err
+		}
+		http.Redirect(w, r, "/signin/2fa", http.StatusFound)
+		return nil
+	}
+
+	err = u.SignInThrottle.Reset(user.Email)
+	if err != nil {
+		fmt.Println(err)
 	}
 
-	fmt.Fprintf(w, "Current user: %s", user.Email)
+	err = u.startSession(w, r, user.ID, remember)
+	if err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+	return nil
 }
 
 func (u Users) SignOut(w http.ResponseWriter, r *http.Request) {
-	token, err := readCookie(r, CookieSession)
+	token, err := u.Cookies.readCookie(r, CookieSession, "/")
 	if err != nil {
 		http.Redirect(w, r, "/signin", http.StatusFound)
 		return
@@ -163,7 +310,7 @@ func (u Users) SignOut(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	deleteCookie(w, CookieSession)
+	u.Cookies.deleteCookie(w, CookieSession)
 
 	http.Redirect(w, r, "/signin", http.StatusFound)
 }
@@ -183,8 +330,28 @@ func (u Users) ProcessForgotPassword(w http.ResponseWriter, r *http.Request) {
 	}
 	data.Email = r.FormValue("email")
 
+	// Every request counts, whether or not the address has an account
+	ip := clientIP(r)
+	err := u.ForgotPasswordThrottle.Check(ip, data.Email)
+	if err != nil {
+		u.Templates.ForgotPassword.Execute(w, r, data, throttleError(err))
+		return
+	}
+
+	_, err = u.ForgotPasswordThrottle.Add(ip, data.Email)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	// Unknown addresses get the same page as known ones, and the email is
+	// sent in the background so the response takes as long either way
 	pwReset, err := u.PasswordResetService.Create(data.Email)
 	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			u.Templates.CheckYourEmail.Execute(w, r, checkEmailData{Email: data.Email})
+			return
+		}
+		fmt.Println(err)
 		u.Templates.ForgotPassword.Execute(w, r, data, err)
 		return
 	}
@@ -192,26 +359,77 @@ func (u Users) ProcessForgotPassword(w http.ResponseWriter, r *http.Request) {
 	vals := url.Values{
 		"token": {pwReset.Token},
 	}
+	resetURL := baseURL(r) + "/reset-pw?" + vals.Encode()
 
-	// Make this configurable
-	resetURL := "http://localhost:3000/reset-pw?" + vals.Encode()
-	err = u.EmailService.ForgotPassword(data.Email, resetURL)
-	if err != nil {
-		u.Templates.ForgotPassword.Execute(w, r, data, err)
-		return
+	sendInBackground(func() error {
+		return u.EmailService.ForgotPassword(data.Email, resetURL)
+	})
+
+	u.Templates.CheckYourEmail.Execute(w, r, checkEmailData{Email: data.Email})
+}
+
+func (u Users) renderResetPassword(w http.ResponseWriter, r *http.Request, token string, errs ...error) {
+	var data struct {
+		Token       string
+		Error       string
+		RequireCode bool
 	}
 
-	u.Templates.CheckYourEmail.Execute(w, r, data)
+	data.Token = token
+	data.RequireCode = u.resetRequiresCode(data.Token)
+	u.Templates.ResetPassword.Execute(w, r, data, errs...)
 }
 
 func (u Users) ResetPassword(w http.ResponseWriter, r *http.Request) {
-	var data struct {
-		Token string
-		Error string
+	u.renderResetPassword(w, r, r.FormValue("token"))
+}
+
+// Show problems with a new password next to the field they're about
+func passwordError(err error) error {
+	switch {
+	case errors.Is(err, models.ErrWeakPassword):
+		return errors.Field(err, "password", err.Error())
+	case errors.Is(err, models.ErrPasswordMatch):
+		return errors.Field(err, "confirm", err.Error())
 	}
+	return err
+}
 
-	data.Token = r.FormValue("token")
-	u.Templates.ResetPassword.Execute(w, r, data)
+// Check the new password on the reset form before the token is used up,
+// so a weak one can be fixed without asking for another email. Problems
+// with the token itself are left for ProcessResetPassword to report
+func (u Users) checkResetPassword(token, password, confirm string) error {
+	if password != confirm {
+		return passwordError(models.ErrPasswordMatch)
+	}
+
+	user, err := u.PasswordResetService.User(token)
+	if err != nil {
+		return nil
+	}
+
+	return passwordError(u.UserService.ValidatePassword(user.Email, password))
+}
+
+// Whether the account a reset token belongs to has two-factor
+// authentication, so the reset form should ask for a code. Unknown tokens
+// are left for ProcessResetPassword to report
+func (u Users) resetRequiresCode(token string) bool {
+	if token == "" {
+		return false
+	}
+
+	user, err := u.PasswordResetService.User(token)
+	if err != nil {
+		return false
+	}
+
+	enabled, err := u.TOTPService.Enabled(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	return enabled
 }
 
 func (u Users) ProcessResetPassword(w http.ResponseWriter, r *http.Request) {
@@ -230,31 +448,219 @@ func (u Users) ProcessResetPassword(w http.ResponseWriter, r *http.Request) {
 	data.Token = r.FormValue("token")
 	data.Password = r.FormValue("password")
 
+	err = u.checkResetPassword(data.Token, data.Password, r.FormValue("confirm"))
+	if err != nil {
+		u.renderResetPassword(w, r, data.Token, err)
+		return
+	}
+
 	user, err := u.PasswordResetService.Consume(data.Token)
 	if err != nil {
 		fmt.Println(err)
-		if errors.Is(models.ErrTokenExpired, err) {
+		if errors.Is(err, models.ErrTokenExpired) {
 			err = errors.Public(err, err.Error())
 		}
 
-		u.Templates.ForgotPassword.Execute(w, r, data, err)
+		u.Templates.ForgotPassword.Execute(w, r, nil, err)
+		return
+	}
+
+	// Access to the user's email alone isn't enough to take over an account
+	// with two-factor authentication. The token is already used up, so a
+	// wrong code means requesting a new email rather than guessing again
+	totp, keys, err := u.secondFactors(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong..", http.StatusInternalServerError)
 		return
 	}
 
-	err = u.UserService.UpdatePassword(user.ID, data.Password)
+	if totp {
+		err = u.TOTPService.Verify(user.ID, r.FormValue("code"))
+		if err != nil {
+			if errors.Is(err, models.ErrInvalidCode) {
+				err = errors.Public(err, "Invalid authentication code. Please request a new reset link and try again")
+			}
+			u.Templates.ForgotPassword.Execute(w, r, nil, err)
+			return
+		}
+	}
+
+	err = u.UserService.UpdatePassword(user, data.Password)
 	if err != nil {
+		if errors.Is(err, models.ErrWeakPassword) {
+			err = errors.Public(err, err.Error()+". Please request a new reset link and try again")
+			u.Templates.ForgotPassword.Execute(w, r, nil, err)
+			return
+		}
 		fmt.Println(err)
 		http.Error(w, "Something went wrong..", http.StatusInternalServerError)
 		return
 	}
 
-	session, err := u.SessionService.Create(user.ID)
+	// Following the reset link proves the address is theirs
+	err = u.EmailVerificationService.MarkVerified(user.ID)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	// Whoever was guessing the old password has nothing left to guess
+	err = u.SignInThrottle.Reset(user.Email)
 	if err != nil {
 		fmt.Println(err)
+	}
+
+	// Nor can anyone who got in finish moving the account to their address
+	err = u.EmailChangeService.Cancel(user.ID)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	// A security key can't be checked on this form, so users who only have
+	// those sign in again with the new password and their key
+	if keys && !totp {
+		err = u.SessionService.DeleteAll(user.ID)
+		if err != nil {
+			fmt.Println(err)
+		}
 		http.Redirect(w, r, "/signin", http.StatusFound)
 		return
 	}
 
-	setCookie(w, CookieSession, session.Token)
+	err = u.rotateSessions(w, r, user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
 	http.Redirect(w, r, "/users/me", http.StatusFound)
 }
+
+// A rough description of the browser and operating system in a user agent,
+// enough for people to recognise their own devices
+func deviceName(userAgent string) string {
+	browser := "Unknown browser"
+	for _, b := range []struct{ token, name string }{
+		// Order matters as most user agents claim to be several browsers
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+	} {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+
+	for _, platform := range []struct{ token, name string }{
+		{"Android", "Android"},
+		{"iPhone", "iPhone"},
+		{"iPad", "iPad"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, platform.token) {
+			return browser + " on " + platform.name
+		}
+	}
+
+	return browser
+}
+
+// List the user's sessions so they can spot ones they don't recognise
+func (u Users) Devices(w http.ResponseWriter, r *http.Request) {
+	type Device struct {
+		ID         int
+		Name       string
+		UserAgent  string
+		IPAddress  string
+		CreatedAt  time.Time
+		LastSeenAt time.Time
+		Current    bool
+	}
+
+	var data struct {
+		Devices []Device
+	}
+
+	user := context.User(r.Context())
+	sessions, err := u.SessionService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong..", http.StatusInternalServerError)
+		return
+	}
+
+	currentID := 0
+	token, err := u.Cookies.readCookie(r, CookieSession, "/")
+	if err == nil {
+		current, err := u.SessionService.Current(token)
+		if err == nil {
+			currentID = current.ID
+		}
+	}
+
+	for _, session := range sessions {
+		data.Devices = append(data.Devices, Device{
+			ID:         session.ID,
+			Name:       deviceName(session.UserAgent),
+			UserAgent:  session.UserAgent,
+			IPAddress:  session.IPAddress,
+			CreatedAt:  session.CreatedAt,
+			LastSeenAt: session.LastSeenAt,
+			Current:    session.ID == currentID,
+		})
+	}
+
+	u.Templates.Devices.Execute(w, r, data)
+}
+
+// Sign out a single device. Revoking the current session signs the user
+// out here too
+func (u Users) RevokeDevice(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	user := context.User(r.Context())
+	err = u.SessionService.DeleteID(user.ID, id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Device not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong..", http.StatusInternalServerError)
+		return
+	}
+
+	token, err := u.Cookies.readCookie(r, CookieSession, "/")
+	if err == nil {
+		_, err = u.SessionService.Current(token)
+		if errors.Is(err, models.ErrNotFound) {
+			u.Cookies.deleteCookie(w, CookieSession)
+			http.Redirect(w, r, "/signin", http.StatusFound)
+			return
+		}
+	}
+
+	http.Redirect(w, r, "/users/me/devices", http.StatusFound)
+}
+
+func (u Users) SignOutEverywhere(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	err := u.SessionService.DeleteAll(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong..", http.StatusInternalServerError)
+		return
+	}
+
+	u.Cookies.deleteCookie(w, CookieSession)
+	http.Redirect(w, r, "/signin", http.StatusFound)
+}
@@ -0,0 +1,140 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"taran1s.share/context"
+	"taran1s.share/errors"
+	"taran1s.share/models"
+)
+
+// Things users can be kept from doing until they verify their email address
+const (
+	VerifyCreateGalleries = "galleries"
+	VerifyUploadImages    = "uploads"
+	// Share links and adding members
+	VerifyShareGalleries = "sharing"
+)
+
+// What users who haven't verified their email address are still allowed
+// to do, keyed by the names above
+type VerificationPolicy map[string]bool
+
+// Read a comma separated list such as "uploads,sharing"
+func ParseVerificationPolicy(s string) (VerificationPolicy, error) {
+	policy := VerificationPolicy{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		switch name {
+		case "":
+		case VerifyCreateGalleries, VerifyUploadImages, VerifyShareGalleries:
+			policy[name] = true
+		default:
+			return nil, fmt.Errorf("unknown action %q", name)
+		}
+	}
+	return policy, nil
+}
+
+// Send users who haven't verified their email address to the verification
+// page, unless the policy lets them do this anyway
+func (umw UserMiddleware) RequireVerified(action string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := context.User(r.Context())
+			if user == nil {
+				http.Redirect(w, r, "/signin", http.StatusFound)
+				return
+			}
+
+			if !user.EmailVerified() && !umw.Unverified[action] {
+				http.Redirect(w, r, "/users/me/verify-email", http.StatusFound)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Email the user a link to verify their address. base is the site's URL
+// as seen by the request
+func (u Users) sendVerification(base string, user *models.User) error {
+	verification, err := u.EmailVerificationService.Create(user.ID)
+	if err != nil {
+		return err
+	}
+
+	vals := url.Values{
+		"token": {verification.Token},
+	}
+	verifyURL := base + "/verify-email?" + vals.Encode()
+
+	return u.EmailService.VerifyEmail(user.Email, verifyURL)
+}
+
+func (u Users) renderVerifyEmail(w http.ResponseWriter, r *http.Request, sent bool, errs ...error) {
+	var data struct {
+		Email string
+		Sent  bool
+	}
+	if user := context.User(r.Context()); user != nil {
+		data.Email = user.Email
+	}
+	data.Sent = sent
+
+	u.Templates.VerifyEmail.Execute(w, r, data, errs...)
+}
+
+// Tells the user to check their inbox, with a button to send the email again
+func (u Users) VerifyEmailNotice(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if user.EmailVerified() {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+
+	u.renderVerifyEmail(w, r, false)
+}
+
+func (u Users) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if user.EmailVerified() {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+
+	err := u.sendVerification(baseURL(r), user)
+	if err != nil {
+		if errors.Is(err, models.ErrResendTooSoon) {
+			err = errors.Public(err, err.Error())
+		}
+		u.renderVerifyEmail(w, r, false, err)
+		return
+	}
+
+	u.renderVerifyEmail(w, r, true)
+}
+
+// The link from the verification email. It works without being signed in
+// as people often open it on a different device
+func (u Users) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	_, err := u.EmailVerificationService.Consume(r.FormValue("token"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) || errors.Is(err, models.ErrTokenExpired) {
+			err = errors.Public(err, "That verification link is invalid or has expired")
+		}
+		u.renderVerifyEmail(w, r, false, err)
+		return
+	}
+
+	// New accounts aren't signed in until now
+	if context.User(r.Context()) == nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"taran1s.share/context"
+	"taran1s.share/models"
+)
+
+func TestParseVerificationPolicy(t *testing.T) {
+	tests := map[string]struct {
+		input   string
+		want    VerificationPolicy
+		wantErr bool
+	}{
+		"empty": {
+			input: "",
+			want:  VerificationPolicy{},
+		},
+		"one": {
+			input: "uploads",
+			want:  VerificationPolicy{VerifyUploadImages: true},
+		},
+		"all": {
+			input: "galleries,uploads,sharing",
+			want: VerificationPolicy{
+				VerifyCreateGalleries: true,
+				VerifyUploadImages:    true,
+				VerifyShareGalleries:  true,
+			},
+		},
+		"spaces and blanks": {
+			input: " galleries , ,sharing,",
+			want: VerificationPolicy{
+				VerifyCreateGalleries: true,
+				VerifyShareGalleries:  true,
+			},
+		},
+		"repeated": {
+			input: "uploads,uploads",
+			want:  VerificationPolicy{VerifyUploadImages: true},
+		},
+		"unknown": {
+			input:   "uploads,deleting",
+			wantErr: true,
+		},
+		"wrong case": {
+			input:   "Uploads",
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := ParseVerificationPolicy(tc.input)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ParseVerificationPolicy(%q) err = %v, want error %v", tc.input, err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("ParseVerificationPolicy(%q) = %v, want %v", tc.input, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRequireVerified(t *testing.T) {
+	verifiedAt := time.Now()
+	unverified := &models.User{ID: 1}
+	verified := &models.User{ID: 2, EmailVerifiedAt: &verifiedAt}
+
+	tests := map[string]struct {
+		user   *models.User
+		policy VerificationPolicy
+		// Where the user is sent, or "" if they get through
+		wantRedirect string
+	}{
+		"signed out": {
+			wantRedirect: "/signin",
+		},
+		"verified": {
+			user: verified,
+		},
+		"unverified": {
+			user:         unverified,
+			wantRedirect: "/users/me/verify-email",
+		},
+		"unverified but allowed": {
+			user:   unverified,
+			policy: VerificationPolicy{VerifyUploadImages: true},
+		},
+		"unverified and allowed something else": {
+			user:         unverified,
+			policy:       VerificationPolicy{VerifyShareGalleries: true},
+			wantRedirect: "/users/me/verify-email",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			umw := UserMiddleware{Unverified: tc.policy}
+			handler := umw.RequireVerified(VerifyUploadImages)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			}))
+
+			r := httptest.NewRequest(http.MethodPost, "/galleries/1/images", nil)
+			r = r.WithContext(context.WithUser(r.Context(), tc.user))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if tc.wantRedirect == "" {
+				if w.Code != http.StatusNoContent {
+					t.Errorf("status = %d, want the request let through", w.Code)
+				}
+				return
+			}
+			if w.Code != http.StatusFound || w.Header().Get("Location") != tc.wantRedirect {
+				t.Errorf("status = %d, Location = %q, want a redirect to %q", w.Code, w.Header().Get("Location"), tc.wantRedirect)
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"taran1s.share/context"
+	"taran1s.share/errors"
+	"taran1s.share/models"
+)
+
+const (
+	CookieWebAuthn = "webauthn"
+	// Attestation and assertion responses are a few kilobytes at most
+	maxWebAuthnResponse = 64 << 10
+)
+
+// What the browser gets back from the end of a ceremony. The page script
+// shows the error or follows the redirect
+type webAuthnResult struct {
+	Error    string `json:"error,omitempty"`
+	Redirect string `json:"redirect,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		fmt.Printf("writing json response: %v\n", err)
+	}
+}
+
+// Report a failed ceremony. Only errors the user can do something about are
+// shown, anything else is logged
+func webAuthnError(w http.ResponseWriter, err error, redirect string) {
+	result := webAuthnResult{Redirect: redirect}
+	status := http.StatusBadRequest
+
+	var pubErr interface{ Public() string }
+	switch {
+	case errors.As(err, &pubErr):
+		result.Error = pubErr.Public()
+	case errors.Is(err, models.ErrWebAuthnFailed):
+		fmt.Printf("webauthn ceremony failed: %v\n", err)
+		result.Error = models.ErrWebAuthnFailed.Error()
+	case errors.Is(err, models.ErrNotFound), errors.Is(err, models.ErrTokenExpired):
+		result.Error = "That took too long, please try again"
+	case errors.Is(err, models.ErrNoCredentials):
+		result.Error = err.Error()
+	default:
+		fmt.Printf("webauthn: %v\n", err)
+		result.Error = "Something went wrong..."
+		status = http.StatusInternalServerError
+	}
+
+	writeJSON(w, status, result)
+}
+
+// The token for a ceremony in progress is kept in a cookie between the
+// begin and finish requests
+func (u Users) setCeremony(w http.ResponseWriter, token string) {
+	cookie := u.Cookies.newCookie(CookieWebAuthn, token, "/")
+	cookie.MaxAge = int(models.DefaultCeremonyDuration.Seconds())
+	http.SetCookie(w, cookie)
+}
+
+func (u Users) takeCeremony(w http.ResponseWriter, r *http.Request) string {
+	token, err := u.Cookies.readCookie(r, CookieWebAuthn, "/")
+	if err != nil {
+		return ""
+	}
+
+	u.Cookies.deleteCookie(w, CookieWebAuthn)
+	return token
+}
+
+func (u Users) Passkeys(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	credentials, err := u.WebAuthnService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong..", http.StatusInternalServerError)
+		return
+	}
+
+	totp, err := u.TOTPService.Enabled(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong..", http.StatusInternalServerError)
+		return
+	}
+
+	var data struct {
+		Passkeys []models.WebAuthnCredential
+		// A code can be given instead of the password
+		TOTP bool
+	}
+	data.Passkeys = credentials
+	data.TOTP = totp
+
+	u.Templates.Passkeys.Execute(w, r, data)
+}
+
+// A passkey signs in without the password or a second factor, so adding one
+// needs the current password or a code from the user's app, just like other
+// changes that could be used to take over the account
+func (u Users) checkPasskeyReauth(r *http.Request, user *models.User, password, code string) error {
+	switch {
+	case password != "":
+		return u.checkCurrentPassword(r, user, password, "password")
+	case code != "":
+		return u.checkTwoFactorCode(r, user, code)
+	default:
+		return errors.Public(models.ErrInvalidCredentials,
+			"Please enter your current password to add a passkey")
+	}
+}
+
+func (u Users) BeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	// Sent in the body rather than the query so the password stays out of
+	// logs. A missing body leaves both empty, which is refused
+	var reauth struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	body := http.MaxBytesReader(w, r.Body, maxWebAuthnResponse)
+	err := json.NewDecoder(body).Decode(&reauth)
+	if err != nil && !errors.Is(err, io.EOF) {
+		writeJSON(w, http.StatusBadRequest, webAuthnResult{Error: "Invalid request"})
+		return
+	}
+
+	err = u.checkPasskeyReauth(r, user, reauth.Password, reauth.Code)
+	if err != nil {
+		webAuthnError(w, err, "")
+		return
+	}
+
+	creation, token, err := u.WebAuthnService.BeginRegistration(user)
+	if err != nil {
+		webAuthnError(w, err, "")
+		return
+	}
+
+	u.setCeremony(w, token)
+	writeJSON(w, http.StatusOK, creation)
+}
+
+func (u Users) FinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	token := u.takeCeremony(w, r)
+	body := http.MaxBytesReader(w, r.Body, maxWebAuthnResponse)
+
+	_, err := u.WebAuthnService.FinishRegistration(user, token, r.URL.Query().Get("name"), body)
+	if err != nil {
+		webAuthnError(w, err, "")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, webAuthnResult{Redirect: "/users/me/passkeys"})
+}
+
+func (u Users) DeletePasskey(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+
+	err = u.WebAuthnService.Delete(user.ID, id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Passkey not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong..", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/users/me/passkeys", http.StatusFound)
+}
+
+// Passwordless sign in with a passkey stored on the user's device
+func (u Users) BeginPasskeySignIn(w http.ResponseWriter, r *http.Request) {
+	assertion, token, err := u.WebAuthnService.BeginPasskeyLogin()
+	if err != nil {
+		webAuthnError(w, err, "")
+		return
+	}
+
+	u.setCeremony(w, token)
+	writeJSON(w, http.StatusOK, assertion)
+}
+
+func (u Users) FinishPasskeySignIn(w http.ResponseWriter, r *http.Request) {
+	token := u.takeCeremony(w, r)
+	body := http.MaxBytesReader(w, r.Body, maxWebAuthnResponse)
+
+	user, err := u.WebAuthnService.FinishPasskeyLogin(token, body)
+	if err != nil {
+		webAuthnError(w, err, "")
+		return
+	}
+
+	// Passkeys require user verification so they count as both factors.
+	// Adding one took the password or a code, so it's no weaker than those
+	remember := r.URL.Query().Get("remember_me") == "on"
+	err = u.startSession(w, r, user.ID, remember)
+	if err != nil {
+		webAuthnError(w, err, "")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, webAuthnResult{Redirect: "/users/me"})
+}
+
+// A security key as the second step of signing in with a password
+func (u Users) BeginSecurityKeyChallenge(w http.ResponseWriter, r *http.Request) {
+	challenge, err := u.loginChallenge(r)
+	if err != nil {
+		u.endChallenge(w)
+		writeJSON(w, http.StatusBadRequest, webAuthnResult{
+			Error:    "Please sign in again",
+			Redirect: "/signin",
+		})
+		return
+	}
+
+	assertion, token, err := u.WebAuthnService.BeginLogin(&models.User{ID: challenge.UserID})
+	if err != nil {
+		webAuthnError(w, err, "")
+		return
+	}
+
+	u.setCeremony(w, token)
+	writeJSON(w, http.StatusOK, assertion)
+}
+
+func (u Users) FinishSecurityKeyChallenge(w http.ResponseWriter, r *http.Request) {
+	challenge, err := u.loginChallenge(r)
+	if err != nil {
+		u.endChallenge(w)
+		writeJSON(w, http.StatusBadRequest, webAuthnResult{
+			Error:    "Please sign in again",
+			Redirect: "/signin",
+		})
+		return
+	}
+
+	token := u.takeCeremony(w, r)
+	body := http.MaxBytesReader(w, r.Body, maxWebAuthnResponse)
+
+	err = u.attemptChallenge(w, r, challenge)
+	if err != nil {
+		redirect := ""
+		if errors.Is(err, models.ErrTooManyAttempts) {
+			redirect = "/signin"
+		}
+		webAuthnError(w, err, redirect)
+		return
+	}
+
+	err = u.WebAuthnService.FinishLogin(&models.User{ID: challenge.UserID}, token, body)
+	if err != nil {
+		redirect := ""
+		if !errors.Is(err, models.ErrWebAuthnFailed) {
+			u.releaseAttempt(r, challenge.Email)
+		} else if u.failChallenge(w, r, challenge) {
+			redirect = "/signin"
+		}
+		webAuthnError(w, err, redirect)
+		return
+	}
+
+	err = u.passChallenge(w, r, challenge)
+	if err != nil {
+		webAuthnError(w, err, "/signin")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, webAuthnResult{Redirect: "/users/me"})
+}
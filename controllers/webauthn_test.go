@@ -0,0 +1,143 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"taran1s.share/context"
+	"taran1s.share/models"
+)
+
+// POST a passkey registration request for user, returning the status and
+// the error shown, if any
+func beginPasskeyRegistration(t *testing.T, u Users, user *models.User, body string) (int, string) {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodPost, "/users/me/passkeys/begin", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r = r.WithContext(context.WithUser(r.Context(), user))
+	w := httptest.NewRecorder()
+	u.BeginPasskeyRegistration(w, r)
+
+	var result webAuthnResult
+	err := json.NewDecoder(w.Body).Decode(&result)
+	if err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	return w.Code, result.Error
+}
+
+// Waits an hour after the second wrong guess
+func testSignInThrottle() *models.Throttle {
+	return &models.Throttle{
+		Store: &models.MemoryThrottleStore{},
+		Name:  "signin",
+		Email: models.ThrottlePolicy{FreeAttempts: 1, BaseDelay: time.Hour, Window: time.Hour},
+		IP:    models.ThrottlePolicy{Window: time.Hour},
+	}
+}
+
+// Without a password or code nothing else is looked at, so no database is
+// needed
+func TestBeginPasskeyRegistrationNoReauth(t *testing.T) {
+	tests := map[string]struct {
+		body    string
+		wantErr string
+	}{
+		"no body": {
+			wantErr: "Please enter your current password to add a passkey",
+		},
+		"empty fields": {
+			body:    `{"password":"","code":""}`,
+			wantErr: "Please enter your current password to add a passkey",
+		},
+		"not json": {
+			body:    "password=hunter2",
+			wantErr: "Invalid request",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			u := Users{SignInThrottle: testSignInThrottle()}
+			user := &models.User{ID: 1, Email: "jo@example.com"}
+
+			status, got := beginPasskeyRegistration(t, u, user, tc.body)
+			if status != http.StatusBadRequest || got != tc.wantErr {
+				t.Errorf("BeginPasskeyRegistration() = %d %q, want %d %q",
+					status, got, http.StatusBadRequest, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestBeginPasskeyRegistration(t *testing.T) {
+	db := testDB(t)
+	user := testUser(t, db, "jo@example.com")
+
+	webAuthn, err := models.NewWebAuthnService(db, models.WebAuthnConfig{
+		RPID:      "share.example.com",
+		RPOrigins: []string{"https://share.example.com"},
+	})
+	if err != nil {
+		t.Fatalf("NewWebAuthnService() err = %v", err)
+	}
+	u := Users{
+		UserService:     &models.UserService{DB: db},
+		TOTPService:     &models.TOTPService{DB: db},
+		WebAuthnService: webAuthn,
+		SignInThrottle:  testSignInThrottle(),
+	}
+
+	// In order, as wrong guesses add up
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantErr    string
+	}{
+		{
+			name:       "wrong password",
+			body:       `{"password":"hunter2"}`,
+			wantStatus: http.StatusBadRequest,
+			wantErr:    "That isn't your current password",
+		},
+		{
+			name:       "code without two-factor",
+			body:       `{"code":"123456"}`,
+			wantStatus: http.StatusBadRequest,
+			wantErr:    models.ErrTOTPNotEnrolled.Error(),
+		},
+		{
+			name:       "right password",
+			body:       `{"password":"correct horse battery"}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "another wrong password",
+			body:       `{"password":"hunter3"}`,
+			wantStatus: http.StatusBadRequest,
+			wantErr:    "That isn't your current password",
+		},
+		{
+			name:       "right password after too many guesses",
+			body:       `{"password":"correct horse battery"}`,
+			wantStatus: http.StatusBadRequest,
+			wantErr:    "Too many attempts, please try again in 60 minutes",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			status, got := beginPasskeyRegistration(t, u, user, tc.body)
+			if status != tc.wantStatus || got != tc.wantErr {
+				t.Errorf("BeginPasskeyRegistration() = %d %q, want %d %q",
+					status, got, tc.wantStatus, tc.wantErr)
+			}
+		})
+	}
+}
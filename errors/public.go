@@ -20,3 +20,18 @@ func (pe publicError) Public() string {
 func (pe publicError) Unwrap() error {
 	return pe.err
 }
+
+type fieldError struct {
+	publicError
+	field string
+}
+
+// Field is a public error about one form field, which the view shows next
+// to that field rather than at the top of the page
+func Field(err error, field, msg string) error {
+	return fieldError{publicError{err, msg}, field}
+}
+
+func (fe fieldError) Field() string {
+	return fe.field
+}
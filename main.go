@@ -5,6 +5,8 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/gorilla/csrf"
@@ -12,6 +14,7 @@ import (
 	"taran1s.share/controllers"
 	"taran1s.share/migrations"
 	"taran1s.share/models"
+	"taran1s.share/rand"
 	"taran1s.share/templates"
 	"taran1s.share/views"
 )
@@ -23,9 +26,35 @@ type config struct {
 		Key    string
 		Secure bool
 	}
-	Server struct {
+	Cookies controllers.CookiePolicy
+	Server  struct {
 		Address string
 	}
+	Galleries struct {
+		UnlockKey string
+	}
+	Sessions struct {
+		Duration            time.Duration
+		IdleTimeout         time.Duration
+		RememberDuration    time.Duration
+		RememberIdleTimeout time.Duration
+	}
+	Passwords      models.PasswordConfig
+	PasswordPolicy struct {
+		MinLength int
+		// A directory of Pwned Passwords range files, empty skips the check
+		BreachedDir      string
+		BreachedMinCount int
+	}
+	// memory or postgres, which shares counts between servers
+	ThrottleStore string
+	WebAuthn      models.WebAuthnConfig
+	OIDC          models.OIDCConfig
+	Unverified    controllers.VerificationPolicy
+	Images        struct {
+		Store  models.ImageStoreConfig
+		Limits models.ImageLimits
+	}
 }
 
 func loadEnvConfig() (config, error) {
@@ -63,8 +92,176 @@ func loadEnvConfig() (config, error) {
 	cfg.CSRF.Key = os.Getenv("CSRF_KEY")
 	cfg.CSRF.Secure = secure
 
+	// Cookies follow CSRF_SECURE unless COOKIE_SECURE says otherwise
+	cfg.Cookies.Secure = secure
+	if v := os.Getenv("COOKIE_SECURE"); v != "" {
+		cfg.Cookies.Secure, err = strconv.ParseBool(v)
+		if err != nil {
+			return cfg, fmt.Errorf("COOKIE_SECURE: %w", err)
+		}
+	}
+
+	switch os.Getenv("COOKIE_SAMESITE") {
+	case "", "lax":
+		cfg.Cookies.SameSite = http.SameSiteLaxMode
+	case "strict":
+		cfg.Cookies.SameSite = http.SameSiteStrictMode
+	default:
+		return cfg, fmt.Errorf("COOKIE_SAMESITE: must be lax or strict")
+	}
+
+	// Prefixed names only work over HTTPS so they are on by default for
+	// secure cookies
+	cfg.Cookies.Prefix = cfg.Cookies.Secure
+	if v := os.Getenv("COOKIE_PREFIX"); v != "" {
+		cfg.Cookies.Prefix, err = strconv.ParseBool(v)
+		if err != nil {
+			return cfg, fmt.Errorf("COOKIE_PREFIX: %w", err)
+		}
+	}
+
 	cfg.Server.Address = fmt.Sprintf("%s:%s", os.Getenv("SERVER_ADDR"), os.Getenv("SERVER_PORT"))
 
+	cfg.Galleries.UnlockKey = os.Getenv("GALLERY_UNLOCK_KEY")
+
+	// Durations such as 24h or 30m, unset ones use the models defaults
+	sessionDurations := map[string]*time.Duration{
+		"SESSION_DURATION":              &cfg.Sessions.Duration,
+		"SESSION_IDLE_TIMEOUT":          &cfg.Sessions.IdleTimeout,
+		"SESSION_REMEMBER_DURATION":     &cfg.Sessions.RememberDuration,
+		"SESSION_REMEMBER_IDLE_TIMEOUT": &cfg.Sessions.RememberIdleTimeout,
+	}
+	for name, duration := range sessionDurations {
+		if v := os.Getenv(name); v != "" {
+			*duration, err = time.ParseDuration(v)
+			if err != nil {
+				return cfg, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+
+	// Changing these upgrades existing hashes as users sign in
+	cfg.Passwords.Algorithm = os.Getenv("PASSWORD_HASH")
+	if v := os.Getenv("BCRYPT_COST"); v != "" {
+		cfg.Passwords.BcryptCost, err = strconv.Atoi(v)
+		if err != nil {
+			return cfg, fmt.Errorf("BCRYPT_COST: %w", err)
+		}
+	}
+
+	argon2Params := map[string]*uint32{
+		"ARGON2_MEMORY":     &cfg.Passwords.Argon2.Memory,
+		"ARGON2_ITERATIONS": &cfg.Passwords.Argon2.Iterations,
+	}
+	for name, param := range argon2Params {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return cfg, fmt.Errorf("%s: %w", name, err)
+			}
+			*param = uint32(n)
+		}
+	}
+
+	if v := os.Getenv("ARGON2_PARALLELISM"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 8)
+		if err != nil {
+			return cfg, fmt.Errorf("ARGON2_PARALLELISM: %w", err)
+		}
+		cfg.Passwords.Argon2.Parallelism = uint8(n)
+	}
+
+	passwordPolicy := map[string]*int{
+		"PASSWORD_MIN_LENGTH":         &cfg.PasswordPolicy.MinLength,
+		"BREACHED_PASSWORDS_MIN_SEEN": &cfg.PasswordPolicy.BreachedMinCount,
+	}
+	for name, setting := range passwordPolicy {
+		if v := os.Getenv(name); v != "" {
+			*setting, err = strconv.Atoi(v)
+			if err != nil {
+				return cfg, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+	cfg.PasswordPolicy.BreachedDir = os.Getenv("BREACHED_PASSWORDS_DIR")
+
+	cfg.ThrottleStore = os.Getenv("THROTTLE_STORE")
+
+	// Passkeys are bound to the domain, so these have to match the address
+	// people use to reach the site
+	cfg.WebAuthn = models.WebAuthnConfig{
+		RPID:          os.Getenv("WEBAUTHN_RP_ID"),
+		RPDisplayName: os.Getenv("WEBAUTHN_RP_NAME"),
+	}
+	if cfg.WebAuthn.RPID == "" {
+		cfg.WebAuthn.RPID = "localhost"
+	}
+	for _, origin := range strings.Split(os.Getenv("WEBAUTHN_RP_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			cfg.WebAuthn.RPOrigins = append(cfg.WebAuthn.RPOrigins, origin)
+		}
+	}
+	if len(cfg.WebAuthn.RPOrigins) == 0 {
+		if cfg.WebAuthn.RPID == "localhost" {
+			cfg.WebAuthn.RPOrigins = []string{"http://localhost:" + os.Getenv("SERVER_PORT")}
+		} else {
+			cfg.WebAuthn.RPOrigins = []string{"https://" + cfg.WebAuthn.RPID}
+		}
+	}
+
+	// Single sign on is off unless an issuer and client are set
+	cfg.OIDC = models.OIDCConfig{
+		Name:         os.Getenv("OIDC_NAME"),
+		Issuer:       os.Getenv("OIDC_ISSUER"),
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:       strings.Fields(os.Getenv("OIDC_SCOPES")),
+	}
+	if cfg.OIDC.RedirectURL == "" {
+		cfg.OIDC.RedirectURL = "http://localhost:" + os.Getenv("SERVER_PORT") + "/auth/oidc/callback"
+	}
+
+	// Everything waits for email verification unless listed here
+	cfg.Unverified, err = controllers.ParseVerificationPolicy(os.Getenv("UNVERIFIED_ALLOW"))
+	if err != nil {
+		return cfg, fmt.Errorf("UNVERIFIED_ALLOW: %w", err)
+	}
+
+	cfg.Images.Store = models.ImageStoreConfig{
+		Backend: os.Getenv("IMAGE_STORE"),
+		Dir:     os.Getenv("IMAGES_DIR"),
+		S3: models.S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+		},
+	}
+
+	// Unset limits fall back to the defaults in models.ImageLimits
+	if v := os.Getenv("IMAGE_MAX_WIDTH"); v != "" {
+		cfg.Images.Limits.MaxWidth, err = strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	if v := os.Getenv("IMAGE_MAX_HEIGHT"); v != "" {
+		cfg.Images.Limits.MaxHeight, err = strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	if v := os.Getenv("IMAGE_MAX_PIXELS"); v != "" {
+		cfg.Images.Limits.MaxPixels, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
 	return cfg, nil
 }
 
@@ -85,12 +282,34 @@ func main() {
 		fmt.Println(err)
 	}
 
+	passwordHasher, err := models.NewPasswordHasher(cfg.Passwords)
+	if err != nil {
+		panic(err)
+	}
+
+	passwordPolicy := &models.PasswordPolicy{
+		MinLength: cfg.PasswordPolicy.MinLength,
+	}
+	if cfg.PasswordPolicy.BreachedDir != "" {
+		passwordPolicy.Breached, err = models.NewBreachedPasswordList(
+			cfg.PasswordPolicy.BreachedDir, cfg.PasswordPolicy.BreachedMinCount)
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	userService := &models.UserService{
-		DB: db,
+		DB:        db,
+		Passwords: passwordHasher,
+		Policy:    passwordPolicy,
 	}
 
 	sessionService := &models.SessionService{
-		DB: db,
+		DB:                  db,
+		Duration:            cfg.Sessions.Duration,
+		IdleTimeout:         cfg.Sessions.IdleTimeout,
+		RememberDuration:    cfg.Sessions.RememberDuration,
+		RememberIdleTimeout: cfg.Sessions.RememberIdleTimeout,
 	}
 
 	passwordResetService := &models.PasswordResetService{
@@ -99,13 +318,77 @@ func main() {
 		Duration:      models.DefaultResetDuration,
 	}
 
+	signInLinkService := &models.SignInLinkService{
+		DB:            db,
+		BytesPerToken: 32,
+		Duration:      models.DefaultSignInLinkDuration,
+	}
+
+	identityService := &models.IdentityService{
+		DB: db,
+	}
+
+	var oidcService *models.OIDCService
+	if cfg.OIDC.Enabled() {
+		oidcService = &models.OIDCService{
+			DB:            db,
+			Config:        cfg.OIDC,
+			BytesPerToken: 32,
+			Duration:      models.DefaultOIDCLoginDuration,
+		}
+	}
+
+	emailChangeService := &models.EmailChangeService{
+		DB:            db,
+		BytesPerToken: 32,
+		Duration:      models.DefaultEmailChangeDuration,
+	}
+
+	emailVerificationService := &models.EmailVerificationService{
+		DB:            db,
+		BytesPerToken: 32,
+		Duration:      models.DefaultVerificationDuration,
+	}
+
+	totpService := &models.TOTPService{
+		DB:     db,
+		Issuer: models.DefaultTOTPIssuer,
+	}
+
+	loginChallengeService := &models.LoginChallengeService{
+		DB:            db,
+		BytesPerToken: 32,
+		Duration:      models.DefaultChallengeDuration,
+	}
+
+	webAuthnService, err := models.NewWebAuthnService(db, cfg.WebAuthn)
+	if err != nil {
+		panic(err)
+	}
+
 	emailService := models.NewEmailService(cfg.SMTP)
 
+	throttleStore, err := models.NewThrottleStore(cfg.ThrottleStore, db)
+	if err != nil {
+		panic(err)
+	}
+
 	usersC := controllers.Users{
-		UserService:          userService,
-		SessionService:       sessionService,
-		PasswordResetService: passwordResetService,
-		EmailService:         emailService,
+		UserService:              userService,
+		SessionService:           sessionService,
+		PasswordResetService:     passwordResetService,
+		EmailVerificationService: emailVerificationService,
+		EmailChangeService:       emailChangeService,
+		SignInLinkService:        signInLinkService,
+		IdentityService:          identityService,
+		OIDCService:              oidcService,
+		EmailService:             emailService,
+		TOTPService:              totpService,
+		LoginChallengeService:    loginChallengeService,
+		WebAuthnService:          webAuthnService,
+		SignInThrottle:           models.NewSignInThrottle(throttleStore),
+		ForgotPasswordThrottle:   models.NewForgotPasswordThrottle(throttleStore),
+		Cookies:                  cfg.Cookies,
 	}
 
 	usersC.Templates.New = views.Must(views.ParseFS(
@@ -115,7 +398,7 @@ func main() {
 
 	usersC.Templates.SignIn = views.Must(views.ParseFS(
 		templates.FS,
-		"layout.gohtml", "signin.gohtml",
+		"layout.gohtml", "signin.gohtml", "webauthn.gohtml",
 	))
 
 	usersC.Templates.ForgotPassword = views.Must(views.ParseFS(
@@ -133,12 +416,92 @@ func main() {
 		"layout.gohtml", "resetpw.gohtml",
 	))
 
+	usersC.Templates.Account = views.Must(views.ParseFS(
+		templates.FS,
+		"layout.gohtml", "account.gohtml",
+	))
+
+	usersC.Templates.Devices = views.Must(views.ParseFS(
+		templates.FS,
+		"layout.gohtml", "devices.gohtml",
+	))
+
+	usersC.Templates.TwoFactor = views.Must(views.ParseFS(
+		templates.FS,
+		"layout.gohtml", "twofactor.gohtml",
+	))
+
+	usersC.Templates.Challenge = views.Must(views.ParseFS(
+		templates.FS,
+		"layout.gohtml", "signin2fa.gohtml", "webauthn.gohtml",
+	))
+
+	usersC.Templates.SignInLink = views.Must(views.ParseFS(
+		templates.FS,
+		"layout.gohtml", "signinlink.gohtml",
+	))
+
+	usersC.Templates.Identities = views.Must(views.ParseFS(
+		templates.FS,
+		"layout.gohtml", "identities.gohtml",
+	))
+
+	usersC.Templates.VerifyEmail = views.Must(views.ParseFS(
+		templates.FS,
+		"layout.gohtml", "verifyemail.gohtml",
+	))
+
+	usersC.Templates.Passkeys = views.Must(views.ParseFS(
+		templates.FS,
+		"layout.gohtml", "passkeys.gohtml", "webauthn.gohtml",
+	))
+
+	imageStore, err := models.NewImageStore(cfg.Images.Store)
+	if err != nil {
+		panic(err)
+	}
+
 	galleryService := &models.GalleryService{
-		DB: db,
+		DB:     db,
+		Store:  imageStore,
+		Limits: cfg.Images.Limits,
+	}
+
+	shareLinkService := &models.ShareLinkService{
+		DB:            db,
+		BytesPerToken: 32,
+		Duration:      models.DefaultShareLinkDuration,
+	}
+
+	if len(os.Args) > 1 {
+		cmds := commands{
+			GalleryService: galleryService,
+		}
+
+		err = cmds.Run(os.Args[1:])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Without a configured key visitors have to re-enter gallery passwords
+	// whenever the server restarts
+	unlockKey := []byte(cfg.Galleries.UnlockKey)
+	if len(unlockKey) == 0 {
+		unlockKey, err = rand.Bytes(32)
+		if err != nil {
+			panic(err)
+		}
 	}
 
 	galleriesC := controllers.Galleries{
-		GalleryService: galleryService,
+		GalleryService:   galleryService,
+		ShareLinkService: shareLinkService,
+		EmailService:     emailService,
+		UnlockKey:        unlockKey,
+		Cookies:          cfg.Cookies,
 	}
 
 	galleriesC.Templates.Show = views.Must(views.ParseFS(
@@ -161,15 +524,29 @@ func main() {
 		"layout.gohtml", "index.gohtml",
 	))
 
+	galleriesC.Templates.Unlock = views.Must(views.ParseFS(
+		templates.FS,
+		"layout.gohtml", "unlockgallery.gohtml",
+	))
+
+	galleriesC.Templates.Public = views.Must(views.ParseFS(
+		templates.FS,
+		"layout.gohtml", "publicgalleries.gohtml",
+	))
+
 	// User middleware
 	umw := controllers.UserMiddleware{
 		SessionService: sessionService,
+		Cookies:        cfg.Cookies,
+		Unverified:     cfg.Unverified,
 	}
 
 	// CSRF protection
 	csrfMw := csrf.Protect(
 		[]byte(cfg.CSRF.Key),
 		csrf.Secure(cfg.CSRF.Secure),
+		// csrf's SameSiteMode shares http.SameSite's values
+		csrf.SameSite(csrf.SameSiteMode(cfg.Cookies.SameSite)),
 		csrf.TrustedOrigins([]string{"localhost:3000"}),
 		csrf.Path("/"),
 	)
@@ -184,6 +561,19 @@ func main() {
 
 	r.Get("/signin", usersC.SignIn)
 	r.Post("/signin", usersC.Authenticate)
+	r.Get("/verify-email", usersC.VerifyEmail)
+	r.Get("/confirm-email", usersC.ConfirmEmailChange)
+	r.Post("/signin/link", usersC.ProcessSignInLink)
+	r.Get("/signin/link", usersC.SignInLink)
+	r.Post("/signin/link/confirm", usersC.ConfirmSignInLink)
+	r.Post("/auth/oidc", usersC.OIDCSignIn)
+	r.Get("/auth/oidc/callback", usersC.OIDCCallback)
+	r.Get("/signin/2fa", usersC.Challenge)
+	r.Post("/signin/2fa", usersC.ProcessChallenge)
+	r.Post("/signin/2fa/webauthn/begin", usersC.BeginSecurityKeyChallenge)
+	r.Post("/signin/2fa/webauthn/finish", usersC.FinishSecurityKeyChallenge)
+	r.Post("/signin/passkey/begin", usersC.BeginPasskeySignIn)
+	r.Post("/signin/passkey/finish", usersC.FinishPasskeySignIn)
 
 	r.Post("/signout", usersC.SignOut)
 
@@ -193,27 +583,91 @@ func main() {
 	r.Get("/reset-pw", usersC.ResetPassword)
 	r.Post("/reset-pw", usersC.ProcessResetPassword)
 
-	r.Get("/users/me", usersC.CurrentUser)
+	r.Group(func(r chi.Router) {
+		r.Use(umw.RequireUser)
+		r.Get("/users/me", usersC.Account)
+		r.Post("/users/me/name", usersC.UpdateName)
+		r.Post("/users/me/password", usersC.ChangePassword)
+		r.Post("/users/me/email", usersC.ChangeEmail)
+		r.Get("/users/me/devices", usersC.Devices)
+		r.Post("/users/me/devices/{id}/revoke", usersC.RevokeDevice)
+		r.Post("/users/me/devices/signout-all", usersC.SignOutEverywhere)
+		r.Get("/users/me/2fa", usersC.TwoFactor)
+		r.Post("/users/me/2fa/setup", usersC.SetupTwoFactor)
+		r.Post("/users/me/2fa/confirm", usersC.ConfirmTwoFactor)
+		r.Post("/users/me/2fa/recovery-codes", usersC.RegenerateRecoveryCodes)
+		r.Post("/users/me/2fa/disable", usersC.DisableTwoFactor)
+		r.Get("/users/me/verify-email", usersC.VerifyEmailNotice)
+		r.Post("/users/me/verify-email", usersC.ResendVerification)
+		r.Get("/users/me/identities", usersC.Identities)
+		r.Post("/users/me/identities/link", usersC.LinkIdentity)
+		r.Post("/users/me/identities/{id}/delete", usersC.UnlinkIdentity)
+		r.Get("/users/me/passkeys", usersC.Passkeys)
+		r.Post("/users/me/passkeys/begin", usersC.BeginPasskeyRegistration)
+		r.Post("/users/me/passkeys/finish", usersC.FinishPasskeyRegistration)
+		r.Post("/users/me/passkeys/{id}/delete", usersC.DeletePasskey)
+	})
 
 	r.Route("/galleries", func(r chi.Router) {
+		// Visibility is checked by the handlers so anonymous visitors can
+		// see public and unlisted galleries
+		r.Get("/public", galleriesC.Public)
+		r.Get("/{id}", galleriesC.Show)
+		r.Get("/{id}/images/{filename}", galleriesC.Image)
+		r.Post("/{id}/unlock", galleriesC.Unlock)
+
 		r.Group(func(r chi.Router) {
 			r.Use(umw.RequireUser)
 			r.Get("/", galleriesC.Index)
-			r.Get("/new", galleriesC.New)
-			r.Post("/", galleriesC.Create)
+			r.With(umw.RequireVerified(controllers.VerifyCreateGalleries)).Get("/new", galleriesC.New)
+			r.With(umw.RequireVerified(controllers.VerifyCreateGalleries)).Post("/", galleriesC.Create)
 			r.Get("/{id}/edit", galleriesC.Edit)
-			r.Get("/{id}", galleriesC.Show)
 			r.Post("/{id}", galleriesC.Update)
 			r.Post("/{id}/delete", galleriesC.Delete)
-			r.Get("/{id}/images/{filename}", galleriesC.Image)
+			r.With(umw.RequireVerified(controllers.VerifyUploadImages)).Post("/{id}/images", galleriesC.UploadImage)
+			r.Post("/{id}/images/{filename}/delete", galleriesC.DeleteImage)
+			r.With(umw.RequireVerified(controllers.VerifyShareGalleries)).Post("/{id}/share", galleriesC.CreateShareLink)
+			r.Post("/{id}/share/{linkID}/revoke", galleriesC.RevokeShareLink)
+			r.With(umw.RequireVerified(controllers.VerifyShareGalleries)).Post("/{id}/members", galleriesC.AddMember)
+			r.Post("/{id}/members/{userID}/delete", galleriesC.RemoveMember)
 		})
 	})
 
+	// Share links work without an account
+	r.Get("/s/{token}", galleriesC.SharedShow)
+	r.Get("/s/{token}/images/{filename}", galleriesC.SharedImage)
+
 	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "I think you got lost...", http.StatusNotFound)
 	})
 
+	go purgeExpired("sessions", sessionService.DeleteExpired, time.Hour)
+	go purgeExpired("sign in challenges", loginChallengeService.DeleteExpired, time.Hour)
+	go purgeExpired("passkey ceremonies", webAuthnService.DeleteExpired, time.Hour)
+	go purgeExpired("sign in throttles", throttleStore.DeleteExpired, 10*time.Minute)
+	go purgeExpired("email changes", emailChangeService.DeleteExpired, time.Hour)
+	if oidcService != nil {
+		go purgeExpired("identity provider sign ins", oidcService.DeleteExpired, time.Hour)
+	}
+
 	fmt.Println("Server starting on :3000")
 
 	http.ListenAndServe(cfg.Server.Address, csrfMw(umw.SetUser(r)))
 }
+
+// Periodically clear out expired rows
+func purgeExpired(what string, deleteExpired func() (int64, error), interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for ; ; <-ticker.C {
+		n, err := deleteExpired()
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		if n > 0 {
+			fmt.Printf("purged %d expired %s\n", n, what)
+		}
+	}
+}
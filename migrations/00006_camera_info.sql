@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE galleries
+    ADD COLUMN keep_camera_info BOOLEAN NOT NULL DEFAULT FALSE;
+
+ALTER TABLE images
+    ADD COLUMN camera_info TEXT NOT NULL DEFAULT '';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE images
+    DROP COLUMN camera_info;
+
+ALTER TABLE galleries
+    DROP COLUMN keep_camera_info;
+-- +goose StatementEnd
@@ -0,0 +1,31 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE sessions
+    DROP CONSTRAINT sessions_user_id_key,
+    ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    ADD COLUMN last_seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    ADD COLUMN user_agent TEXT NOT NULL DEFAULT '',
+    ADD COLUMN ip_address TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX sessions_user_id_idx ON sessions (user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+-- Only the most recently used session for each user survives
+DELETE FROM sessions
+WHERE id NOT IN (
+    SELECT DISTINCT ON (user_id) id
+    FROM sessions
+    ORDER BY user_id, last_seen_at DESC
+);
+
+DROP INDEX sessions_user_id_idx;
+
+ALTER TABLE sessions
+    DROP COLUMN created_at,
+    DROP COLUMN last_seen_at,
+    DROP COLUMN user_agent,
+    DROP COLUMN ip_address,
+    ADD CONSTRAINT sessions_user_id_key UNIQUE (user_id);
+-- +goose StatementEnd
@@ -0,0 +1,29 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE sessions
+    ADD COLUMN remember BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN expires_at TIMESTAMPTZ,
+    ADD COLUMN idle_expires_at TIMESTAMPTZ;
+
+-- Existing sessions get the default lifetime from now rather than being
+-- signed out by the migration
+UPDATE sessions
+SET expires_at = NOW() + INTERVAL '24 hours',
+    idle_expires_at = NOW() + INTERVAL '30 minutes';
+
+ALTER TABLE sessions
+    ALTER COLUMN expires_at SET NOT NULL,
+    ALTER COLUMN idle_expires_at SET NOT NULL;
+
+CREATE INDEX sessions_expires_at_idx ON sessions (expires_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX sessions_expires_at_idx;
+
+ALTER TABLE sessions
+    DROP COLUMN remember,
+    DROP COLUMN expires_at,
+    DROP COLUMN idle_expires_at;
+-- +goose StatementEnd
@@ -2,6 +2,8 @@ package models
 
 import (
 	"fmt"
+	"html"
+	"time"
 
 	"github.com/go-mail/mail/v2"
 )
@@ -88,3 +90,135 @@ func (es *EmailService) ForgotPassword(to, resetURL string) error {
 	}
 	return nil
 }
+
+func (es *EmailService) VerifyEmail(to, verifyURL string) error {
+	email := Email{
+		Subject:   "Verify your email address",
+		To:        to,
+		Plaintext: "To finish setting up your account, please confirm your email address by visiting: " + verifyURL,
+		HTML: fmt.Sprintf(`<p>To finish setting up your account, please confirm your email address by visiting: <a href="%s">%s</a></p>`,
+			html.EscapeString(verifyURL), html.EscapeString(verifyURL)),
+	}
+
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("verify email: %w", err)
+	}
+	return nil
+}
+
+func (es *EmailService) SignInLink(to, signInURL string) error {
+	email := Email{
+		Subject:   "Your sign in link",
+		To:        to,
+		Plaintext: "To sign in, please visit: " + signInURL + "\n\nIf you didn't ask to sign in you can ignore this email.",
+		HTML: fmt.Sprintf(`<p>To sign in, please visit: <a href="%s">%s</a></p><p>If you didn't ask to sign in you can ignore this email.</p>`,
+			html.EscapeString(signInURL), html.EscapeString(signInURL)),
+	}
+
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("sign in link email: %w", err)
+	}
+	return nil
+}
+
+// Sent instead of a verification email when someone signs up with an
+// address that already has an account
+func (es *EmailService) SignUpAttempt(to, signInURL, resetURL string) error {
+	email := Email{
+		Subject: "Someone tried to sign up with your email address",
+		To:      to,
+		Plaintext: "Someone tried to create a new account with this email address, but you already have one.\n\n" +
+			"If it was you, you can sign in at: " + signInURL + "\nIf you've forgotten your password you can reset it at: " + resetURL +
+			"\n\nIf it wasn't you, you can ignore this email. Your account hasn't been changed.",
+		HTML: fmt.Sprintf(`<p>Someone tried to create a new account with this email address, but you already have one.</p>`+
+			`<p>If it was you, you can sign in at: <a href="%s">%s</a><br>If you've forgotten your password you can reset it at: <a href="%s">%s</a></p>`+
+			`<p>If it wasn't you, you can ignore this email. Your account hasn't been changed.</p>`,
+			html.EscapeString(signInURL), html.EscapeString(signInURL), html.EscapeString(resetURL), html.EscapeString(resetURL)),
+	}
+
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("sign up attempt email: %w", err)
+	}
+	return nil
+}
+
+// Sent to the new address when a user changes their email
+func (es *EmailService) ConfirmEmailChange(to, confirmURL string) error {
+	email := Email{
+		Subject:   "Confirm your new email address",
+		To:        to,
+		Plaintext: "To start using this address for your account, please visit: " + confirmURL + "\n\nIf you didn't ask for this you can ignore this email.",
+		HTML: fmt.Sprintf(`<p>To start using this address for your account, please visit: <a href="%s">%s</a></p><p>If you didn't ask for this you can ignore this email.</p>`,
+			html.EscapeString(confirmURL), html.EscapeString(confirmURL)),
+	}
+
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("confirm email change email: %w", err)
+	}
+	return nil
+}
+
+// Sent to the old address when a user changes their email, so the owner
+// finds out if it wasn't them
+func (es *EmailService) EmailChangeRequested(to, newEmail, resetURL string) error {
+	email := Email{
+		Subject: "Your email address is being changed",
+		To:      to,
+		Plaintext: fmt.Sprintf("Someone signed in to your account has asked to change its email address to %s. "+
+			"It will change once the link sent there is followed.\n\nIf this wasn't you, reset your password straight away at: %s", newEmail, resetURL),
+		HTML: fmt.Sprintf(`<p>Someone signed in to your account has asked to change its email address to %s. `+
+			`It will change once the link sent there is followed.</p><p>If this wasn't you, reset your password straight away at: <a href="%s">%s</a></p>`,
+			html.EscapeString(newEmail), html.EscapeString(resetURL), html.EscapeString(resetURL)),
+	}
+
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("email change requested email: %w", err)
+	}
+	return nil
+}
+
+// Warn the account owner that someone has been guessing their password
+func (es *EmailService) AccountLocked(to, ip string, until time.Time, resetURL string) error {
+	when := until.Format("15:04 MST on 2 Jan 2006")
+	email := Email{
+		Subject: "Your account has been locked",
+		To:      to,
+		Plaintext: fmt.Sprintf("There have been too many failed attempts to sign in to your account, the last from %s, "+
+			"so signing in with a password is blocked until %s.\n\nIf this wasn't you, someone may be trying to guess "+
+			"your password. You can choose a new one at: %s", ip, when, resetURL),
+		HTML: fmt.Sprintf(`<p>There have been too many failed attempts to sign in to your account, the last from %s, `+
+			`so signing in with a password is blocked until %s.</p><p>If this wasn't you, someone may be trying to guess `+
+			`your password. You can choose a new one at: <a href="%s">%s</a></p>`,
+			html.EscapeString(ip), when, html.EscapeString(resetURL), html.EscapeString(resetURL)),
+	}
+
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("account locked email: %w", err)
+	}
+	return nil
+}
+
+// Let a user know they've been added to someone else's gallery
+func (es *EmailService) GalleryInvite(to, inviter, title, role, galleryURL string) error {
+	email := Email{
+		Subject: inviter + " shared a gallery with you",
+		To:      to,
+		Plaintext: fmt.Sprintf("%s has added you to the gallery %q as a %s. View it at: %s",
+			inviter, title, role, galleryURL),
+		HTML: fmt.Sprintf(`<p>%s has added you to the gallery &quot;%s&quot; as a %s. View it at: <a href="%s">%s</a></p>`,
+			html.EscapeString(inviter), html.EscapeString(title), role,
+			html.EscapeString(galleryURL), html.EscapeString(galleryURL)),
+	}
+
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("gallery invite email: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+	"taran1s.share/rand"
+)
+
+const (
+	DefaultEmailChangeDuration = 24 * time.Hour
+)
+
+// A new email address waiting for the user to follow the link sent to it
+type EmailChange struct {
+	ID       int
+	UserID   int
+	NewEmail string
+	// Only set when created
+	Token     string
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+type EmailChangeService struct {
+	DB            *sql.DB
+	BytesPerToken int
+	Duration      time.Duration
+}
+
+func (service *EmailChangeService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+// Start changing the user's email address, replacing any change they
+// already had waiting. Returns ErrEmailExists if another account has the
+// new address
+func (service *EmailChangeService) Create(userID int, newEmail string) (*EmailChange, error) {
+	newEmail = normaliseEmail(newEmail)
+	if !checkEmail(newEmail) {
+		return nil, ErrInvalidEmail
+	}
+
+	var exists bool
+	row := service.DB.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM users WHERE email = $1);`, newEmail)
+	err := row.Scan(&exists)
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+	if exists {
+		return nil, ErrEmailExists
+	}
+
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+
+	duration := service.Duration
+	if duration == 0 {
+		duration = DefaultEmailChangeDuration
+	}
+
+	change := EmailChange{
+		UserID:    userID,
+		NewEmail:  newEmail,
+		Token:     token,
+		TokenHash: service.hash(token),
+		ExpiresAt: time.Now().Add(duration),
+	}
+
+	row = service.DB.QueryRow(`
+		INSERT INTO email_changes (user_id, new_email, token_hash, expires_at)
+		VALUES ($1,$2,$3,$4) ON CONFLICT (user_id) DO
+		UPDATE
+		SET new_email = $2, token_hash = $3, created_at = NOW(), expires_at = $4
+		WHERE email_changes.created_at < $5
+		RETURNING id;`, change.UserID, change.NewEmail, change.TokenHash,
+		change.ExpiresAt, time.Now().Add(-MinResendInterval))
+
+	err = row.Scan(&change.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrResendTooSoon
+	} else if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+
+	return &change, nil
+}
+
+// Switch the user to the address the token was sent to. Following the
+// link proves the new address is theirs, so it counts as verified
+func (service *EmailChangeService) Consume(token string) (*User, error) {
+	var user User
+	var expiresAt time.Time
+	row := service.DB.QueryRow(`
+		DELETE FROM email_changes
+		WHERE token_hash = $1
+		RETURNING user_id, new_email, expires_at;`, service.hash(token))
+
+	err := row.Scan(&user.ID, &user.Email, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("consume: %w", err)
+	}
+
+	if time.Now().After(expiresAt) {
+		return nil, ErrTokenExpired
+	}
+
+	_, err = service.DB.Exec(`
+		UPDATE users
+		SET email = $2, email_verified_at = NOW()
+		WHERE id = $1;`, user.ID, user.Email)
+	if err != nil {
+		// Someone signed up with the address after the link was sent
+		var pgError *pgconn.PgError
+		if errors.As(err, &pgError) && pgError.Code == pgerrcode.UniqueViolation {
+			return nil, ErrEmailExists
+		}
+		return nil, fmt.Errorf("consume: %w", err)
+	}
+
+	return &user, nil
+}
+
+// Drop any change the user has waiting, such as when they reset their
+// password because someone else had got in
+func (service *EmailChangeService) Cancel(userID int) error {
+	_, err := service.DB.Exec(`
+		DELETE FROM email_changes
+		WHERE user_id = $1;`, userID)
+	if err != nil {
+		return fmt.Errorf("cancel: %w", err)
+	}
+	return nil
+}
+
+// Remove changes whose links were never followed
+func (service *EmailChangeService) DeleteExpired() (int64, error) {
+	result, err := service.DB.Exec(`
+		DELETE FROM email_changes
+		WHERE expires_at < NOW();`)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired: %w", err)
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,135 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"taran1s.share/rand"
+)
+
+const (
+	DefaultVerificationDuration = 24 * time.Hour
+	// Stops the resend button being used to flood someone's inbox
+	MinResendInterval = time.Minute
+)
+
+var (
+	ErrEmailNotVerified error = fmt.Errorf("Please verify your email address first")
+	ErrResendTooSoon    error = fmt.Errorf("A verification email was sent recently, please check your inbox or try again in a minute")
+)
+
+type EmailVerification struct {
+	ID     int
+	UserID int
+	// Only set when created
+	Token     string
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+type EmailVerificationService struct {
+	DB            *sql.DB
+	BytesPerToken int
+	Duration      time.Duration
+}
+
+func (service *EmailVerificationService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+// Issue a verification token for the user, replacing any earlier one
+func (service *EmailVerificationService) Create(userID int) (*EmailVerification, error) {
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+
+	duration := service.Duration
+	if duration == 0 {
+		duration = DefaultVerificationDuration
+	}
+
+	verification := EmailVerification{
+		UserID:    userID,
+		Token:     token,
+		TokenHash: service.hash(token),
+		ExpiresAt: time.Now().Add(duration),
+	}
+
+	row := service.DB.QueryRow(`
+		INSERT INTO email_verifications (user_id, token_hash, expires_at)
+		VALUES ($1,$2,$3) ON CONFLICT (user_id) DO
+		UPDATE
+		SET token_hash = $2, created_at = NOW(), expires_at = $3
+		WHERE email_verifications.created_at < $4
+		RETURNING id;`, verification.UserID, verification.TokenHash,
+		verification.ExpiresAt, time.Now().Add(-MinResendInterval))
+
+	err = row.Scan(&verification.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrResendTooSoon
+	} else if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+
+	return &verification, nil
+}
+
+// Mark the email address the token was sent to as verified
+func (service *EmailVerificationService) Consume(token string) (*User, error) {
+	var user User
+	var expiresAt time.Time
+	row := service.DB.QueryRow(`
+		DELETE FROM email_verifications
+		WHERE token_hash = $1
+		RETURNING user_id, expires_at;`, service.hash(token))
+
+	err := row.Scan(&user.ID, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("consume: %w", err)
+	}
+
+	if time.Now().After(expiresAt) {
+		return nil, ErrTokenExpired
+	}
+
+	err = service.MarkVerified(user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("consume: %w", err)
+	}
+
+	return &user, nil
+}
+
+// Record that the user has shown they can read mail sent to their address,
+// such as by following a password reset link
+func (service *EmailVerificationService) MarkVerified(userID int) error {
+	_, err := service.DB.Exec(`
+		UPDATE users
+		SET email_verified_at = COALESCE(email_verified_at, NOW())
+		WHERE id = $1;`, userID)
+	if err != nil {
+		return fmt.Errorf("mark verified: %w", err)
+	}
+
+	_, err = service.DB.Exec(`
+		DELETE FROM email_verifications
+		WHERE user_id = $1;`, userID)
+	if err != nil {
+		return fmt.Errorf("mark verified: %w", err)
+	}
+
+	return nil
+}
@@ -7,5 +7,18 @@ var (
 	ErrInvalidEmail       = errors.New("Invalid Email Address")
 	ErrEmailExists        = errors.New("There is already an account registered  with that email address")
 	ErrPasswordMatch      = errors.New("Passwords do not match")
+	ErrNameRequired       = errors.New("Please enter your forename and surname")
 	ErrNotFound           = errors.New("Resource could not be found")
+	ErrInvalidFilename    = errors.New("Invalid file name")
+	ErrInvalidExtension   = errors.New("Only png, jpg, jpeg and gif images can be uploaded")
+	ErrInvalidImage       = errors.New("File is not a valid image")
+	ErrInvalidSize        = errors.New("Invalid image size")
+	ErrContentMismatch    = errors.New("File contents do not match its extension")
+	ErrImageTooLarge      = errors.New("Image dimensions are too large")
+	ErrPolyglotImage      = errors.New("Image contains unexpected data")
+	ErrImageExists        = errors.New("An image with that name already exists, please rename the file or delete the old one first")
+	ErrInvalidVisibility  = errors.New("Invalid gallery visibility")
+	ErrForbidden          = errors.New("You are not authorized to do that")
+	ErrInvalidRole        = errors.New("Invalid gallery role")
+	ErrMemberIsOwner      = errors.New("The gallery owner can't be added as a member")
 )
@@ -4,35 +4,58 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"io/fs"
-	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
 )
 
 var ErrGalleryNoExist error = fmt.Errorf("Gallery does not exist..")
 
+// Who can see a gallery. Private galleries are only visible to their owner,
+// unlisted ones to anyone with the link and public ones are also listed on
+// the public galleries page
+const (
+	VisibilityPrivate  = "private"
+	VisibilityUnlisted = "unlisted"
+	VisibilityPublic   = "public"
+)
+
+func ValidVisibility(visibility string) bool {
+	switch visibility {
+	case VisibilityPrivate, VisibilityUnlisted, VisibilityPublic:
+		return true
+	}
+	return false
+}
+
 type Gallery struct {
-	ID     int
-	UserID int
-	Title  string
+	ID         int
+	UserID     int
+	Title      string
+	Visibility string
+	// Keep exposure and lens EXIF tags on uploaded images instead of
+	// stripping all metadata
+	KeepCameraInfo bool
+	// bcrypt hash of the passphrase visitors need to view the gallery,
+	// empty when there isn't one
+	PasswordHash string
 }
 
 type GalleryService struct {
-	DB        *sql.DB
-	ImagesDir string
+	DB     *sql.DB
+	Store  ImageStore
+	Limits ImageLimits
 }
 
-type Image struct {
-	GalleryID int
-	Path      string
-	Filename  string
+// Whether visitors other than the owner and members need a passphrase to view the gallery
+func (gallery *Gallery) HasPassword() bool {
+	return gallery.PasswordHash != ""
 }
 
 func (service *GalleryService) Create(title string, userID int) (*Gallery, error) {
 	gallery := Gallery{
-		Title:  title,
-		UserID: userID,
+		Title:      title,
+		UserID:     userID,
+		Visibility: VisibilityPrivate,
 	}
 
 	row := service.DB.QueryRow(`
@@ -53,13 +76,17 @@ func (service *GalleryService) ByID(id int) (*Gallery, error) {
 	}
 
 	row := service.DB.QueryRow(`
-		SELECT title, user_id 
+		SELECT title, user_id, keep_camera_info, visibility,
+			COALESCE(password_hash, '')
 		FROM galleries
 		WHERE id = $1;`, id)
 
-	err := row.Scan(&gallery.Title, &gallery.UserID)
-	if err != nil {
-		return nil, ErrGalleryNoExist
+	err := row.Scan(&gallery.Title, &gallery.UserID, &gallery.KeepCameraInfo,
+		&gallery.Visibility, &gallery.PasswordHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("byid: %w", err)
 	}
 
 	return &gallery, nil
@@ -67,7 +94,7 @@ func (service *GalleryService) ByID(id int) (*Gallery, error) {
 
 func (service *GalleryService) ByUserID(userID int) ([]Gallery, error) {
 	rows, err := service.DB.Query(`
-		SELECT id, title
+		SELECT id, title, visibility
 		FROM galleries
 		WHERE user_id = $1;`, userID)
 
@@ -83,7 +110,7 @@ func (service *GalleryService) ByUserID(userID int) ([]Gallery, error) {
 			UserID: userID,
 		}
 
-		err := rows.Scan(&gallery.ID, &gallery.Title)
+		err := rows.Scan(&gallery.ID, &gallery.Title, &gallery.Visibility)
 		if err != nil {
 			return nil, fmt.Errorf("byuserid: %w", err)
 		}
@@ -98,11 +125,49 @@ func (service *GalleryService) ByUserID(userID int) ([]Gallery, error) {
 	return galleries, nil
 }
 
+// Every gallery with public visibility, newest first
+func (service *GalleryService) Public() ([]Gallery, error) {
+	rows, err := service.DB.Query(`
+		SELECT id, user_id, title
+		FROM galleries
+		WHERE visibility = $1
+		ORDER BY id DESC;`, VisibilityPublic)
+	if err != nil {
+		return nil, fmt.Errorf("public: %w", err)
+	}
+	defer rows.Close()
+
+	var galleries []Gallery
+	for rows.Next() {
+		gallery := Gallery{
+			Visibility: VisibilityPublic,
+		}
+
+		err := rows.Scan(&gallery.ID, &gallery.UserID, &gallery.Title)
+		if err != nil {
+			return nil, fmt.Errorf("public: %w", err)
+		}
+
+		galleries = append(galleries, gallery)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("public: %w", err)
+	}
+
+	return galleries, nil
+}
+
 func (service *GalleryService) Update(gallery *Gallery) error {
+	if !ValidVisibility(gallery.Visibility) {
+		return ErrInvalidVisibility
+	}
+
 	_, err := service.DB.Exec(`
 		UPDATE galleries
-		SET title = $2
-		WHERE id = $1;`, gallery.ID, gallery.Title)
+		SET title = $2, keep_camera_info = $3, visibility = $4
+		WHERE id = $1;`, gallery.ID, gallery.Title, gallery.KeepCameraInfo,
+		gallery.Visibility)
 
 	if err != nil {
 		return fmt.Errorf("update: %w", err)
@@ -111,8 +176,49 @@ func (service *GalleryService) Update(gallery *Gallery) error {
 	return nil
 }
 
-func (service *GalleryService) DeleteID(id int) error {
+// Set the passphrase needed to view a gallery, or remove it if password is
+// empty
+func (service *GalleryService) SetPassword(gallery *Gallery, password string) error {
+	hash := ""
+	if password != "" {
+		var err error
+		hash, err = defaultPasswordHasher.Hash(password)
+		if err != nil {
+			return fmt.Errorf("set password: %w", err)
+		}
+	}
+
 	_, err := service.DB.Exec(`
+		UPDATE galleries
+		SET password_hash = NULLIF($2, '')
+		WHERE id = $1;`, gallery.ID, hash)
+	if err != nil {
+		return fmt.Errorf("set password: %w", err)
+	}
+
+	gallery.PasswordHash = hash
+	return nil
+}
+
+// Check a visitor's passphrase against the gallery's. A hash that can't be
+// checked is an error rather than a wrong passphrase
+func (service *GalleryService) CheckPassword(gallery *Gallery, password string) (bool, error) {
+	if !gallery.HasPassword() {
+		return true, nil
+	}
+	ok, _, err := defaultPasswordHasher.Check(gallery.PasswordHash, password)
+	if err != nil {
+		return false, fmt.Errorf("check gallery password %d: %w", gallery.ID, err)
+	}
+	return ok, nil
+}
+
+// Delete a gallery and its images. The row is removed first and the images
+// only once that has succeeded, so a database failure never costs a gallery
+// its images. If removing the images fails they are left orphaned and will
+// be picked up by RemoveOrphanedPrefixes
+func (service *GalleryService) DeleteID(id int) error {
+	result, err := service.DB.Exec(`
 		DELETE FROM galleries
 		WHERE id = $1;`, id)
 
@@ -120,78 +226,172 @@ func (service *GalleryService) DeleteID(id int) error {
 		return fmt.Errorf("deleteid: %w", err)
 	}
 
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("deleteid: %w", err)
+	}
+
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	service.removeGalleryImages(id)
+
 	return nil
 }
 
+// Delete every gallery a user owns, and their images, for when the user's
+// account is removed. Run this before deleting the user row: the cascade
+// would take the galleries with it but leave their images in the store
 func (service *GalleryService) DeleteUser(userID int) error {
-	_, err := service.DB.Exec(`
+	rows, err := service.DB.Query(`
 		DELETE FROM galleries
-		WHERE user_id = $1;`, userID)
-
+		WHERE user_id = $1
+		RETURNING id;`, userID)
 	if err != nil {
 		return fmt.Errorf("deleteuser: %w", err)
 	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		err := rows.Scan(&id)
+		if err != nil {
+			return fmt.Errorf("deleteuser: %w", err)
+		}
+		ids = append(ids, id)
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("deleteuser: %w", err)
+	}
+
+	for _, id := range ids {
+		service.removeGalleryImages(id)
+	}
 
 	return nil
 }
 
-func (service *GalleryService) galleryDir(id int) string {
-	imagesDir := service.ImagesDir
-	if imagesDir == "" {
-		imagesDir = "images"
+// Best effort removal of a deleted gallery's images - failures are logged
+// rather than returned because the row is already gone
+func (service *GalleryService) removeGalleryImages(id int) {
+	err := service.removePrefix(galleryPrefix(id))
+	if err != nil {
+		fmt.Printf("removing images for gallery %d: %v\n", id, err)
 	}
-	return filepath.Join(imagesDir, fmt.Sprintf("gallery-%d", id))
 }
 
-func (service *GalleryService) extensions() []string {
-	return []string{".png", ".jpg", ".jpeg", ".gif"}
+func (service *GalleryService) removePrefix(prefix string) error {
+	objects, err := service.Store.List(prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, object := range objects {
+		err := service.Store.Delete(object.Key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func hasExtension(file string, extensions []string) bool {
-	for _, ext := range extensions {
-		file = strings.ToLower(file)
-		ext = strings.ToLower(ext)
-		if filepath.Ext(file) == ext {
-			return true
+// IDs of every gallery, used by the maintenance commands
+func (service *GalleryService) galleryIDs() ([]int, error) {
+	rows, err := service.DB.Query(`
+		SELECT id FROM galleries ORDER BY id;`)
+	if err != nil {
+		return nil, fmt.Errorf("gallery ids: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, fmt.Errorf("gallery ids: %w", err)
 		}
+		ids = append(ids, id)
 	}
-	return false
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("gallery ids: %w", err)
+	}
+
+	return ids, nil
 }
 
-func (service *GalleryService) Images(galleryID int) ([]Image, error) {
-	globPattern := filepath.Join(service.galleryDir(galleryID), "*")
+// Find gallery-<id>/ prefixes in the image store that have no matching row
+// in the galleries table. DeleteID and DeleteUser remove a gallery's images
+// themselves, so these are only left behind when that removal failed or
+// the row was deleted some other way
+func (service *GalleryService) OrphanedPrefixes() ([]string, error) {
+	// The store listing has to happen before we read the gallery IDs.
+	// Rows are always inserted before their images are stored so any
+	// prefix we see here will have a row by the time we query
+	objects, err := service.Store.List(galleryPrefixRoot)
+	if err != nil {
+		return nil, fmt.Errorf("orphaned prefixes: %w", err)
+	}
 
-	allFiles, err := filepath.Glob(globPattern)
+	ids, err := service.galleryIDs()
 	if err != nil {
-		return nil, fmt.Errorf("getting image files: %w", err)
+		return nil, fmt.Errorf("orphaned prefixes: %w", err)
+	}
+
+	galleryIDs := make(map[int]bool)
+	for _, id := range ids {
+		galleryIDs[id] = true
 	}
 
-	var images []Image
-	for _, file := range allFiles {
-		if hasExtension(file, service.extensions()) {
-			images = append(images, Image{
-				GalleryID: galleryID,
-				Path:      file,
-				Filename:  filepath.Base(file),
-			})
+	seen := make(map[string]bool)
+	var orphans []string
+	for _, object := range objects {
+		dir, _, ok := strings.Cut(object.Key, "/")
+		if !ok {
+			continue
+		}
+
+		id, err := strconv.Atoi(strings.TrimPrefix(dir, galleryPrefixRoot))
+		if err != nil || galleryIDs[id] {
+			continue
+		}
+
+		prefix := galleryPrefix(id)
+		if !seen[prefix] {
+			seen[prefix] = true
+			orphans = append(orphans, prefix)
 		}
 	}
 
-	return images, nil
+	return orphans, nil
 }
 
-func (service *GalleryService) Image(galleryID int, filename string) (Image, error) {
-	imagePath := filepath.Join(service.galleryDir(galleryID), filename)
+// Remove the images under every orphaned prefix, returning the prefixes removed
+func (service *GalleryService) RemoveOrphanedPrefixes() ([]string, error) {
+	orphans, err := service.OrphanedPrefixes()
+	if err != nil {
+		return nil, err
+	}
 
-	_, err := os.Stat(imagePath)
-	if errors.Is(err, fs.ErrNotExist) {
-		return Image{}, fs.ErrNotExist
-	} else if err != nil {
-		return Image{}, fmt.Errorf("querying image: %w", err)
+	var removed []string
+	for _, prefix := range orphans {
+		err := service.removePrefix(prefix)
+		if err != nil {
+			return removed, fmt.Errorf("removing %v: %w", prefix, err)
+		}
+		removed = append(removed, prefix)
 	}
-	return Image{
-		Filename:  filename,
-		GalleryID: galleryID,
-		Path:      imagePath,
-	}, nil
+
+	return removed, nil
+}
+
+const galleryPrefixRoot = "gallery-"
+
+func galleryPrefix(id int) string {
+	return fmt.Sprintf("%s%d/", galleryPrefixRoot, id)
 }
@@ -0,0 +1,253 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Roles a user can be given in someone else's gallery, from least to most
+// trusted
+const (
+	RoleViewer      = "viewer"
+	RoleContributor = "contributor"
+	RoleEditor      = "editor"
+	// Not stored in gallery_members - the owner is the gallery's user_id
+	RoleOwner = "owner"
+)
+
+func ValidRole(role string) bool {
+	switch role {
+	case RoleViewer, RoleContributor, RoleEditor:
+		return true
+	}
+	return false
+}
+
+// Things that can be done to a gallery, each needing a more trusted role
+// than the last
+type GalleryAction int
+
+const (
+	// See the gallery and its images
+	ActionView GalleryAction = iota
+	// Add images
+	ActionUpload
+	// Rename the gallery and delete images
+	ActionEdit
+	// Change who can see the gallery, manage its members or delete it
+	ActionManage
+)
+
+// The most trusted action each role can perform
+var roleActions = map[string]GalleryAction{
+	RoleViewer:      ActionView,
+	RoleContributor: ActionUpload,
+	RoleEditor:      ActionEdit,
+	RoleOwner:       ActionManage,
+}
+
+// Whether role, which may be empty, allows action
+func RoleAllows(role string, action GalleryAction) bool {
+	allowed, ok := roleActions[role]
+	return ok && action <= allowed
+}
+
+type GalleryMember struct {
+	GalleryID int
+	UserID    int
+	Email     string
+	Forename  string
+	Surname   string
+	Role      string
+	CreatedAt time.Time
+}
+
+// A gallery someone else owns along with the user's role in it
+type SharedGallery struct {
+	Gallery
+	Role string
+}
+
+// The user's role in a gallery, or an empty string if they have none.
+// Anonymous visitors are passed as a nil user
+func (service *GalleryService) Role(gallery *Gallery, user *User) (string, error) {
+	if user == nil {
+		return "", nil
+	}
+
+	if user.ID == gallery.UserID {
+		return RoleOwner, nil
+	}
+
+	var role string
+	row := service.DB.QueryRow(`
+		SELECT role
+		FROM gallery_members
+		WHERE gallery_id = $1 AND user_id = $2;`, gallery.ID, user.ID)
+
+	err := row.Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("role: %w", err)
+	}
+
+	return role, nil
+}
+
+// Check the user may perform action on the gallery, returning their role.
+// Anyone can view public and unlisted galleries, everything else depends on
+// the user's role. Returns ErrForbidden if the action isn't allowed
+func (service *GalleryService) Authorize(gallery *Gallery, user *User, action GalleryAction) (string, error) {
+	role, err := service.Role(gallery, user)
+	if err != nil {
+		return "", fmt.Errorf("authorize: %w", err)
+	}
+
+	if RoleAllows(role, action) {
+		return role, nil
+	}
+
+	if action == ActionView && (gallery.Visibility == VisibilityUnlisted ||
+		gallery.Visibility == VisibilityPublic) {
+		return role, nil
+	}
+
+	return role, ErrForbidden
+}
+
+// Give the user registered with email a role in the gallery, replacing any
+// role they already had
+func (service *GalleryService) AddMember(gallery *Gallery, email, role string) (*GalleryMember, error) {
+	if !ValidRole(role) {
+		return nil, ErrInvalidRole
+	}
+
+	member := GalleryMember{
+		GalleryID: gallery.ID,
+		Email:     strings.ToLower(email),
+		Role:      role,
+	}
+
+	row := service.DB.QueryRow(`
+		SELECT id, forename, surname
+		FROM users
+		WHERE email = $1;`, member.Email)
+
+	err := row.Scan(&member.UserID, &member.Forename, &member.Surname)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("add member: %w", err)
+	}
+
+	if member.UserID == gallery.UserID {
+		return nil, ErrMemberIsOwner
+	}
+
+	row = service.DB.QueryRow(`
+		INSERT INTO gallery_members (gallery_id, user_id, role)
+		VALUES ($1,$2,$3)
+		ON CONFLICT (gallery_id, user_id) DO
+		UPDATE
+		SET role = $3
+		RETURNING created_at;`, member.GalleryID, member.UserID, member.Role)
+
+	err = row.Scan(&member.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("add member: %w", err)
+	}
+
+	return &member, nil
+}
+
+func (service *GalleryService) Members(galleryID int) ([]GalleryMember, error) {
+	rows, err := service.DB.Query(`
+		SELECT users.id, users.email, users.forename, users.surname,
+			gallery_members.role, gallery_members.created_at
+		FROM gallery_members
+		JOIN users ON users.id = gallery_members.user_id
+		WHERE gallery_members.gallery_id = $1
+		ORDER BY gallery_members.created_at;`, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("members: %w", err)
+	}
+	defer rows.Close()
+
+	var members []GalleryMember
+	for rows.Next() {
+		member := GalleryMember{
+			GalleryID: galleryID,
+		}
+
+		err := rows.Scan(&member.UserID, &member.Email, &member.Forename,
+			&member.Surname, &member.Role, &member.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("members: %w", err)
+		}
+
+		members = append(members, member)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("members: %w", err)
+	}
+
+	return members, nil
+}
+
+func (service *GalleryService) RemoveMember(galleryID, userID int) error {
+	result, err := service.DB.Exec(`
+		DELETE FROM gallery_members
+		WHERE gallery_id = $1 AND user_id = $2;`, galleryID, userID)
+	if err != nil {
+		return fmt.Errorf("remove member: %w", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("remove member: %w", err)
+	}
+
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// Galleries the user has been invited to, most recent first
+func (service *GalleryService) SharedWith(userID int) ([]SharedGallery, error) {
+	rows, err := service.DB.Query(`
+		SELECT galleries.id, galleries.user_id, galleries.title,
+			galleries.visibility, gallery_members.role
+		FROM gallery_members
+		JOIN galleries ON galleries.id = gallery_members.gallery_id
+		WHERE gallery_members.user_id = $1
+		ORDER BY gallery_members.created_at DESC;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("shared with: %w", err)
+	}
+	defer rows.Close()
+
+	var galleries []SharedGallery
+	for rows.Next() {
+		var shared SharedGallery
+		err := rows.Scan(&shared.ID, &shared.UserID, &shared.Title,
+			&shared.Visibility, &shared.Role)
+		if err != nil {
+			return nil, fmt.Errorf("shared with: %w", err)
+		}
+
+		galleries = append(galleries, shared)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("shared with: %w", err)
+	}
+
+	return galleries, nil
+}
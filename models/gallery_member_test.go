@@ -0,0 +1,242 @@
+package models
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRoleAllows(t *testing.T) {
+	actions := []GalleryAction{ActionView, ActionUpload, ActionEdit, ActionManage}
+
+	tests := map[string]struct {
+		role string
+		// Whether each of actions is allowed, in order
+		want []bool
+	}{
+		"no role":     {role: "", want: []bool{false, false, false, false}},
+		"unknown":     {role: "admin", want: []bool{false, false, false, false}},
+		"viewer":      {role: RoleViewer, want: []bool{true, false, false, false}},
+		"contributor": {role: RoleContributor, want: []bool{true, true, false, false}},
+		"editor":      {role: RoleEditor, want: []bool{true, true, true, false}},
+		"owner":       {role: RoleOwner, want: []bool{true, true, true, true}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			for i, action := range actions {
+				if got := RoleAllows(tc.role, action); got != tc.want[i] {
+					t.Errorf("RoleAllows(%q, %d) = %v, want %v", tc.role, action, got, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestValidRole(t *testing.T) {
+	tests := map[string]bool{
+		RoleViewer:      true,
+		RoleContributor: true,
+		RoleEditor:      true,
+		// Ownership can't be handed out as a member role
+		RoleOwner: false,
+		"":        false,
+		"Editor":  false,
+	}
+
+	for role, want := range tests {
+		if got := ValidRole(role); got != want {
+			t.Errorf("ValidRole(%q) = %v, want %v", role, got, want)
+		}
+	}
+}
+
+// Visitors and owners are decided without looking up members
+func TestAuthorizeWithoutMembership(t *testing.T) {
+	owner := &User{ID: 1}
+
+	tests := map[string]struct {
+		visibility string
+		user       *User
+		action     GalleryAction
+		wantRole   string
+		wantErr    error
+	}{
+		"visitor views public": {
+			visibility: VisibilityPublic,
+			action:     ActionView,
+		},
+		"visitor views unlisted": {
+			visibility: VisibilityUnlisted,
+			action:     ActionView,
+		},
+		"visitor views private": {
+			visibility: VisibilityPrivate,
+			action:     ActionView,
+			wantErr:    ErrForbidden,
+		},
+		"visitor uploads to public": {
+			visibility: VisibilityPublic,
+			action:     ActionUpload,
+			wantErr:    ErrForbidden,
+		},
+		"owner manages private": {
+			visibility: VisibilityPrivate,
+			user:       owner,
+			action:     ActionManage,
+			wantRole:   RoleOwner,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			service := &GalleryService{}
+			gallery := &Gallery{ID: 1, UserID: owner.ID, Visibility: tc.visibility}
+
+			role, err := service.Authorize(gallery, tc.user, tc.action)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Authorize() err = %v, want %v", err, tc.wantErr)
+			}
+			if role != tc.wantRole {
+				t.Errorf("Authorize() role = %q, want %q", role, tc.wantRole)
+			}
+		})
+	}
+}
+
+func TestAuthorizeMembers(t *testing.T) {
+	db := testDB(t)
+	service := &GalleryService{DB: db}
+
+	owner := testUser(t, db, "owner@example.com")
+	stranger := testUser(t, db, "stranger@example.com")
+	members := map[string]*User{
+		RoleViewer:      testUser(t, db, "viewer@example.com"),
+		RoleContributor: testUser(t, db, "contributor@example.com"),
+		RoleEditor:      testUser(t, db, "editor@example.com"),
+	}
+
+	gallery, err := service.Create("Holiday", owner.ID)
+	if err != nil {
+		t.Fatalf("Create() err = %v", err)
+	}
+	for role, user := range members {
+		_, err := service.AddMember(gallery, user.Email, role)
+		if err != nil {
+			t.Fatalf("AddMember(%s) err = %v", role, err)
+		}
+	}
+
+	tests := map[string]struct {
+		user     *User
+		action   GalleryAction
+		wantRole string
+		wantErr  error
+	}{
+		"viewer views": {
+			user:     members[RoleViewer],
+			action:   ActionView,
+			wantRole: RoleViewer,
+		},
+		"viewer uploads": {
+			user:     members[RoleViewer],
+			action:   ActionUpload,
+			wantRole: RoleViewer,
+			wantErr:  ErrForbidden,
+		},
+		"contributor uploads": {
+			user:     members[RoleContributor],
+			action:   ActionUpload,
+			wantRole: RoleContributor,
+		},
+		"contributor edits": {
+			user:     members[RoleContributor],
+			action:   ActionEdit,
+			wantRole: RoleContributor,
+			wantErr:  ErrForbidden,
+		},
+		"editor edits": {
+			user:     members[RoleEditor],
+			action:   ActionEdit,
+			wantRole: RoleEditor,
+		},
+		"editor manages": {
+			user:     members[RoleEditor],
+			action:   ActionManage,
+			wantRole: RoleEditor,
+			wantErr:  ErrForbidden,
+		},
+		"stranger views private": {
+			user:    stranger,
+			action:  ActionView,
+			wantErr: ErrForbidden,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			role, err := service.Authorize(gallery, tc.user, tc.action)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Authorize() err = %v, want %v", err, tc.wantErr)
+			}
+			if role != tc.wantRole {
+				t.Errorf("Authorize() role = %q, want %q", role, tc.wantRole)
+			}
+		})
+	}
+
+	// Removing a member takes their access away
+	err = service.RemoveMember(gallery.ID, members[RoleEditor].ID)
+	if err != nil {
+		t.Fatalf("RemoveMember() err = %v", err)
+	}
+	_, err = service.Authorize(gallery, members[RoleEditor], ActionView)
+	if !errors.Is(err, ErrForbidden) {
+		t.Errorf("Authorize() after removal err = %v, want ErrForbidden", err)
+	}
+}
+
+func TestAddMember(t *testing.T) {
+	db := testDB(t)
+	service := &GalleryService{DB: db}
+
+	owner := testUser(t, db, "owner@example.com")
+	testUser(t, db, "friend@example.com")
+	gallery, err := service.Create("Holiday", owner.ID)
+	if err != nil {
+		t.Fatalf("Create() err = %v", err)
+	}
+
+	// In order, as later cases change what earlier ones added
+	tests := []struct {
+		name    string
+		email   string
+		role    string
+		wantErr error
+	}{
+		{name: "member", email: "friend@example.com", role: RoleViewer},
+		{name: "changes the role", email: "Friend@Example.com", role: RoleEditor},
+		{name: "invalid role", email: "friend@example.com", role: RoleOwner, wantErr: ErrInvalidRole},
+		{name: "owner", email: "owner@example.com", role: RoleEditor, wantErr: ErrMemberIsOwner},
+		{name: "no account", email: "nobody@example.com", role: RoleViewer, wantErr: ErrNotFound},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			member, err := service.AddMember(gallery, tc.email, tc.role)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("AddMember() err = %v, want %v", err, tc.wantErr)
+			}
+			if err == nil && member.Role != tc.role {
+				t.Errorf("AddMember() role = %q, want %q", member.Role, tc.role)
+			}
+		})
+	}
+
+	members, err := service.Members(gallery.ID)
+	if err != nil {
+		t.Fatalf("Members() err = %v", err)
+	}
+	if len(members) != 1 || members[0].Role != RoleEditor {
+		t.Errorf("Members() = %+v, want one editor", members)
+	}
+}
@@ -0,0 +1,119 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestDeleteUser(t *testing.T) {
+	db := testDB(t)
+	store := &LocalImageStore{Dir: t.TempDir()}
+	service := &GalleryService{DB: db, Store: store}
+
+	owner := testUser(t, db, "owner@example.com")
+	other := testUser(t, db, "other@example.com")
+
+	var galleries []*Gallery
+	for _, userID := range []int{owner.ID, owner.ID, other.ID} {
+		gallery, err := service.Create("Holiday", userID)
+		if err != nil {
+			t.Fatalf("Create() err = %v", err)
+		}
+		err = service.CreateImage(gallery.ID, "cat.png", bytes.NewReader(testPNG(t, 8, 8)))
+		if err != nil {
+			t.Fatalf("CreateImage() err = %v", err)
+		}
+		galleries = append(galleries, gallery)
+	}
+
+	err := service.DeleteUser(owner.ID)
+	if err != nil {
+		t.Fatalf("DeleteUser() err = %v", err)
+	}
+
+	for i, gallery := range galleries {
+		wantGone := gallery.UserID == owner.ID
+
+		_, err := service.ByID(gallery.ID)
+		if gone := errors.Is(err, ErrNotFound); gone != wantGone {
+			t.Errorf("gallery %d: ByID() err = %v, want gone %v", i, err, wantGone)
+		}
+
+		objects, err := store.List(galleryPrefix(gallery.ID))
+		if err != nil {
+			t.Fatalf("List() err = %v", err)
+		}
+		if gone := len(objects) == 0; gone != wantGone {
+			t.Errorf("gallery %d: %d images left in the store, want gone %v", i, len(objects), wantGone)
+		}
+	}
+
+	// Nothing is left for gc to find
+	orphans, err := service.OrphanedPrefixes()
+	if err != nil {
+		t.Fatalf("OrphanedPrefixes() err = %v", err)
+	}
+	if len(orphans) != 0 {
+		t.Errorf("OrphanedPrefixes() = %v, want none", orphans)
+	}
+}
+
+func TestGalleryPassword(t *testing.T) {
+	hash, err := defaultPasswordHasher.Hash("open sesame")
+	if err != nil {
+		t.Fatalf("Hash() err = %v", err)
+	}
+
+	tests := map[string]struct {
+		hash     string
+		password string
+		wantHas  bool
+		want     bool
+		wantErr  bool
+	}{
+		"no passphrase": {
+			password: "anything",
+			want:     true,
+		},
+		"right passphrase": {
+			hash:     hash,
+			password: "open sesame",
+			wantHas:  true,
+			want:     true,
+		},
+		"wrong passphrase": {
+			hash:     hash,
+			password: "Open sesame",
+			wantHas:  true,
+		},
+		"no passphrase given": {
+			hash:    hash,
+			wantHas: true,
+		},
+		"broken hash": {
+			hash:     "$2a$10$abc",
+			password: "open sesame",
+			wantHas:  true,
+			wantErr:  true,
+		},
+	}
+
+	service := &GalleryService{}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			gallery := &Gallery{ID: 1, PasswordHash: tc.hash}
+			if got := gallery.HasPassword(); got != tc.wantHas {
+				t.Errorf("HasPassword() = %v, want %v", got, tc.wantHas)
+			}
+
+			ok, err := service.CheckPassword(gallery, tc.password)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("CheckPassword() err = %v, want error %v", err, tc.wantErr)
+			}
+			if ok != tc.want {
+				t.Errorf("CheckPassword() = %v, want %v", ok, tc.want)
+			}
+		})
+	}
+}
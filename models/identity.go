@@ -0,0 +1,232 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var (
+	ErrIdentityLinked error = fmt.Errorf("That account is already linked to a GoShare user")
+	// The same whether or not there is an account with the address, so it
+	// doesn't tell anyone who is registered
+	ErrIdentityNotLinked error = fmt.Errorf("That account can't be used to sign in here. If you have a GoShare account, sign in to it and link your identity provider from the linked accounts page")
+)
+
+// An account at an identity provider that can be used to sign in
+type Identity struct {
+	ID        int
+	UserID    int
+	Issuer    string
+	Subject   string
+	Email     string
+	CreatedAt time.Time
+}
+
+type IdentityService struct {
+	DB *sql.DB
+}
+
+// Find or create the user an identity provider account signs in as. New
+// identities only get an account, new or existing, when the provider has
+// verified the address, otherwise anyone who could register the address at
+// the provider could take the account over. They are only linked to an
+// existing account that we have verified the address of too
+func (service *IdentityService) SignIn(claims *OIDCClaims) (*User, error) {
+	user, err := service.User(claims.Issuer, claims.Subject)
+	if err == nil {
+		return user, nil
+	} else if !errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("sign in: %w", err)
+	}
+
+	if claims.Email == "" {
+		return nil, fmt.Errorf("sign in: %w: no email address", ErrOIDCFailed)
+	}
+	email := strings.ToLower(claims.Email)
+
+	existing := &User{}
+	row := service.DB.QueryRow(`
+		SELECT id, email, email_verified_at
+		FROM users
+		WHERE email = $1;`, email)
+
+	err = row.Scan(&existing.ID, &existing.Email, &existing.EmailVerifiedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		existing = nil
+	} else if err != nil {
+		return nil, fmt.Errorf("sign in: %w", err)
+	}
+
+	err = identityAllowed(claims, existing)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing == nil {
+		user, err = service.createUser(claims, email)
+		if errors.Is(err, ErrEmailExists) {
+			// Someone registered the address in the meantime
+			return nil, ErrIdentityNotLinked
+		}
+		return user, err
+	}
+
+	err = service.Link(existing.ID, claims)
+	if err != nil {
+		return nil, fmt.Errorf("sign in: %w", err)
+	}
+
+	return existing, nil
+}
+
+// Whether an identity seen for the first time may have an account made for
+// it, or be linked to existing, the account already using its address.
+// Every refusal is ErrIdentityNotLinked
+func identityAllowed(claims *OIDCClaims, existing *User) error {
+	if !claims.EmailVerified {
+		return ErrIdentityNotLinked
+	}
+	if existing != nil && !existing.EmailVerified() {
+		return ErrIdentityNotLinked
+	}
+	return nil
+}
+
+// A new account for someone signing in with an identity provider for the
+// first time, whose address the provider has verified. They have no
+// password until they set one with a reset
+func (service *IdentityService) createUser(claims *OIDCClaims, email string) (*User, error) {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("create user: %w", err)
+	}
+	defer tx.Rollback()
+
+	user := &User{
+		Email:    email,
+		Forename: claims.GivenName,
+		Surname:  claims.FamilyName,
+	}
+	now := time.Now()
+	user.EmailVerifiedAt = &now
+
+	row := tx.QueryRow(`
+		INSERT INTO users (email, forename, surname, password_hash, email_verified_at)
+		VALUES ($1,$2,$3,'',$4) RETURNING id;`, user.Email, user.Forename,
+		user.Surname, user.EmailVerifiedAt)
+
+	err = row.Scan(&user.ID)
+	if err != nil {
+		var pgError *pgconn.PgError
+		if errors.As(err, &pgError) && pgError.Code == pgerrcode.UniqueViolation {
+			return nil, ErrEmailExists
+		}
+		return nil, fmt.Errorf("create user: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO user_identities (user_id, issuer, subject, email)
+		VALUES ($1,$2,$3,$4);`, user.ID, claims.Issuer, claims.Subject, claims.Email)
+	if err != nil {
+		return nil, fmt.Errorf("create user: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("create user: %w", err)
+	}
+
+	return user, nil
+}
+
+// The user an identity is linked to
+func (service *IdentityService) User(issuer, subject string) (*User, error) {
+	user := User{}
+	row := service.DB.QueryRow(`
+		SELECT users.id, users.email
+		FROM user_identities
+			JOIN users ON users.id = user_identities.user_id
+		WHERE user_identities.issuer = $1 AND user_identities.subject = $2;`,
+		issuer, subject)
+
+	err := row.Scan(&user.ID, &user.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("user: %w", err)
+	}
+
+	return &user, nil
+}
+
+func (service *IdentityService) Link(userID int, claims *OIDCClaims) error {
+	_, err := service.DB.Exec(`
+		INSERT INTO user_identities (user_id, issuer, subject, email)
+		VALUES ($1,$2,$3,$4);`, userID, claims.Issuer, claims.Subject, claims.Email)
+	if err != nil {
+		var pgError *pgconn.PgError
+		if errors.As(err, &pgError) && pgError.Code == pgerrcode.UniqueViolation {
+			return ErrIdentityLinked
+		}
+		return fmt.Errorf("link: %w", err)
+	}
+
+	return nil
+}
+
+func (service *IdentityService) ByUserID(userID int) ([]Identity, error) {
+	rows, err := service.DB.Query(`
+		SELECT id, issuer, subject, email, created_at
+		FROM user_identities
+		WHERE user_id = $1
+		ORDER BY created_at;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("byuserid: %w", err)
+	}
+	defer rows.Close()
+
+	var identities []Identity
+	for rows.Next() {
+		identity := Identity{
+			UserID: userID,
+		}
+		err = rows.Scan(&identity.ID, &identity.Issuer, &identity.Subject,
+			&identity.Email, &identity.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("byuserid: %w", err)
+		}
+		identities = append(identities, identity)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("byuserid: %w", err)
+	}
+
+	return identities, nil
+}
+
+func (service *IdentityService) Unlink(userID, id int) error {
+	result, err := service.DB.Exec(`
+		DELETE FROM user_identities
+		WHERE id = $1 AND user_id = $2;`, id, userID)
+	if err != nil {
+		return fmt.Errorf("unlink: %w", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("unlink: %w", err)
+	}
+
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,199 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+const testIssuer = "https://id.example.com"
+
+// The rules for a first sign in, which refuse in the same way whether or
+// not there is an account
+func TestIdentityAllowed(t *testing.T) {
+	verifiedAt := time.Now()
+	verified := &User{ID: 1, EmailVerifiedAt: &verifiedAt}
+	unverified := &User{ID: 2}
+
+	tests := map[string]struct {
+		providerVerified bool
+		existing         *User
+		wantErr          error
+	}{
+		"new account": {
+			providerVerified: true,
+		},
+		"new account with an unverified address": {
+			wantErr: ErrIdentityNotLinked,
+		},
+		"both have verified the address": {
+			providerVerified: true,
+			existing:         verified,
+		},
+		"provider hasn't verified the address": {
+			existing: verified,
+			wantErr:  ErrIdentityNotLinked,
+		},
+		"we haven't verified the address": {
+			providerVerified: true,
+			existing:         unverified,
+			wantErr:          ErrIdentityNotLinked,
+		},
+		"neither has verified the address": {
+			existing: unverified,
+			wantErr:  ErrIdentityNotLinked,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			claims := &OIDCClaims{Issuer: testIssuer, Subject: "jo", Email: "jo@example.com",
+				EmailVerified: tc.providerVerified}
+
+			err := identityAllowed(claims, tc.existing)
+			if err != tc.wantErr {
+				t.Errorf("identityAllowed() err = %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestIdentitySignIn(t *testing.T) {
+	db := testDB(t)
+	service := &IdentityService{DB: db}
+
+	verified := testUser(t, db, "verified@example.com")
+	_, err := db.Exec(`UPDATE users SET email_verified_at = NOW() WHERE id = $1;`, verified.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testUser(t, db, "unverified@example.com")
+
+	tests := map[string]struct {
+		claims OIDCClaims
+		// The address of the account signed in to
+		wantEmail    string
+		wantVerified bool
+		wantErr      error
+	}{
+		"new account": {
+			claims:       OIDCClaims{Subject: "new", Email: "New@Example.com", EmailVerified: true, GivenName: "Jo"},
+			wantEmail:    "new@example.com",
+			wantVerified: true,
+		},
+		"new account with an unverified address": {
+			claims:  OIDCClaims{Subject: "newish", Email: "newish@example.com"},
+			wantErr: ErrIdentityNotLinked,
+		},
+		"both have verified the address": {
+			claims:       OIDCClaims{Subject: "verified", Email: "Verified@Example.com", EmailVerified: true},
+			wantEmail:    "verified@example.com",
+			wantVerified: true,
+		},
+		"provider hasn't verified the address": {
+			claims:  OIDCClaims{Subject: "claims-verified", Email: "verified@example.com"},
+			wantErr: ErrIdentityNotLinked,
+		},
+		"we haven't verified the address": {
+			claims:  OIDCClaims{Subject: "unverified", Email: "unverified@example.com", EmailVerified: true},
+			wantErr: ErrIdentityNotLinked,
+		},
+		"no address": {
+			claims:  OIDCClaims{Subject: "anonymous", EmailVerified: true},
+			wantErr: ErrOIDCFailed,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			tc.claims.Issuer = testIssuer
+
+			user, err := service.SignIn(&tc.claims)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("SignIn() err = %v, want %v", err, tc.wantErr)
+			}
+			if err != nil {
+				// Nothing was linked, so the next attempt fails the same way
+				_, err = service.User(tc.claims.Issuer, tc.claims.Subject)
+				if !errors.Is(err, ErrNotFound) {
+					t.Errorf("User() after refusing err = %v, want ErrNotFound", err)
+				}
+				return
+			}
+			if user.Email != tc.wantEmail || user.EmailVerified() != tc.wantVerified {
+				t.Errorf("SignIn() = %s verified %v, want %s verified %v", user.Email,
+					user.EmailVerified(), tc.wantEmail, tc.wantVerified)
+			}
+
+			// The identity now signs in to the same account, whatever
+			// address the provider has for it later
+			tc.claims.Email = "changed@example.com"
+			again, err := service.SignIn(&tc.claims)
+			if err != nil {
+				t.Fatalf("SignIn() again err = %v", err)
+			}
+			if again.ID != user.ID {
+				t.Errorf("SignIn() again = user %d, want %d", again.ID, user.ID)
+			}
+		})
+	}
+
+	identities, err := service.ByUserID(verified.ID)
+	if err != nil {
+		t.Fatalf("ByUserID() err = %v", err)
+	}
+	if len(identities) != 1 || identities[0].Subject != "verified" {
+		t.Errorf("ByUserID() = %+v, want the one identity linked by signing in", identities)
+	}
+}
+
+func TestIdentityLink(t *testing.T) {
+	db := testDB(t)
+	service := &IdentityService{DB: db}
+
+	jo := testUser(t, db, "jo@example.com")
+	sam := testUser(t, db, "sam@example.com")
+	claims := &OIDCClaims{Issuer: testIssuer, Subject: "jo", Email: "jo@id.example.com"}
+
+	err := service.Link(jo.ID, claims)
+	if err != nil {
+		t.Fatalf("Link() err = %v", err)
+	}
+
+	// An identity can only belong to one account
+	err = service.Link(sam.ID, claims)
+	if !errors.Is(err, ErrIdentityLinked) {
+		t.Errorf("Link() to another user err = %v, want ErrIdentityLinked", err)
+	}
+	err = service.Link(jo.ID, claims)
+	if !errors.Is(err, ErrIdentityLinked) {
+		t.Errorf("Link() twice err = %v, want ErrIdentityLinked", err)
+	}
+
+	user, err := service.User(claims.Issuer, claims.Subject)
+	if err != nil || user.ID != jo.ID {
+		t.Fatalf("User() = %v, %v, want user %d", user, err, jo.ID)
+	}
+
+	identities, err := service.ByUserID(jo.ID)
+	if err != nil || len(identities) != 1 {
+		t.Fatalf("ByUserID() = %+v, %v, want one identity", identities, err)
+	}
+	if identities[0].Email != claims.Email {
+		t.Errorf("identity email = %q, want %q", identities[0].Email, claims.Email)
+	}
+
+	// Only the owner can unlink it
+	err = service.Unlink(sam.ID, identities[0].ID)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Unlink() by another user err = %v, want ErrNotFound", err)
+	}
+	err = service.Unlink(jo.ID, identities[0].ID)
+	if err != nil {
+		t.Fatalf("Unlink() err = %v", err)
+	}
+	_, err = service.User(claims.Issuer, claims.Subject)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("User() after unlinking err = %v, want ErrNotFound", err)
+	}
+}
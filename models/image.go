@@ -0,0 +1,396 @@
+package models
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Image struct {
+	ID        int
+	GalleryID int
+	// Location of the image in the gallery service's ImageStore
+	Key       string
+	Filename  string
+	Size      int64
+	Width     int
+	Height    int
+	Position  int
+	CreatedAt time.Time
+	// Camera and exposure summary, only set for galleries that keep
+	// camera info
+	CameraInfo string
+	// Detected from the image contents when it was stored
+	ContentType string
+}
+
+func (service *GalleryService) extensions() []string {
+	return []string{".png", ".jpg", ".jpeg", ".gif"}
+}
+
+func hasExtension(file string, extensions []string) bool {
+	for _, ext := range extensions {
+		file = strings.ToLower(file)
+		ext = strings.ToLower(ext)
+		if filepath.Ext(file) == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// Strip any directory components from an uploaded file name and replace
+// characters we don't want ending up on disk or in a URL
+func sanitizeFilename(filename string) (string, error) {
+	filename = strings.ReplaceAll(filename, "\\", "/")
+	filename = filepath.Base(filename)
+
+	var sb strings.Builder
+	for _, r := range filename {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			sb.WriteRune(r)
+		case r == '.', r == '-', r == '_':
+			sb.WriteRune(r)
+		default:
+			sb.WriteRune('-')
+		}
+	}
+
+	filename = strings.TrimLeft(sb.String(), ".")
+	if filename == "" {
+		return "", ErrInvalidFilename
+	}
+
+	return filename, nil
+}
+
+// Read the dimensions of an image
+func imageConfig(contents []byte) (image.Config, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(contents))
+	if err != nil {
+		return image.Config{}, ErrInvalidImage
+	}
+	return config, nil
+}
+
+func imageKey(galleryID int, filename string) string {
+	return galleryPrefix(galleryID) + filename
+}
+
+// Store an uploaded image and record it in the images table. Location and
+// device metadata is stripped before anything is stored. The store
+// write happens inside the transaction so a failed write never leaves a
+// row behind. If the commit fails after the write the image is left without
+// a row and can be picked up by ImportImages
+func (service *GalleryService) CreateImage(galleryID int, filename string, contents io.Reader) error {
+	filename, err := sanitizeFilename(filename)
+	if err != nil {
+		return fmt.Errorf("create image: %w", err)
+	}
+
+	if !hasExtension(filename, service.extensions()) {
+		return fmt.Errorf("create image %v: %w", filename, ErrInvalidExtension)
+	}
+
+	data, err := io.ReadAll(contents)
+	if err != nil {
+		return fmt.Errorf("reading image contents: %w", err)
+	}
+
+	contentType, err := service.validateImage(filename, data)
+	if err != nil {
+		return fmt.Errorf("create image %v: %w", filename, err)
+	}
+
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("create image: %w", err)
+	}
+	defer tx.Rollback()
+
+	var keepCameraInfo bool
+	row := tx.QueryRow(`
+		SELECT keep_camera_info
+		FROM galleries
+		WHERE id = $1;`, galleryID)
+	err = row.Scan(&keepCameraInfo)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	} else if err != nil {
+		return fmt.Errorf("create image: %w", err)
+	}
+
+	data, cameraInfo, err := stripMetadata(data, keepCameraInfo)
+	if err != nil {
+		return fmt.Errorf("create image %v: %w", filename, err)
+	}
+
+	err = checkPolyglot(data)
+	if err != nil {
+		return fmt.Errorf("create image %v: %w", filename, err)
+	}
+
+	// Dimensions are read after stripping as the image may have been rotated
+	config, err := imageConfig(data)
+	if err != nil {
+		return fmt.Errorf("create image %v: %w", filename, err)
+	}
+
+	// An existing image is never replaced, as anyone allowed to upload
+	// could otherwise overwrite images added by someone else
+	var id int
+	row = tx.QueryRow(`
+		INSERT INTO images (gallery_id, filename, size, width, height, camera_info, content_type, position)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,
+			(SELECT COALESCE(MAX(position) + 1, 0) FROM images WHERE gallery_id = $1))
+		ON CONFLICT (gallery_id, filename) DO NOTHING
+		RETURNING id;`,
+		galleryID, filename, len(data), config.Width, config.Height, cameraInfo, contentType)
+	err = row.Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("create image %v: %w", filename, ErrImageExists)
+	} else if err != nil {
+		return fmt.Errorf("create image: %w", err)
+	}
+
+	err = service.Store.Put(imageKey(galleryID, filename), bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("storing image: %w", err)
+	}
+	service.removeVariants(galleryID, filename)
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("create image: %w", err)
+	}
+
+	return nil
+}
+
+func (service *GalleryService) Images(galleryID int) ([]Image, error) {
+	rows, err := service.DB.Query(`
+		SELECT id, filename, size, width, height, position, created_at,
+			camera_info, content_type
+		FROM images
+		WHERE gallery_id = $1
+		ORDER BY position, id;`, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("images: %w", err)
+	}
+	defer rows.Close()
+
+	var images []Image
+	for rows.Next() {
+		image := Image{
+			GalleryID: galleryID,
+		}
+
+		err := rows.Scan(&image.ID, &image.Filename, &image.Size,
+			&image.Width, &image.Height, &image.Position, &image.CreatedAt,
+			&image.CameraInfo, &image.ContentType)
+		if err != nil {
+			return nil, fmt.Errorf("images: %w", err)
+		}
+
+		image.Key = imageKey(galleryID, image.Filename)
+		images = append(images, image)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("images: %w", err)
+	}
+
+	return images, nil
+}
+
+func (service *GalleryService) Image(galleryID int, filename string) (Image, error) {
+	image := Image{
+		GalleryID: galleryID,
+		Filename:  filename,
+		Key:       imageKey(galleryID, filename),
+	}
+
+	row := service.DB.QueryRow(`
+		SELECT id, size, width, height, position, created_at, camera_info,
+			content_type
+		FROM images
+		WHERE gallery_id = $1 AND filename = $2;`, galleryID, filename)
+
+	err := row.Scan(&image.ID, &image.Size, &image.Width, &image.Height,
+		&image.Position, &image.CreatedAt, &image.CameraInfo, &image.ContentType)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Image{}, ErrNotFound
+	} else if err != nil {
+		return Image{}, fmt.Errorf("querying image: %w", err)
+	}
+
+	return image, nil
+}
+
+// Open an image's contents from the store - callers must close the reader
+func (service *GalleryService) OpenImage(image Image) (io.ReadCloser, error) {
+	contents, err := service.Store.Get(image.Key)
+	if err != nil {
+		return nil, fmt.Errorf("open image: %w", err)
+	}
+	return contents, nil
+}
+
+// Remove an image's row and then its contents. As with DeleteID the store
+// is only touched once the row is gone
+func (service *GalleryService) DeleteImage(galleryID int, filename string) error {
+	if filename != path.Base(filename) || strings.HasPrefix(filename, ".") {
+		return fmt.Errorf("delete image: %w", ErrInvalidFilename)
+	}
+
+	row := service.DB.QueryRow(`
+		DELETE FROM images
+		WHERE gallery_id = $1 AND filename = $2
+		RETURNING id;`, galleryID, filename)
+
+	var id int
+	err := row.Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	} else if err != nil {
+		return fmt.Errorf("delete image: %w", err)
+	}
+
+	err = service.Store.Delete(imageKey(galleryID, filename))
+	if err != nil {
+		fmt.Printf("removing image %v from gallery %d: %v\n", filename, galleryID, err)
+	}
+	service.removeVariants(galleryID, filename)
+
+	return nil
+}
+
+// Add rows for images that already exist in the store but are missing from
+// the images table, e.g. files copied into place before the table existed.
+// Prefixes without a gallery row are left for RemoveOrphanedPrefixes
+func (service *GalleryService) ImportImages() ([]Image, error) {
+	galleryIDs, err := service.galleryIDs()
+	if err != nil {
+		return nil, fmt.Errorf("import images: %w", err)
+	}
+
+	var imported []Image
+	for _, galleryID := range galleryIDs {
+		existing, err := service.Images(galleryID)
+		if err != nil {
+			return imported, fmt.Errorf("import images: %w", err)
+		}
+
+		known := make(map[string]bool)
+		for _, image := range existing {
+			known[image.Filename] = true
+		}
+
+		objects, err := service.Store.List(galleryPrefix(galleryID))
+		if err != nil {
+			return imported, fmt.Errorf("import images: %w", err)
+		}
+
+		for _, object := range objects {
+			filename := strings.TrimPrefix(object.Key, galleryPrefix(galleryID))
+			if strings.Contains(filename, "/") || known[filename] ||
+				strings.HasPrefix(filename, ".") ||
+				!hasExtension(filename, service.extensions()) {
+				continue
+			}
+
+			config, format, err := service.storedImageConfig(object.Key)
+			if err != nil {
+				fmt.Printf("skipping %v: %v\n", object.Key, err)
+				continue
+			}
+
+			image := Image{
+				GalleryID: galleryID,
+				Key:       object.Key,
+				Filename:  filename,
+				Size:      object.Size,
+				Width:     config.Width,
+				Height:    config.Height,
+				CreatedAt: object.ModTime,
+				// Imported files haven't been through validateImage so
+				// the type comes from the decoder rather than the name
+				ContentType: imageContentTypes[format],
+			}
+
+			row := service.DB.QueryRow(`
+				INSERT INTO images (gallery_id, filename, size, width, height,
+					content_type, position, created_at)
+				VALUES ($1,$2,$3,$4,$5,$6,
+					(SELECT COALESCE(MAX(position) + 1, 0) FROM images WHERE gallery_id = $1),
+					$7)
+				ON CONFLICT (gallery_id, filename) DO NOTHING
+				RETURNING id, position;`,
+				image.GalleryID, image.Filename, image.Size,
+				image.Width, image.Height, image.ContentType, image.CreatedAt)
+
+			err = row.Scan(&image.ID, &image.Position)
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			} else if err != nil {
+				return imported, fmt.Errorf("import images: %w", err)
+			}
+
+			imported = append(imported, image)
+		}
+	}
+
+	return imported, nil
+}
+
+func (service *GalleryService) storedImageConfig(key string) (image.Config, string, error) {
+	contents, err := service.Store.Get(key)
+	if err != nil {
+		return image.Config{}, "", err
+	}
+	defer contents.Close()
+
+	config, format, err := image.DecodeConfig(contents)
+	if err != nil || imageContentTypes[format] == "" {
+		return image.Config{}, "", ErrInvalidImage
+	}
+	return config, format, nil
+}
+
+// Find rows in the images table whose contents are missing from the store
+func (service *GalleryService) MissingImages() ([]Image, error) {
+	galleryIDs, err := service.galleryIDs()
+	if err != nil {
+		return nil, fmt.Errorf("missing images: %w", err)
+	}
+
+	var missing []Image
+	for _, galleryID := range galleryIDs {
+		images, err := service.Images(galleryID)
+		if err != nil {
+			return nil, fmt.Errorf("missing images: %w", err)
+		}
+
+		for _, image := range images {
+			_, err := service.Store.Stat(image.Key)
+			if errors.Is(err, ErrNotFound) {
+				missing = append(missing, image)
+			} else if err != nil {
+				return nil, fmt.Errorf("missing images: %w", err)
+			}
+		}
+	}
+
+	return missing, nil
+}
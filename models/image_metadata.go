@@ -0,0 +1,653 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"sort"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// Phone cameras embed GPS coordinates, device serial numbers and editing
+// history in EXIF, XMP and IPTC blocks. Everything in this file exists to
+// make sure none of that reaches the image store.
+//
+// JPEG and PNG uploads have every metadata block removed. When the EXIF
+// orientation says the camera was rotated the pixels are rotated to match
+// before the tag is dropped so the photo still displays the right way up.
+// Galleries that opt in to keeping camera info get a fresh, minimal EXIF
+// block holding only exposure and lens details. GIFs don't carry EXIF and
+// are left untouched.
+
+const (
+	tagMake        = 0x010F
+	tagModel       = 0x0110
+	tagOrientation = 0x0112
+	tagExifIFD     = 0x8769
+
+	tagExposureTime     = 0x829A
+	tagFNumber          = 0x829D
+	tagExposureProgram  = 0x8822
+	tagISO              = 0x8827
+	tagDateTimeOriginal = 0x9003
+	tagShutterSpeed     = 0x9201
+	tagAperture         = 0x9202
+	tagExposureBias     = 0x9204
+	tagMeteringMode     = 0x9207
+	tagFlash            = 0x9209
+	tagFocalLength      = 0x920A
+	tagFocalLength35mm  = 0xA405
+	tagLensSpec         = 0xA432
+	tagLensMake         = 0xA433
+	tagLensModel        = 0xA434
+)
+
+// Camera tags we're happy to keep. Anything else, notably the GPS IFD,
+// MakerNote and body/lens serial numbers, is always dropped
+var (
+	cameraIFD0Tags = map[uint16]bool{
+		tagMake:  true,
+		tagModel: true,
+	}
+
+	cameraExifTags = map[uint16]bool{
+		tagExposureTime:     true,
+		tagFNumber:          true,
+		tagExposureProgram:  true,
+		tagISO:              true,
+		tagDateTimeOriginal: true,
+		tagShutterSpeed:     true,
+		tagAperture:         true,
+		tagExposureBias:     true,
+		tagMeteringMode:     true,
+		tagFlash:            true,
+		tagFocalLength:      true,
+		tagFocalLength35mm:  true,
+		tagLensSpec:         true,
+		tagLensMake:         true,
+		tagLensModel:        true,
+	}
+)
+
+type exifEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	// Always little-endian, whatever the byte order of the source
+	value []byte
+}
+
+// Size in bytes of one value of each TIFF field type
+var exifTypeSizes = map[uint16]int{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+// The metadata we pulled out of an image
+type imageMetadata struct {
+	orientation int
+	ifd0        []exifEntry
+	exif        []exifEntry
+}
+
+// Remove location and device metadata from an image, returning the cleaned
+// contents and a short human readable summary of the camera settings when
+// keepCamera is set
+func stripMetadata(data []byte, keepCamera bool) ([]byte, string, error) {
+	switch {
+	case bytes.HasPrefix(data, jpegSOI):
+		return stripJPEG(data, keepCamera)
+	case bytes.HasPrefix(data, pngSignature):
+		return stripPNG(data, keepCamera)
+	default:
+		return data, "", nil
+	}
+}
+
+func parseExif(tiff []byte) (imageMetadata, error) {
+	meta := imageMetadata{orientation: 1}
+	if len(tiff) < 8 {
+		return meta, fmt.Errorf("exif too short")
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return meta, fmt.Errorf("invalid exif byte order")
+	}
+
+	if order.Uint16(tiff[2:]) != 42 {
+		return meta, fmt.Errorf("invalid exif header")
+	}
+
+	ifd0, err := readIFD(tiff, order, order.Uint32(tiff[4:]))
+	if err != nil {
+		return meta, err
+	}
+
+	for _, entry := range ifd0 {
+		switch {
+		case entry.tag == tagOrientation && entry.typ == 3 && entry.count == 1:
+			meta.orientation = int(binary.LittleEndian.Uint16(entry.value))
+		case entry.tag == tagExifIFD && entry.typ == 4 && entry.count == 1:
+			exif, err := readIFD(tiff, order, binary.LittleEndian.Uint32(entry.value))
+			if err != nil {
+				return meta, err
+			}
+			for _, e := range exif {
+				if cameraExifTags[e.tag] {
+					meta.exif = append(meta.exif, e)
+				}
+			}
+		case cameraIFD0Tags[entry.tag]:
+			meta.ifd0 = append(meta.ifd0, entry)
+		}
+	}
+
+	return meta, nil
+}
+
+func readIFD(tiff []byte, order binary.ByteOrder, offset uint32) ([]exifEntry, error) {
+	if uint64(offset)+2 > uint64(len(tiff)) {
+		return nil, fmt.Errorf("ifd offset out of range")
+	}
+
+	n := int(order.Uint16(tiff[offset:]))
+	start := int(offset) + 2
+	if start+12*n > len(tiff) {
+		return nil, fmt.Errorf("ifd entries out of range")
+	}
+
+	var entries []exifEntry
+	for i := 0; i < n; i++ {
+		raw := tiff[start+12*i : start+12*i+12]
+		entry := exifEntry{
+			tag:   order.Uint16(raw[0:]),
+			typ:   order.Uint16(raw[2:]),
+			count: order.Uint32(raw[4:]),
+		}
+
+		size, ok := exifTypeSizes[entry.typ]
+		if !ok {
+			continue
+		}
+
+		length := uint64(size) * uint64(entry.count)
+		var value []byte
+		if length <= 4 {
+			value = raw[8 : 8+length]
+		} else {
+			valueOffset := uint64(order.Uint32(raw[8:]))
+			if valueOffset+length > uint64(len(tiff)) {
+				continue
+			}
+			value = tiff[valueOffset : valueOffset+length]
+		}
+
+		entry.value = toLittleEndian(value, entry.typ, order)
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func toLittleEndian(value []byte, typ uint16, order binary.ByteOrder) []byte {
+	out := bytes.Clone(value)
+	if order == binary.LittleEndian {
+		return out
+	}
+
+	// Rationals are pairs of 32 bit integers so swap them as such
+	unit := exifTypeSizes[typ]
+	if typ == 5 || typ == 10 {
+		unit = 4
+	}
+
+	for i := 0; i+unit <= len(out); i += unit {
+		for a, b := i, i+unit-1; a < b; a, b = a+1, b-1 {
+			out[a], out[b] = out[b], out[a]
+		}
+	}
+	return out
+}
+
+// Build a minimal little-endian TIFF holding just the camera tags. Returns
+// nil if there is nothing to keep
+func (meta imageMetadata) cameraExif() []byte {
+	if len(meta.ifd0) == 0 && len(meta.exif) == 0 {
+		return nil
+	}
+
+	ifd0 := append([]exifEntry(nil), meta.ifd0...)
+	exif := append([]exifEntry(nil), meta.exif...)
+
+	if len(exif) > 0 {
+		ifd0 = append(ifd0, exifEntry{tag: tagExifIFD, typ: 4, count: 1, value: make([]byte, 4)})
+	}
+
+	sort.Slice(ifd0, func(i, j int) bool { return ifd0[i].tag < ifd0[j].tag })
+	sort.Slice(exif, func(i, j int) bool { return exif[i].tag < exif[j].tag })
+
+	le := binary.LittleEndian
+	out := []byte{'I', 'I', 42, 0, 8, 0, 0, 0}
+
+	exifOffset := len(out) + ifdSize(ifd0)
+	for i := range ifd0 {
+		if ifd0[i].tag == tagExifIFD {
+			le.PutUint32(ifd0[i].value, uint32(exifOffset))
+		}
+	}
+
+	out = appendIFD(out, ifd0)
+	if len(exif) > 0 {
+		out = appendIFD(out, exif)
+	}
+	return out
+}
+
+// Total bytes an IFD and its out-of-line values take up
+func ifdSize(entries []exifEntry) int {
+	size := 2 + 12*len(entries) + 4
+	for _, entry := range entries {
+		if len(entry.value) > 4 {
+			size += len(entry.value) + len(entry.value)%2
+		}
+	}
+	return size
+}
+
+func appendIFD(out []byte, entries []exifEntry) []byte {
+	le := binary.LittleEndian
+
+	ifd := make([]byte, 2+12*len(entries)+4)
+	dataOffset := len(out) + len(ifd)
+	var data []byte
+
+	le.PutUint16(ifd, uint16(len(entries)))
+	for i, entry := range entries {
+		p := 2 + 12*i
+		le.PutUint16(ifd[p:], entry.tag)
+		le.PutUint16(ifd[p+2:], entry.typ)
+		le.PutUint32(ifd[p+4:], entry.count)
+		if len(entry.value) <= 4 {
+			copy(ifd[p+8:p+12], entry.value)
+			continue
+		}
+
+		le.PutUint32(ifd[p+8:], uint32(dataOffset+len(data)))
+		data = append(data, entry.value...)
+		if len(data)%2 == 1 {
+			data = append(data, 0)
+		}
+	}
+
+	out = append(out, ifd...)
+	return append(out, data...)
+}
+
+// Summarise the kept camera tags, e.g.
+// "Canon EOS R5 · RF24-70mm F2.8 L IS USM · 50mm · f/2.8 · 1/250s · ISO 400"
+func (meta imageMetadata) cameraSummary() string {
+	values := make(map[uint16]exifEntry)
+	for _, entry := range append(meta.ifd0, meta.exif...) {
+		values[entry.tag] = entry
+	}
+
+	ascii := func(tag uint16) string {
+		entry, ok := values[tag]
+		if !ok || entry.typ != 2 {
+			return ""
+		}
+		return strings.TrimSpace(strings.TrimRight(string(entry.value), "\x00"))
+	}
+
+	rational := func(tag uint16) (uint32, uint32, bool) {
+		entry, ok := values[tag]
+		if !ok || entry.typ != 5 || len(entry.value) < 8 {
+			return 0, 0, false
+		}
+		num := binary.LittleEndian.Uint32(entry.value)
+		den := binary.LittleEndian.Uint32(entry.value[4:])
+		return num, den, den != 0
+	}
+
+	var parts []string
+
+	cameraMake, model := ascii(tagMake), ascii(tagModel)
+	switch {
+	case model != "" && strings.HasPrefix(strings.ToLower(model), strings.ToLower(cameraMake)):
+		parts = append(parts, model)
+	case cameraMake != "" || model != "":
+		parts = append(parts, strings.TrimSpace(cameraMake+" "+model))
+	}
+
+	if lens := ascii(tagLensModel); lens != "" {
+		parts = append(parts, lens)
+	}
+
+	if num, den, ok := rational(tagFocalLength); ok {
+		parts = append(parts, fmt.Sprintf("%gmm", float64(num)/float64(den)))
+	}
+
+	if num, den, ok := rational(tagFNumber); ok {
+		parts = append(parts, fmt.Sprintf("f/%.1f", float64(num)/float64(den)))
+	}
+
+	if num, den, ok := rational(tagExposureTime); ok && num != 0 {
+		if num < den {
+			parts = append(parts, fmt.Sprintf("1/%.0fs", float64(den)/float64(num)))
+		} else {
+			parts = append(parts, fmt.Sprintf("%gs", float64(num)/float64(den)))
+		}
+	}
+
+	if entry, ok := values[tagISO]; ok && entry.typ == 3 && len(entry.value) >= 2 {
+		parts = append(parts, fmt.Sprintf("ISO %d", binary.LittleEndian.Uint16(entry.value)))
+	}
+
+	return strings.Join(parts, " · ")
+}
+
+// Rotate and flip pixels so the image displays correctly with an
+// orientation of 1
+func applyOrientation(src image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	rgba := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+
+			si := rgba.PixOffset(sx, sy)
+			di := dst.PixOffset(x, y)
+			copy(dst.Pix[di:di+4], rgba.Pix[si:si+4])
+		}
+	}
+
+	return dst
+}
+
+var (
+	jpegSOI      = []byte{0xFF, 0xD8}
+	exifHeader   = []byte("Exif\x00\x00")
+	iccHeader    = []byte("ICC_PROFILE\x00")
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+)
+
+type jpegSegment struct {
+	marker byte
+	// The whole segment including the marker and length
+	raw []byte
+	// Where raw starts in the file
+	offset int
+}
+
+// Split a JPEG into its header segments and everything from the start of
+// scan onwards
+func splitJPEG(data []byte) ([]jpegSegment, []byte, error) {
+	var segments []jpegSegment
+	pos := 2
+	for {
+		if pos+4 > len(data) || data[pos] != 0xFF {
+			return nil, nil, ErrInvalidImage
+		}
+
+		marker := data[pos+1]
+		switch {
+		case marker == 0xFF:
+			pos++
+			continue
+		case marker == 0xDA || marker == 0xD9:
+			return segments, data[pos:], nil
+		case marker >= 0xD0 && marker <= 0xD8, marker == 0x01:
+			pos += 2
+			continue
+		}
+
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return nil, nil, ErrInvalidImage
+		}
+
+		segments = append(segments, jpegSegment{
+			marker: marker,
+			raw:    data[pos : pos+2+length],
+			offset: pos,
+		})
+		pos += 2 + length
+	}
+}
+
+func stripJPEG(data []byte, keepCamera bool) ([]byte, string, error) {
+	segments, scan, err := splitJPEG(data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	meta := imageMetadata{orientation: 1}
+	var kept []jpegSegment
+	var iccProfile []jpegSegment
+	for _, segment := range segments {
+		payload := segment.raw[4:]
+		switch {
+		case segment.marker == 0xE1 && bytes.HasPrefix(payload, exifHeader):
+			// Unreadable EXIF is dropped like everything else
+			parsed, err := parseExif(payload[len(exifHeader):])
+			if err == nil {
+				meta = parsed
+			}
+		case segment.marker == 0xE2 && bytes.HasPrefix(payload, iccHeader):
+			iccProfile = append(iccProfile, segment)
+			kept = append(kept, segment)
+		case segment.marker == 0xE0, segment.marker == 0xEE:
+			// JFIF and Adobe colour transform headers
+			kept = append(kept, segment)
+		case segment.marker >= 0xE0 && segment.marker <= 0xEF, segment.marker == 0xFE:
+			// XMP, IPTC, comments and vendor blocks
+		default:
+			kept = append(kept, segment)
+		}
+	}
+
+	var exifSegment []byte
+	summary := ""
+	if keepCamera {
+		if tiff := meta.cameraExif(); tiff != nil && len(tiff)+len(exifHeader)+2 <= 0xFFFF {
+			exifSegment = []byte{0xFF, 0xE1, 0, 0}
+			binary.BigEndian.PutUint16(exifSegment[2:], uint16(2+len(exifHeader)+len(tiff)))
+			exifSegment = append(exifSegment, exifHeader...)
+			exifSegment = append(exifSegment, tiff...)
+		}
+		summary = meta.cameraSummary()
+	}
+
+	if meta.orientation >= 2 && meta.orientation <= 8 {
+		src, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, "", ErrInvalidImage
+		}
+
+		var buf bytes.Buffer
+		err = jpeg.Encode(&buf, applyOrientation(src, meta.orientation), &jpeg.Options{Quality: 92})
+		if err != nil {
+			return nil, "", fmt.Errorf("encoding rotated image: %w", err)
+		}
+
+		// The re-encoded image brings its own tables so only the colour
+		// profile carries over from the original headers
+		segments, scan, err = splitJPEG(buf.Bytes())
+		if err != nil {
+			return nil, "", err
+		}
+		kept = append(append([]jpegSegment(nil), iccProfile...), segments...)
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(jpegSOI)
+	for _, segment := range kept {
+		if segment.marker == 0xE0 {
+			out.Write(segment.raw)
+		}
+	}
+	out.Write(exifSegment)
+	for _, segment := range kept {
+		if segment.marker != 0xE0 {
+			out.Write(segment.raw)
+		}
+	}
+	out.Write(scan)
+
+	return out.Bytes(), summary, nil
+}
+
+type pngChunk struct {
+	typ string
+	// The whole chunk including length, type and CRC
+	raw []byte
+}
+
+func splitPNG(data []byte) ([]pngChunk, error) {
+	var chunks []pngChunk
+	pos := len(pngSignature)
+	for pos < len(data) {
+		if pos+12 > len(data) {
+			return nil, ErrInvalidImage
+		}
+
+		length := uint64(binary.BigEndian.Uint32(data[pos:]))
+		end := uint64(pos) + 12 + length
+		if end > uint64(len(data)) {
+			return nil, ErrInvalidImage
+		}
+
+		chunk := pngChunk{
+			typ: string(data[pos+4 : pos+8]),
+			raw: data[pos:end],
+		}
+		chunks = append(chunks, chunk)
+		pos = int(end)
+
+		if chunk.typ == "IEND" {
+			break
+		}
+	}
+	return chunks, nil
+}
+
+func newPNGChunk(typ string, data []byte) pngChunk {
+	raw := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(raw, uint32(len(data)))
+	copy(raw[4:], typ)
+	raw = append(raw, data...)
+	raw = binary.BigEndian.AppendUint32(raw, crc32.ChecksumIEEE(raw[4:]))
+	return pngChunk{typ: typ, raw: raw}
+}
+
+func stripPNG(data []byte, keepCamera bool) ([]byte, string, error) {
+	chunks, err := splitPNG(data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	meta := imageMetadata{orientation: 1}
+	var kept []pngChunk
+	var colour []pngChunk
+	for _, chunk := range chunks {
+		switch chunk.typ {
+		case "eXIf":
+			parsed, err := parseExif(chunk.raw[8 : len(chunk.raw)-4])
+			if err == nil {
+				meta = parsed
+			}
+		case "tEXt", "zTXt", "iTXt":
+			// Free text, including XMP packets
+		case "iCCP", "sRGB", "gAMA", "cHRM":
+			colour = append(colour, chunk)
+			kept = append(kept, chunk)
+		default:
+			kept = append(kept, chunk)
+		}
+	}
+
+	if meta.orientation >= 2 && meta.orientation <= 8 {
+		src, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, "", ErrInvalidImage
+		}
+
+		var buf bytes.Buffer
+		err = png.Encode(&buf, applyOrientation(src, meta.orientation))
+		if err != nil {
+			return nil, "", fmt.Errorf("encoding rotated image: %w", err)
+		}
+
+		encoded, err := splitPNG(buf.Bytes())
+		if err != nil {
+			return nil, "", err
+		}
+
+		// IHDR first, then the colour chunks from the original
+		kept = append([]pngChunk{encoded[0]}, append(colour, encoded[1:]...)...)
+	}
+
+	var extra []pngChunk
+	summary := ""
+	if keepCamera {
+		if tiff := meta.cameraExif(); tiff != nil {
+			extra = append(extra, newPNGChunk("eXIf", tiff))
+		}
+		summary = meta.cameraSummary()
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(pngSignature)
+	for i, chunk := range kept {
+		out.Write(chunk.raw)
+		// eXIf has to come before the image data so put it straight
+		// after IHDR
+		if i == 0 {
+			for _, chunk := range extra {
+				out.Write(chunk.raw)
+			}
+		}
+	}
+
+	return out.Bytes(), summary, nil
+}
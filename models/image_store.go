@@ -0,0 +1,228 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ImageStore is where gallery image files live. Keys are slash separated
+// paths such as "gallery-1/cat.jpg" regardless of the backend
+type ImageStore interface {
+	// Put writes the contents to key, replacing anything already there
+	Put(key string, contents io.Reader) error
+	// Get opens the object at key - callers must close the reader.
+	// Returns ErrNotFound if the key does not exist
+	Get(key string) (io.ReadCloser, error)
+	// Delete removes the object at key. Deleting a missing key is not an error
+	Delete(key string) error
+	// List returns every object whose key starts with prefix
+	List(prefix string) ([]ObjectInfo, error)
+	// Stat returns ErrNotFound if the key does not exist
+	Stat(key string) (ObjectInfo, error)
+}
+
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+const (
+	ImageStoreLocal = "local"
+	ImageStoreS3    = "s3"
+)
+
+type ImageStoreConfig struct {
+	Backend string
+	// Only used by the local backend
+	Dir string
+	// Only used by the s3 backend
+	S3 S3Config
+}
+
+func NewImageStore(config ImageStoreConfig) (ImageStore, error) {
+	switch config.Backend {
+	case "", ImageStoreLocal:
+		return &LocalImageStore{Dir: config.Dir}, nil
+	case ImageStoreS3:
+		return NewS3ImageStore(config.S3)
+	default:
+		return nil, fmt.Errorf("unknown image store %q", config.Backend)
+	}
+}
+
+// Stores images on the local disk under Dir
+type LocalImageStore struct {
+	Dir string
+}
+
+func (store *LocalImageStore) dir() string {
+	if store.Dir == "" {
+		return "images"
+	}
+	return store.Dir
+}
+
+// Map a key onto the filesystem, refusing anything that would escape Dir
+func (store *LocalImageStore) path(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if clean == "/" || clean != "/"+key {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return filepath.Join(store.dir(), filepath.FromSlash(key)), nil
+}
+
+// Contents are written to a temporary file next to the destination and
+// renamed into place so readers never see a partial image
+func (store *LocalImageStore) Put(key string, contents io.Reader) error {
+	dst, err := store.path(key)
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, contents)
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("put: %w", err)
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+
+	err = os.Rename(tmp.Name(), dst)
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+
+	return nil
+}
+
+func (store *LocalImageStore) Get(key string) (io.ReadCloser, error) {
+	p, err := store.path(key)
+	if err != nil {
+		return nil, fmt.Errorf("get: %w", err)
+	}
+
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("get: %w", err)
+	}
+
+	return f, nil
+}
+
+// Empty parent directories are removed along with the file so deleting
+// every image in a gallery doesn't leave an empty gallery-<id> behind
+func (store *LocalImageStore) Delete(key string) error {
+	p, err := store.path(key)
+	if err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+
+	err = os.Remove(p)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("delete: %w", err)
+	}
+
+	root := filepath.Clean(store.dir())
+	for dir := filepath.Dir(p); dir != root && dir != "."; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (store *LocalImageStore) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	root := store.dir()
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Skip in-progress uploads
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		objects = append(objects, ObjectInfo{
+			Key:     key,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+		return nil
+	})
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("list: %w", err)
+	}
+
+	return objects, nil
+}
+
+func (store *LocalImageStore) Stat(key string) (ObjectInfo, error) {
+	p, err := store.path(key)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("stat: %w", err)
+	}
+
+	info, err := os.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ObjectInfo{}, ErrNotFound
+	} else if err != nil {
+		return ObjectInfo{}, fmt.Errorf("stat: %w", err)
+	}
+
+	return ObjectInfo{
+		Key:     key,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}, nil
+}
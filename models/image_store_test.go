@@ -0,0 +1,205 @@
+package models
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalImageStoreRoundTrip(t *testing.T) {
+	store := &LocalImageStore{Dir: t.TempDir()}
+
+	err := store.Put("gallery-1/cat.jpg", strings.NewReader("meow"))
+	if err != nil {
+		t.Fatalf("Put() err = %v", err)
+	}
+
+	r, err := store.Get("gallery-1/cat.jpg")
+	if err != nil {
+		t.Fatalf("Get() err = %v", err)
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatalf("reading image: %v", err)
+	}
+	if string(got) != "meow" {
+		t.Errorf("Get() = %q, want %q", got, "meow")
+	}
+
+	info, err := store.Stat("gallery-1/cat.jpg")
+	if err != nil {
+		t.Fatalf("Stat() err = %v", err)
+	}
+	if info.Key != "gallery-1/cat.jpg" || info.Size != 4 {
+		t.Errorf("Stat() = %+v, want key gallery-1/cat.jpg and size 4", info)
+	}
+
+	// Put replaces what was there
+	err = store.Put("gallery-1/cat.jpg", strings.NewReader("purr"))
+	if err != nil {
+		t.Fatalf("Put() err = %v", err)
+	}
+	r, err = store.Get("gallery-1/cat.jpg")
+	if err != nil {
+		t.Fatalf("Get() err = %v", err)
+	}
+	got, _ = io.ReadAll(r)
+	r.Close()
+	if string(got) != "purr" {
+		t.Errorf("Get() after replace = %q, want %q", got, "purr")
+	}
+}
+
+func TestLocalImageStoreList(t *testing.T) {
+	dir := t.TempDir()
+	store := &LocalImageStore{Dir: dir}
+
+	for _, key := range []string{"gallery-1/a.jpg", "gallery-1/b.png", "gallery-12/c.gif"} {
+		err := store.Put(key, strings.NewReader(key))
+		if err != nil {
+			t.Fatalf("Put(%q) err = %v", key, err)
+		}
+	}
+
+	// Half written uploads are skipped
+	err := os.WriteFile(filepath.Join(dir, "gallery-1", ".upload-123"), []byte("partial"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		prefix string
+		want   []string
+	}{
+		"one gallery": {
+			prefix: "gallery-1/",
+			want:   []string{"gallery-1/a.jpg", "gallery-1/b.png"},
+		},
+		"every gallery": {
+			prefix: "gallery-",
+			want:   []string{"gallery-1/a.jpg", "gallery-1/b.png", "gallery-12/c.gif"},
+		},
+		"no match": {
+			prefix: "gallery-2/",
+			want:   nil,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			objects, err := store.List(tc.prefix)
+			if err != nil {
+				t.Fatalf("List() err = %v", err)
+			}
+
+			var got []string
+			for _, object := range objects {
+				got = append(got, object.Key)
+			}
+			if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("List(%q) = %v, want %v", tc.prefix, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLocalImageStoreListMissingDir(t *testing.T) {
+	store := &LocalImageStore{Dir: filepath.Join(t.TempDir(), "missing")}
+
+	objects, err := store.List("")
+	if err != nil {
+		t.Fatalf("List() err = %v", err)
+	}
+	if len(objects) != 0 {
+		t.Errorf("List() = %v, want nothing", objects)
+	}
+}
+
+func TestLocalImageStoreDelete(t *testing.T) {
+	dir := t.TempDir()
+	store := &LocalImageStore{Dir: dir}
+
+	err := store.Put("gallery-1/cat.jpg", strings.NewReader("meow"))
+	if err != nil {
+		t.Fatalf("Put() err = %v", err)
+	}
+
+	err = store.Delete("gallery-1/cat.jpg")
+	if err != nil {
+		t.Fatalf("Delete() err = %v", err)
+	}
+
+	_, err = store.Get("gallery-1/cat.jpg")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() after delete err = %v, want ErrNotFound", err)
+	}
+	_, err = store.Stat("gallery-1/cat.jpg")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Stat() after delete err = %v, want ErrNotFound", err)
+	}
+
+	// The emptied gallery directory goes too, but not the store itself
+	_, err = os.Stat(filepath.Join(dir, "gallery-1"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("gallery directory still exists, stat err = %v", err)
+	}
+	_, err = os.Stat(dir)
+	if err != nil {
+		t.Errorf("store directory was removed: %v", err)
+	}
+
+	err = store.Delete("gallery-1/cat.jpg")
+	if err != nil {
+		t.Errorf("Delete() of a missing key err = %v, want nil", err)
+	}
+}
+
+func TestLocalImageStoreInvalidKeys(t *testing.T) {
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "images")
+	store := &LocalImageStore{Dir: dir}
+
+	keys := []string{
+		"",
+		"/",
+		"../outside.jpg",
+		"gallery-1/../../outside.jpg",
+		"/gallery-1/cat.jpg",
+		"gallery-1//cat.jpg",
+		"gallery-1/./cat.jpg",
+		"gallery-1/",
+	}
+
+	for _, key := range keys {
+		t.Run(key, func(t *testing.T) {
+			err := store.Put(key, strings.NewReader("escaped"))
+			if err == nil {
+				t.Errorf("Put(%q) err = nil, want an error", key)
+			}
+
+			_, err = store.Get(key)
+			if err == nil || errors.Is(err, ErrNotFound) {
+				t.Errorf("Get(%q) err = %v, want an invalid key error", key, err)
+			}
+
+			_, err = store.Stat(key)
+			if err == nil || errors.Is(err, ErrNotFound) {
+				t.Errorf("Stat(%q) err = %v, want an invalid key error", key, err)
+			}
+
+			err = store.Delete(key)
+			if err == nil {
+				t.Errorf("Delete(%q) err = nil, want an error", key)
+			}
+		})
+	}
+
+	_, err := os.Stat(filepath.Join(parent, "outside.jpg"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("a file was written outside the store directory")
+	}
+}
@@ -0,0 +1,56 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io"
+	"testing"
+)
+
+func TestCreateImageDoesNotReplace(t *testing.T) {
+	db := testDB(t)
+	service := &GalleryService{DB: db, Store: &LocalImageStore{Dir: t.TempDir()}}
+
+	owner := testUser(t, db, "owner@example.com")
+	gallery, err := service.Create("Holiday", owner.ID)
+	if err != nil {
+		t.Fatalf("Create() err = %v", err)
+	}
+
+	first := testPNG(t, 16, 16)
+	err = service.CreateImage(gallery.ID, "cat.png", bytes.NewReader(first))
+	if err != nil {
+		t.Fatalf("CreateImage() err = %v", err)
+	}
+
+	err = service.CreateImage(gallery.ID, "cat.png", bytes.NewReader(testPNG(t, 8, 8)))
+	if !errors.Is(err, ErrImageExists) {
+		t.Fatalf("CreateImage() with a taken name err = %v, want ErrImageExists", err)
+	}
+
+	img, err := service.Image(gallery.ID, "cat.png")
+	if err != nil {
+		t.Fatalf("Image() err = %v", err)
+	}
+	if img.Width != 16 {
+		t.Errorf("image width = %d, want the first upload's 16", img.Width)
+	}
+
+	r, err := service.OpenImage(img)
+	if err != nil {
+		t.Fatalf("OpenImage() err = %v", err)
+	}
+	defer r.Close()
+	stored, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(stored))
+	if err != nil {
+		t.Fatalf("decoding stored image: %v", err)
+	}
+	if config.Width != 16 {
+		t.Errorf("stored image width = %d, want the first upload's 16", config.Width)
+	}
+}
@@ -0,0 +1,377 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/gif"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	DefaultMaxImageWidth  = 10000
+	DefaultMaxImageHeight = 10000
+	// 50 megapixels, summed over every frame of an animated GIF
+	DefaultMaxImagePixels = 50_000_000
+)
+
+// Limits on decoded image size, protecting the server from decompression
+// bombs - small files that expand to gigabytes of pixels
+type ImageLimits struct {
+	MaxWidth  int
+	MaxHeight int
+	MaxPixels int64
+}
+
+func (limits ImageLimits) withDefaults() ImageLimits {
+	if limits.MaxWidth <= 0 {
+		limits.MaxWidth = DefaultMaxImageWidth
+	}
+	if limits.MaxHeight <= 0 {
+		limits.MaxHeight = DefaultMaxImageHeight
+	}
+	if limits.MaxPixels <= 0 {
+		limits.MaxPixels = DefaultMaxImagePixels
+	}
+	return limits
+}
+
+// Content types we accept, keyed by the format name the image package
+// reports
+var imageContentTypes = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+}
+
+var imageExtensionFormats = map[string]string{
+	".jpg":  "jpeg",
+	".jpeg": "jpeg",
+	".png":  "png",
+	".gif":  "gif",
+}
+
+// Markers that have no business in an image and suggest the file is also
+// meant to be interpreted as a web page
+var polyglotMarkers = [][]byte{
+	[]byte("<html"),
+	[]byte("<head"),
+	[]byte("<body"),
+	[]byte("<script"),
+	[]byte("<svg"),
+	[]byte("<iframe"),
+	[]byte("<!doctype"),
+	[]byte("<?xml"),
+	[]byte("javascript:"),
+}
+
+// Identify an image by its magic bytes rather than trusting its name
+func sniffImageFormat(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF}):
+		return "jpeg"
+	case bytes.HasPrefix(data, pngSignature):
+		return "png"
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return "gif"
+	default:
+		return ""
+	}
+}
+
+// Check an upload really is the image its name claims to be, that it
+// decodes fully within the configured limits and that nothing is appended
+// after it. Returns the content type to serve it with
+func (service *GalleryService) validateImage(filename string, data []byte) (string, error) {
+	format := sniffImageFormat(data)
+	if format == "" {
+		return "", ErrInvalidImage
+	}
+
+	if imageExtensionFormats[strings.ToLower(filepath.Ext(filename))] != format {
+		return "", ErrContentMismatch
+	}
+
+	limits := service.Limits.withDefaults()
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", ErrInvalidImage
+	}
+
+	if config.Width <= 0 || config.Height <= 0 ||
+		config.Width > limits.MaxWidth || config.Height > limits.MaxHeight {
+		return "", ErrImageTooLarge
+	}
+
+	pixels := int64(config.Width) * int64(config.Height)
+	end := len(data)
+	switch format {
+	case "gif":
+		var frames int64
+		frames, end, err = scanGIF(data, nil)
+		if err != nil {
+			return "", err
+		}
+		pixels *= frames
+	case "png":
+		end, err = pngEnd(data)
+		if err != nil {
+			return "", err
+		}
+	case "jpeg":
+		end, err = jpegEnd(data)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if pixels > limits.MaxPixels {
+		return "", ErrImageTooLarge
+	}
+
+	// Anything appended after the end of the image, such as a zip archive,
+	// makes the file something other than just an image
+	if len(bytes.Trim(data[end:], "\x00")) > 0 {
+		return "", ErrPolyglotImage
+	}
+
+	// Only now is it safe to decode every pixel
+	if format == "gif" {
+		_, err = gif.DecodeAll(bytes.NewReader(data))
+	} else {
+		_, _, err = image.Decode(bytes.NewReader(data))
+	}
+	if err != nil {
+		return "", ErrInvalidImage
+	}
+
+	return imageContentTypes[format], nil
+}
+
+// Reject images containing markup a browser might be talked into rendering.
+// This runs on the stripped image so markup in XMP, which we remove anyway,
+// doesn't count against an otherwise fine photo. Pixel data is compressed
+// and so effectively random, and a large photo would now and then contain
+// a marker by chance, so only the other blocks and anything after the end
+// of the image are searched
+func checkPolyglot(data []byte) error {
+	blocks, err := nonPixelBlocks(data)
+	if err != nil {
+		return err
+	}
+
+	// Markers can't run over from pixel data into a block, as each block
+	// starts with its own marker or length bytes
+	for _, block := range blocks {
+		lower := make([]byte, 0, block.end-block.start)
+		for _, b := range data[block.start:block.end] {
+			if b >= 'A' && b <= 'Z' {
+				b += 'a' - 'A'
+			}
+			lower = append(lower, b)
+		}
+
+		for _, marker := range polyglotMarkers {
+			if bytes.Contains(lower, marker) {
+				return ErrPolyglotImage
+			}
+		}
+	}
+	return nil
+}
+
+// Where a block of an image file starts and ends
+type byteRange struct {
+	start, end int
+}
+
+// Everything in an image that isn't pixel data: JPEG segments such as
+// APPn and COM, PNG chunks other than IDAT, GIF extensions, and whatever
+// follows the end of the image
+func nonPixelBlocks(data []byte) ([]byteRange, error) {
+	var blocks []byteRange
+	add := func(start, end int) {
+		blocks = append(blocks, byteRange{start, end})
+	}
+
+	var end int
+	var err error
+	switch sniffImageFormat(data) {
+	case "jpeg":
+		end, err = walkJPEG(data, add)
+	case "png":
+		var chunks []pngChunk
+		chunks, err = splitPNG(data)
+		end = len(pngSignature)
+		for _, chunk := range chunks {
+			if chunk.typ != "IDAT" {
+				add(end, end+len(chunk.raw))
+			}
+			end += len(chunk.raw)
+		}
+	case "gif":
+		_, end, err = scanGIF(data, add)
+	default:
+		return nil, ErrInvalidImage
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	add(end, len(data))
+	return blocks, nil
+}
+
+// Offset just past the EOI marker, walking the entropy coded data of every
+// scan rather than trusting the last FF D9 in the file
+func jpegEnd(data []byte) (int, error) {
+	return walkJPEG(data, nil)
+}
+
+// Walk a JPEG's segments and scans, calling segment with the offsets of
+// each marker segment if it isn't nil. Returns the offset past EOI
+func walkJPEG(data []byte, segment func(start, end int)) (int, error) {
+	segments, scan, err := splitJPEG(data)
+	if err != nil {
+		return 0, err
+	}
+
+	if segment != nil {
+		for _, s := range segments {
+			segment(s.offset, s.offset+len(s.raw))
+		}
+	}
+
+	pos := len(data) - len(scan)
+	for pos+1 < len(data) {
+		if data[pos] != 0xFF {
+			pos++
+			continue
+		}
+
+		marker := data[pos+1]
+		switch {
+		case marker == 0xFF:
+			pos++
+		case marker == 0x00, marker >= 0xD0 && marker <= 0xD7:
+			// Stuffed byte or restart marker inside scan data
+			pos += 2
+		case marker == 0xD9:
+			return pos + 2, nil
+		default:
+			// Segments between progressive scans, including the next SOS
+			if pos+4 > len(data) {
+				return 0, ErrInvalidImage
+			}
+			end := pos + 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+			if end > len(data) {
+				return 0, ErrInvalidImage
+			}
+			if segment != nil {
+				segment(pos, end)
+			}
+			pos = end
+		}
+	}
+
+	return 0, ErrInvalidImage
+}
+
+// Offset just past the IEND chunk
+func pngEnd(data []byte) (int, error) {
+	chunks, err := splitPNG(data)
+	if err != nil {
+		return 0, err
+	}
+
+	end := len(pngSignature)
+	for _, chunk := range chunks {
+		end += len(chunk.raw)
+	}
+
+	if len(chunks) == 0 || chunks[len(chunks)-1].typ != "IEND" {
+		return 0, ErrInvalidImage
+	}
+	return end, nil
+}
+
+// Walk a GIF's block structure without decoding any pixels, returning the
+// number of frames and the offset just past the trailer. This lets us
+// refuse animations whose frames add up to too many pixels before
+// gif.DecodeAll allocates them. extension is called with the offsets of
+// each extension block if it isn't nil
+func scanGIF(data []byte, extension func(start, end int)) (int64, int, error) {
+	// Header and logical screen descriptor
+	pos := 13
+	if len(data) < pos {
+		return 0, 0, ErrInvalidImage
+	}
+
+	flags := data[10]
+	if flags&0x80 != 0 {
+		pos += 3 << ((flags & 0x07) + 1)
+	}
+
+	skipSubBlocks := func() bool {
+		for {
+			if pos >= len(data) {
+				return false
+			}
+			size := int(data[pos])
+			pos++
+			if size == 0 {
+				return true
+			}
+			pos += size
+		}
+	}
+
+	var frames int64
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21:
+			// Extension: label then data sub-blocks
+			start := pos
+			pos += 2
+			if !skipSubBlocks() {
+				return 0, 0, ErrInvalidImage
+			}
+			if extension != nil {
+				extension(start, pos)
+			}
+		case 0x2C:
+			// Image descriptor, optional local colour table, LZW minimum
+			// code size and the image data sub-blocks
+			if pos+10 > len(data) {
+				return 0, 0, ErrInvalidImage
+			}
+			width := binary.LittleEndian.Uint16(data[pos+5:])
+			height := binary.LittleEndian.Uint16(data[pos+7:])
+			if width == 0 || height == 0 {
+				return 0, 0, ErrInvalidImage
+			}
+
+			flags := data[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << ((flags & 0x07) + 1)
+			}
+			pos++
+			if !skipSubBlocks() {
+				return 0, 0, ErrInvalidImage
+			}
+			frames++
+		case 0x3B:
+			if frames == 0 {
+				return 0, 0, ErrInvalidImage
+			}
+			return frames, pos + 1, nil
+		default:
+			return 0, 0, ErrInvalidImage
+		}
+	}
+
+	return 0, 0, ErrInvalidImage
+}
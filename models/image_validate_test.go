@@ -0,0 +1,377 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"math/rand/v2"
+	"testing"
+)
+
+func testImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 16), uint8(y * 16), 128, 255})
+		}
+	}
+	return img
+}
+
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	err := png.Encode(&buf, testImage(width, height))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testJPEG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, testImage(width, height), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testGIF(t *testing.T, width, height, frames int) []byte {
+	t.Helper()
+	anim := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, width, height), palette.Plan9)
+		frame.SetColorIndex(0, 0, uint8(i))
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+
+	var buf bytes.Buffer
+	err := gif.EncodeAll(&buf, anim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func appendBytes(data []byte, extra string) []byte {
+	return append(append([]byte{}, data...), extra...)
+}
+
+func TestValidateImage(t *testing.T) {
+	pngData := testPNG(t, 16, 16)
+	jpegData := testJPEG(t, 16, 16)
+	gifData := testGIF(t, 16, 16, 3)
+	zip := "PK\x03\x04\x14\x00\x00\x00\x08\x00"
+
+	tests := map[string]struct {
+		filename string
+		data     []byte
+		limits   ImageLimits
+		want     string
+		wantErr  error
+	}{
+		"png": {
+			filename: "cat.png",
+			data:     pngData,
+			want:     "image/png",
+		},
+		"jpeg": {
+			filename: "cat.jpg",
+			data:     jpegData,
+			want:     "image/jpeg",
+		},
+		"jpeg extension": {
+			filename: "cat.JPEG",
+			data:     jpegData,
+			want:     "image/jpeg",
+		},
+		"animated gif": {
+			filename: "cat.gif",
+			data:     gifData,
+			want:     "image/gif",
+		},
+		"trailing zero padding": {
+			filename: "cat.png",
+			data:     appendBytes(pngData, "\x00\x00\x00\x00"),
+			want:     "image/png",
+		},
+		"not an image": {
+			filename: "cat.png",
+			data:     []byte("just some text"),
+			wantErr:  ErrInvalidImage,
+		},
+		"png named jpg": {
+			filename: "cat.jpg",
+			data:     pngData,
+			wantErr:  ErrContentMismatch,
+		},
+		"jpeg named gif": {
+			filename: "cat.gif",
+			data:     jpegData,
+			wantErr:  ErrContentMismatch,
+		},
+		"truncated png": {
+			filename: "cat.png",
+			data:     pngData[:len(pngData)-20],
+			wantErr:  ErrInvalidImage,
+		},
+		"truncated jpeg": {
+			filename: "cat.jpg",
+			data:     jpegData[:len(jpegData)/2],
+			wantErr:  ErrInvalidImage,
+		},
+		"too wide": {
+			filename: "cat.png",
+			data:     pngData,
+			limits:   ImageLimits{MaxWidth: 15},
+			wantErr:  ErrImageTooLarge,
+		},
+		"too tall": {
+			filename: "cat.jpg",
+			data:     jpegData,
+			limits:   ImageLimits{MaxHeight: 15},
+			wantErr:  ErrImageTooLarge,
+		},
+		"too many pixels": {
+			filename: "cat.png",
+			data:     pngData,
+			limits:   ImageLimits{MaxPixels: 255},
+			wantErr:  ErrImageTooLarge,
+		},
+		"frames add up to too many pixels": {
+			// Each 16x16 frame is within the limit, all three aren't
+			filename: "cat.gif",
+			data:     gifData,
+			limits:   ImageLimits{MaxPixels: 700},
+			wantErr:  ErrImageTooLarge,
+		},
+		"zip appended to png": {
+			filename: "cat.png",
+			data:     appendBytes(pngData, zip),
+			wantErr:  ErrPolyglotImage,
+		},
+		"zip appended to jpeg": {
+			filename: "cat.jpg",
+			data:     appendBytes(jpegData, zip),
+			wantErr:  ErrPolyglotImage,
+		},
+		"html appended to gif": {
+			filename: "cat.gif",
+			data:     appendBytes(gifData, "<html><script>alert(1)</script>"),
+			wantErr:  ErrPolyglotImage,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			service := &GalleryService{Limits: tc.limits}
+
+			got, err := service.validateImage(tc.filename, tc.data)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("validateImage() err = %v, want %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("validateImage() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func insertBytes(data []byte, pos int, extra []byte) []byte {
+	out := append([]byte{}, data[:pos]...)
+	out = append(out, extra...)
+	return append(out, data[pos:]...)
+}
+
+// A PNG whose pixels spell out text, stored uncompressed so the text
+// appears as it is in the file
+func testTextPNG(t *testing.T, text string) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, 32, 4))
+	for i := range img.Pix {
+		img.Pix[i] = text[i%len(text)]
+	}
+
+	var buf bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.NoCompression}
+	err := encoder.Encode(&buf, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Overwrite part of a JPEG's entropy coded data with text, somewhere that
+// leaves its structure intact
+func testJPEGScanText(t *testing.T, data []byte, text string) []byte {
+	t.Helper()
+	_, scan, err := splitJPEG(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sos := len(data) - len(scan)
+	start := sos + 2 + int(binary.BigEndian.Uint16(data[sos+2:]))
+
+	for pos := start + 1; pos+len(text) < len(data)-2; pos++ {
+		if data[pos-1] == 0xFF || bytes.IndexByte(data[pos:pos+len(text)+1], 0xFF) >= 0 {
+			continue
+		}
+		out := append([]byte{}, data...)
+		copy(out[pos:], text)
+		return out
+	}
+	t.Fatal("no room in the scan data")
+	return nil
+}
+
+func TestCheckPolyglot(t *testing.T) {
+	pngData := testPNG(t, 16, 16)
+	jpegData := testJPEG(t, 64, 64)
+	gifData := testGIF(t, 16, 16, 1)
+	script := "<script>alert(1)</script>"
+
+	comment := []byte{0xFF, 0xFE, 0, byte(2 + len(script))}
+	comment = append(comment, script...)
+	gifComment := append([]byte{0x21, 0xFE, byte(len(script))}, script...)
+	gifComment = append(gifComment, 0)
+
+	pixelText := testTextPNG(t, script)
+	if !bytes.Contains(pixelText, []byte("<script")) {
+		t.Fatal("test PNG doesn't contain its text")
+	}
+
+	tests := map[string]struct {
+		data    []byte
+		wantErr error
+	}{
+		"plain image": {
+			data: pngData,
+		},
+		"text that only looks a bit like markup": {
+			data: appendBytes(pngData, "a < b and html"),
+		},
+		"script tag": {
+			data:    appendBytes(pngData, "<script>alert(1)</script>"),
+			wantErr: ErrPolyglotImage,
+		},
+		"upper case tag": {
+			data:    appendBytes(pngData, "<SCRIPT SRC=//evil>"),
+			wantErr: ErrPolyglotImage,
+		},
+		"svg": {
+			data:    appendBytes(pngData, "<svg onload=alert(1)>"),
+			wantErr: ErrPolyglotImage,
+		},
+		"doctype": {
+			data:    appendBytes(pngData, "<!DOCTYPE html>"),
+			wantErr: ErrPolyglotImage,
+		},
+		"javascript url": {
+			data:    appendBytes(pngData, "JavaScript:alert(1)"),
+			wantErr: ErrPolyglotImage,
+		},
+		"jpeg comment": {
+			data:    insertBytes(jpegData, 2, comment),
+			wantErr: ErrPolyglotImage,
+		},
+		"png text chunk": {
+			data:    insertBytes(pngData, len(pngData)-12, newPNGChunk("tEXt", []byte("Comment\x00"+script)).raw),
+			wantErr: ErrPolyglotImage,
+		},
+		"gif comment": {
+			data:    insertBytes(gifData, len(gifData)-1, gifComment),
+			wantErr: ErrPolyglotImage,
+		},
+		// Pixel data can hold any bytes at all, and isn't something a
+		// browser would render as a page
+		"markup in png pixels": {
+			data: pixelText,
+		},
+		"markup in jpeg scan data": {
+			data: testJPEGScanText(t, jpegData, "<svg onload=alert(1)>"),
+		},
+		"not an image": {
+			data:    []byte("<html>"),
+			wantErr: ErrInvalidImage,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := checkPolyglot(tc.data)
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("checkPolyglot() err = %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// Pixel data is effectively random, so a large photo is bound to contain
+// short markers like "<svg" now and then. They must not count
+func TestCheckPolyglotNoise(t *testing.T) {
+	rnd := rand.New(rand.NewPCG(1, 2))
+	img := image.NewNRGBA(image.Rect(0, 0, 1024, 1024))
+	for i := range img.Pix {
+		img.Pix[i] = byte(rnd.Uint32())
+	}
+
+	// Left to chance they would only turn up in about one photo in a
+	// hundred, so some are put in where the uncompressed PNG will keep
+	// them. A few copies of each, within a row, as the file is still split
+	// into rows and deflate blocks
+	markers := []string{"<svg", "<html", "<script"}
+	for _, marker := range markers {
+		for i := 0; i < 3; i++ {
+			row := img.Pix[rnd.IntN(img.Rect.Dy())*img.Stride:]
+			copy(row[rnd.IntN(img.Stride-len(marker)):], marker)
+		}
+	}
+
+	var pngBuf, jpegBuf bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.NoCompression}
+	err := encoder.Encode(&pngBuf, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, marker := range markers {
+		if !bytes.Contains(pngBuf.Bytes(), []byte(marker)) {
+			t.Fatalf("test PNG doesn't contain %q", marker)
+		}
+	}
+
+	err = jpeg.Encode(&jpegBuf, img, &jpeg.Options{Quality: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		filename string
+		data     []byte
+	}{
+		"png":  {filename: "noise.png", data: pngBuf.Bytes()},
+		"jpeg": {filename: "noise.jpg", data: jpegBuf.Bytes()},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			service := &GalleryService{}
+			_, err := service.validateImage(tc.filename, tc.data)
+			if err != nil {
+				t.Fatalf("validateImage() err = %v", err)
+			}
+			err = checkPolyglot(tc.data)
+			if err != nil {
+				t.Errorf("checkPolyglot() err = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"golang.org/x/image/draw"
+)
+
+// Names of the resized variants that can be requested with ?size=
+const (
+	SizeThumb  = "thumb"
+	SizeMedium = "medium"
+)
+
+// The longest edge, in pixels, of each variant
+var imageSizes = map[string]int{
+	SizeThumb:  320,
+	SizeMedium: 1280,
+}
+
+// Variants are cached alongside the original, e.g. gallery-1/thumb/cat.jpg
+func variantKey(galleryID int, size, filename string) string {
+	return galleryPrefix(galleryID) + size + "/" + filename
+}
+
+// A ReadCloser over an in-memory image that can still be seeked, so
+// http.ServeContent can handle range requests for freshly generated variants
+type bytesReadCloser struct {
+	*bytes.Reader
+}
+
+func (bytesReadCloser) Close() error {
+	return nil
+}
+
+// Open a resized variant of an image, generating and caching it on first
+// request. An empty size opens the original. Images that are already
+// smaller than the requested size are served as-is
+func (service *GalleryService) OpenImageSize(img Image, size string) (io.ReadCloser, error) {
+	if size == "" {
+		return service.OpenImage(img)
+	}
+
+	maxDim, ok := imageSizes[size]
+	if !ok {
+		return nil, ErrInvalidSize
+	}
+
+	if img.Width <= maxDim && img.Height <= maxDim {
+		return service.OpenImage(img)
+	}
+
+	key := variantKey(img.GalleryID, size, img.Filename)
+	contents, err := service.Store.Get(key)
+	if err == nil {
+		return contents, nil
+	} else if !errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("open image variant: %w", err)
+	}
+
+	data, err := service.resize(img, maxDim)
+	if err != nil {
+		return nil, fmt.Errorf("open image variant: %w", err)
+	}
+
+	err = service.Store.Put(key, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("storing image variant: %w", err)
+	}
+
+	return bytesReadCloser{bytes.NewReader(data)}, nil
+}
+
+// Scale an image down so its longest edge is maxDim, encoded in the same
+// format as the original
+func (service *GalleryService) resize(img Image, maxDim int) ([]byte, error) {
+	original, err := service.OpenImage(img)
+	if err != nil {
+		return nil, err
+	}
+	defer original.Close()
+
+	src, format, err := image.Decode(original)
+	if err != nil {
+		return nil, fmt.Errorf("decoding %v: %w", img.Key, err)
+	}
+
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width >= height {
+		height = max(1, height*maxDim/width)
+		width = maxDim
+	} else {
+		width = max(1, width*maxDim/height)
+		height = maxDim
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+
+	var buf bytes.Buffer
+	switch format {
+	case "png":
+		err = png.Encode(&buf, dst)
+	case "gif":
+		err = gif.Encode(&buf, dst, nil)
+	default:
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("encoding %v: %w", img.Key, err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Remove every cached variant of an image. Called whenever the original
+// changes or is deleted - failures are logged since a stale variant is
+// cleaned up with the rest of the gallery eventually
+func (service *GalleryService) removeVariants(galleryID int, filename string) {
+	for size := range imageSizes {
+		err := service.Store.Delete(variantKey(galleryID, size, filename))
+		if err != nil {
+			fmt.Printf("removing %v variant of %v: %v\n", size, filename, err)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"taran1s.share/rand"
+)
+
+const (
+	DefaultChallengeDuration = 5 * time.Minute
+	// Wrong codes allowed before the user has to enter their password again
+	MaxChallengeAttempts = 5
+)
+
+var ErrTooManyAttempts error = fmt.Errorf("Too many attempts")
+
+// A sign in that has passed the password check and is waiting on a second
+// factor. The token is kept in a cookie in place of a session
+type LoginChallenge struct {
+	ID     int
+	UserID int
+	// Looked up with the challenge, so wrong answers count towards the
+	// same sign in throttle as wrong passwords
+	Email string
+	// Only set when created
+	Token     string
+	TokenHash string
+	// Carried over to the session once the challenge is passed
+	Remember  bool
+	Attempts  int
+	ExpiresAt time.Time
+}
+
+type LoginChallengeService struct {
+	DB            *sql.DB
+	BytesPerToken int
+	Duration      time.Duration
+}
+
+func (service *LoginChallengeService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+func (service *LoginChallengeService) Create(userID int, remember bool) (*LoginChallenge, error) {
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+
+	duration := service.Duration
+	if duration == 0 {
+		duration = DefaultChallengeDuration
+	}
+
+	challenge := LoginChallenge{
+		UserID:    userID,
+		Token:     token,
+		TokenHash: service.hash(token),
+		Remember:  remember,
+		ExpiresAt: time.Now().Add(duration),
+	}
+
+	row := service.DB.QueryRow(`
+		INSERT INTO login_challenges (user_id, token_hash, remember, expires_at)
+		VALUES ($1,$2,$3,$4)
+		RETURNING id;`, challenge.UserID, challenge.TokenHash,
+		challenge.Remember, challenge.ExpiresAt)
+
+	err = row.Scan(&challenge.ID)
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+
+	return &challenge, nil
+}
+
+// Look up a challenge, failing if it has expired or had too many wrong
+// answers
+func (service *LoginChallengeService) ByToken(token string) (*LoginChallenge, error) {
+	challenge := LoginChallenge{
+		TokenHash: service.hash(token),
+	}
+
+	row := service.DB.QueryRow(`
+		SELECT login_challenges.id, user_id, users.email, remember, attempts, expires_at
+		FROM login_challenges
+		JOIN users ON users.id = login_challenges.user_id
+		WHERE token_hash = $1;`, challenge.TokenHash)
+
+	err := row.Scan(&challenge.ID, &challenge.UserID, &challenge.Email,
+		&challenge.Remember, &challenge.Attempts, &challenge.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("bytoken: %w", err)
+	}
+
+	if time.Now().After(challenge.ExpiresAt) {
+		return nil, ErrTokenExpired
+	}
+
+	if challenge.Attempts >= MaxChallengeAttempts {
+		return nil, ErrTooManyAttempts
+	}
+
+	return &challenge, nil
+}
+
+// Use up one of the challenge's attempts before an answer is checked.
+// Taking it first, in a single statement, means requests sent together
+// can't all get past the limit
+func (service *LoginChallengeService) Attempt(challenge *LoginChallenge) error {
+	row := service.DB.QueryRow(`
+		UPDATE login_challenges
+		SET attempts = attempts + 1
+		WHERE id = $1 AND attempts < $2 AND expires_at > NOW()
+		RETURNING attempts;`, challenge.ID, MaxChallengeAttempts)
+
+	err := row.Scan(&challenge.Attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrTooManyAttempts
+	} else if err != nil {
+		return fmt.Errorf("attempt: %w", err)
+	}
+
+	return nil
+}
+
+func (service *LoginChallengeService) Delete(challenge *LoginChallenge) error {
+	_, err := service.DB.Exec(`
+		DELETE FROM login_challenges
+		WHERE id = $1;`, challenge.ID)
+	if err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+
+	return nil
+}
+
+func (service *LoginChallengeService) DeleteExpired() (int64, error) {
+	result, err := service.DB.Exec(`
+		DELETE FROM login_challenges
+		WHERE expires_at < NOW();`)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired: %w", err)
+	}
+
+	return result.RowsAffected()
+}
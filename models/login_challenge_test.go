@@ -0,0 +1,141 @@
+package models
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoginChallengeAttempts(t *testing.T) {
+	db := testDB(t)
+	service := &LoginChallengeService{DB: db}
+	user := testUser(t, db, "jo@example.com")
+
+	created, err := service.Create(user.ID, true)
+	if err != nil {
+		t.Fatalf("Create() err = %v", err)
+	}
+
+	challenge, err := service.ByToken(created.Token)
+	if err != nil {
+		t.Fatalf("ByToken() err = %v", err)
+	}
+	if challenge.UserID != user.ID || challenge.Email != user.Email || !challenge.Remember {
+		t.Errorf("ByToken() = %+v, want user %d, %s and remember", challenge, user.ID, user.Email)
+	}
+
+	for i := 1; i <= MaxChallengeAttempts; i++ {
+		err := service.Attempt(challenge)
+		if err != nil {
+			t.Fatalf("Attempt() %d err = %v", i, err)
+		}
+		if challenge.Attempts != i {
+			t.Errorf("Attempts after %d = %d", i, challenge.Attempts)
+		}
+	}
+
+	err = service.Attempt(challenge)
+	if !errors.Is(err, ErrTooManyAttempts) {
+		t.Errorf("Attempt() past the limit err = %v, want ErrTooManyAttempts", err)
+	}
+
+	_, err = service.ByToken(created.Token)
+	if !errors.Is(err, ErrTooManyAttempts) {
+		t.Errorf("ByToken() once used up err = %v, want ErrTooManyAttempts", err)
+	}
+}
+
+// Answers sent at the same time can't get more than the allowed attempts
+// between them
+func TestLoginChallengeConcurrentAttempts(t *testing.T) {
+	db := testDB(t)
+	service := &LoginChallengeService{DB: db}
+	user := testUser(t, db, "jo@example.com")
+
+	created, err := service.Create(user.ID, false)
+	if err != nil {
+		t.Fatalf("Create() err = %v", err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < 4*MaxChallengeAttempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			challenge, err := service.ByToken(created.Token)
+			if err != nil {
+				return
+			}
+			err = service.Attempt(challenge)
+			if err == nil {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			} else if !errors.Is(err, ErrTooManyAttempts) {
+				t.Errorf("Attempt() err = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != MaxChallengeAttempts {
+		t.Errorf("%d attempts were allowed, want %d", allowed, MaxChallengeAttempts)
+	}
+}
+
+func TestLoginChallengeExpiry(t *testing.T) {
+	db := testDB(t)
+	user := testUser(t, db, "jo@example.com")
+
+	expired := &LoginChallengeService{DB: db, Duration: -time.Minute}
+	old, err := expired.Create(user.ID, false)
+	if err != nil {
+		t.Fatalf("Create() err = %v", err)
+	}
+
+	service := &LoginChallengeService{DB: db}
+	current, err := service.Create(user.ID, false)
+	if err != nil {
+		t.Fatalf("Create() err = %v", err)
+	}
+
+	_, err = service.ByToken(old.Token)
+	if !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("ByToken() for an expired challenge err = %v, want ErrTokenExpired", err)
+	}
+
+	err = service.Attempt(old)
+	if !errors.Is(err, ErrTooManyAttempts) {
+		t.Errorf("Attempt() on an expired challenge err = %v, want ErrTooManyAttempts", err)
+	}
+
+	n, err := service.DeleteExpired()
+	if err != nil {
+		t.Fatalf("DeleteExpired() err = %v", err)
+	}
+	if n != 1 {
+		t.Errorf("DeleteExpired() removed %d, want 1", n)
+	}
+
+	_, err = service.ByToken(old.Token)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("ByToken() after DeleteExpired err = %v, want ErrNotFound", err)
+	}
+	_, err = service.ByToken(current.Token)
+	if err != nil {
+		t.Errorf("ByToken() for a current challenge err = %v", err)
+	}
+
+	err = service.Delete(current)
+	if err != nil {
+		t.Fatalf("Delete() err = %v", err)
+	}
+	_, err = service.ByToken(current.Token)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("ByToken() after Delete err = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,284 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"taran1s.share/rand"
+)
+
+const (
+	DefaultOIDCName = "your organisation"
+	// How long the user has to sign in at the identity provider
+	DefaultOIDCLoginDuration = 10 * time.Minute
+)
+
+var ErrOIDCFailed error = fmt.Errorf("Signing in with your identity provider failed")
+
+// An OpenID Connect identity provider. Endpoints are found through
+// discovery on the issuer URL
+type OIDCConfig struct {
+	// Shown on the sign in button
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// Our callback URL, which must be registered with the provider
+	RedirectURL string
+	// Extra scopes to openid, email and profile
+	Scopes []string
+}
+
+func (config OIDCConfig) Enabled() bool {
+	return config.Issuer != "" && config.ClientID != ""
+}
+
+// A sign in waiting on the identity provider
+type OIDCLogin struct {
+	// Only set when created
+	State   string
+	AuthURL string
+	// Set when the identity is being linked to a signed in user
+	LinkUserID int
+	Remember   bool
+}
+
+// What we use from a verified ID token
+type OIDCClaims struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	GivenName     string
+	FamilyName    string
+}
+
+// OpenID Connect sign in using the authorization code flow with PKCE
+type OIDCService struct {
+	DB            *sql.DB
+	Config        OIDCConfig
+	BytesPerToken int
+	Duration      time.Duration
+	// Used for discovery and talking to the provider, defaults to
+	// http.DefaultClient
+	Client *http.Client
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+}
+
+// What the provider is called on the sign in page
+func (service *OIDCService) Name() string {
+	if service.Config.Name == "" {
+		return DefaultOIDCName
+	}
+	return service.Config.Name
+}
+
+func (service *OIDCService) hash(state string) string {
+	stateHash := sha256.Sum256([]byte(state))
+	return base64.URLEncoding.EncodeToString(stateHash[:])
+}
+
+func (service *OIDCService) context(ctx context.Context) context.Context {
+	if service.Client != nil {
+		return oidc.ClientContext(ctx, service.Client)
+	}
+	return ctx
+}
+
+// The provider's endpoints and keys, discovered the first time they're
+// needed so the app still starts if the provider is down
+func (service *OIDCService) discover(ctx context.Context) (*oidc.Provider, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	if service.provider != nil {
+		return service.provider, nil
+	}
+
+	provider, err := oidc.NewProvider(service.context(ctx), service.Config.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	service.provider = provider
+	return provider, nil
+}
+
+func (service *OIDCService) oauth2Config(provider *oidc.Provider) *oauth2.Config {
+	scopes := append([]string{oidc.ScopeOpenID, "email", "profile"}, service.Config.Scopes...)
+
+	return &oauth2.Config{
+		ClientID:     service.Config.ClientID,
+		ClientSecret: service.Config.ClientSecret,
+		RedirectURL:  service.Config.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       scopes,
+	}
+}
+
+// Start a sign in, returning the provider URL to send the user to. The
+// state goes in a cookie so only this browser can finish it
+func (service *OIDCService) Begin(ctx context.Context, linkUserID int, remember bool) (*OIDCLogin, error) {
+	provider, err := service.discover(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("begin: %w", err)
+	}
+
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+
+	state, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("begin: %w", err)
+	}
+
+	nonce, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("begin: %w", err)
+	}
+
+	verifier := oauth2.GenerateVerifier()
+
+	duration := service.Duration
+	if duration == 0 {
+		duration = DefaultOIDCLoginDuration
+	}
+
+	var linkUser *int
+	if linkUserID != 0 {
+		linkUser = &linkUserID
+	}
+
+	_, err = service.DB.Exec(`
+		INSERT INTO oidc_logins (state_hash, nonce, code_verifier, link_user_id, remember, expires_at)
+		VALUES ($1,$2,$3,$4,$5,$6);`, service.hash(state), nonce, verifier,
+		linkUser, remember, time.Now().Add(duration))
+	if err != nil {
+		return nil, fmt.Errorf("begin: %w", err)
+	}
+
+	authURL := service.oauth2Config(provider).AuthCodeURL(state,
+		oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+
+	return &OIDCLogin{
+		State:      state,
+		AuthURL:    authURL,
+		LinkUserID: linkUserID,
+		Remember:   remember,
+	}, nil
+}
+
+// Finish a sign in when the provider sends the user back with a code.
+// The state is used up whether or not this succeeds
+func (service *OIDCService) Finish(ctx context.Context, state, code string) (*OIDCLogin, *OIDCClaims, error) {
+	login := OIDCLogin{}
+	var nonce, verifier string
+	var linkUserID sql.NullInt64
+	var expiresAt time.Time
+
+	row := service.DB.QueryRow(`
+		DELETE FROM oidc_logins
+		WHERE state_hash = $1
+		RETURNING nonce, code_verifier, link_user_id, remember, expires_at;`, service.hash(state))
+
+	err := row.Scan(&nonce, &verifier, &linkUserID, &login.Remember, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, ErrNotFound
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("finish: %w", err)
+	}
+	login.LinkUserID = int(linkUserID.Int64)
+
+	if time.Now().After(expiresAt) {
+		return nil, nil, ErrTokenExpired
+	}
+
+	claims, err := service.exchange(ctx, code, nonce, verifier)
+	if err != nil {
+		return nil, nil, fmt.Errorf("finish: %w: %w", ErrOIDCFailed, err)
+	}
+
+	return &login, claims, nil
+}
+
+// Swap the code for tokens and check the ID token came from the provider,
+// was meant for us and belongs to this sign in
+func (service *OIDCService) exchange(ctx context.Context, code, nonce, verifier string) (*OIDCClaims, error) {
+	provider, err := service.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx = service.context(ctx)
+
+	token, err := service.oauth2Config(provider).Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, err
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("no id_token in token response")
+	}
+
+	verifierConfig := &oidc.Config{ClientID: service.Config.ClientID}
+	idToken, err := provider.Verifier(verifierConfig).Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if idToken.Nonce != nonce {
+		return nil, fmt.Errorf("nonce mismatch")
+	}
+
+	if idToken.AccessTokenHash != "" {
+		err = idToken.VerifyAccessToken(token.AccessToken)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var raw struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		GivenName     string `json:"given_name"`
+		FamilyName    string `json:"family_name"`
+	}
+	err = idToken.Claims(&raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OIDCClaims{
+		Issuer:        idToken.Issuer,
+		Subject:       idToken.Subject,
+		Email:         raw.Email,
+		EmailVerified: raw.EmailVerified,
+		GivenName:     raw.GivenName,
+		FamilyName:    raw.FamilyName,
+	}, nil
+}
+
+// Remove sign ins that never came back from the provider
+func (service *OIDCService) DeleteExpired() (int64, error) {
+	result, err := service.DB.Exec(`
+		DELETE FROM oidc_logins
+		WHERE expires_at < NOW();`)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired: %w", err)
+	}
+
+	return result.RowsAffected()
+}
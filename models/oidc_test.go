@@ -0,0 +1,483 @@
+package models
+
+import (
+	"context"
+	"crypto"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const testRedirectURL = "https://share.example.com/auth/oidc/callback"
+
+// What the provider remembers about a code it handed out
+type fakeGrant struct {
+	nonce     string
+	challenge string
+}
+
+// An identity provider that serves discovery, its signing keys and a token
+// endpoint which checks the client and PKCE verifier the way a real one
+// would. Tests change the ID tokens it issues to see what gets through
+type fakeOIDCProvider struct {
+	server       *httptest.Server
+	clientID     string
+	clientSecret string
+	// The published signing key
+	key *rsa.PrivateKey
+
+	mu     sync.Mutex
+	issued int
+	// The issuer in the discovery document, the server's URL by default
+	issuer      string
+	discoveries int
+	codes       map[string]fakeGrant
+	// Sign ID tokens with this key instead of the published one
+	signer *rsa.PrivateKey
+	// Change the claims of the next ID tokens
+	edit        func(claims map[string]any)
+	omitIDToken bool
+}
+
+func newFakeOIDCProvider(t *testing.T) *fakeOIDCProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(crand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &fakeOIDCProvider{
+		clientID:     "share-client",
+		clientSecret: "share-secret",
+		key:          key,
+		codes:        map[string]fakeGrant{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/keys", p.keys)
+	mux.HandleFunc("/token", p.token)
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+
+	return p
+}
+
+func (p *fakeOIDCProvider) service(db *sql.DB) *OIDCService {
+	return &OIDCService{
+		DB: db,
+		Config: OIDCConfig{
+			Issuer:       p.server.URL,
+			ClientID:     p.clientID,
+			ClientSecret: p.clientSecret,
+			RedirectURL:  testRedirectURL,
+		},
+		Client: p.server.Client(),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (p *fakeOIDCProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.discoveries++
+
+	issuer := p.issuer
+	if issuer == "" {
+		issuer = p.server.URL
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                issuer,
+		"authorization_endpoint":                p.server.URL + "/authorize",
+		"token_endpoint":                        p.server.URL + "/token",
+		"jwks_uri":                              p.server.URL + "/keys",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (p *fakeOIDCProvider) keys(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": "test-key",
+			"n":   b64(p.key.N.Bytes()),
+			"e":   b64(big.NewInt(int64(p.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (p *fakeOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	if clientID != p.clientID || secret != p.clientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	// Codes can only be used once, and only with the verifier whose
+	// challenge was sent when signing in
+	code := r.PostFormValue("code")
+	grant, ok := p.codes[code]
+	delete(p.codes, code)
+	verifierHash := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || r.PostFormValue("grant_type") != "authorization_code" ||
+		r.PostFormValue("redirect_uri") != testRedirectURL ||
+		b64(verifierHash[:]) != grant.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	accessToken := "access-" + code
+	accessTokenHash := sha256.Sum256([]byte(accessToken))
+	now := time.Now()
+	claims := map[string]any{
+		"iss":            p.server.URL,
+		"sub":            "user-1",
+		"aud":            p.clientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+		"nonce":          grant.nonce,
+		"at_hash":        b64(accessTokenHash[:16]),
+		"email":          "Jo@Example.com",
+		"email_verified": true,
+		"given_name":     "Jo",
+		"family_name":    "Bloggs",
+	}
+	if p.edit != nil {
+		p.edit(claims)
+	}
+
+	response := map[string]any{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+	}
+	if !p.omitIDToken {
+		signer := p.signer
+		if signer == nil {
+			signer = p.key
+		}
+		response["id_token"] = signJWT(signer, claims)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// A compact RS256 JWT
+func signJWT(key *rsa.PrivateKey, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "test-key"})
+	payload, _ := json.Marshal(claims)
+	signingInput := b64(header) + "." + b64(payload)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(crand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return signingInput + "." + b64(signature)
+}
+
+// Hand out a code as if the user signed in, returning it
+func (p *fakeOIDCProvider) grant(nonce, verifier string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(verifier))
+	p.issued++
+	code := fmt.Sprintf("code-%d", p.issued)
+	p.codes[code] = fakeGrant{nonce: nonce, challenge: b64(challenge[:])}
+	return code
+}
+
+// Follow an authorization URL as the user's browser would, returning the
+// state and code the provider sends back to the callback
+func (p *fakeOIDCProvider) authorize(t *testing.T, authURL string) (string, string) {
+	t.Helper()
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("parsing auth URL: %v", err)
+	}
+	if got := u.Scheme + "://" + u.Host + u.Path; got != p.server.URL+"/authorize" {
+		t.Fatalf("auth URL = %q, want the provider's authorization endpoint", got)
+	}
+
+	query := u.Query()
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             p.clientID,
+		"redirect_uri":          testRedirectURL,
+		"scope":                 "openid email profile",
+		"code_challenge_method": "S256",
+	}
+	for name, value := range want {
+		if got := query.Get(name); got != value {
+			t.Errorf("auth URL %s = %q, want %q", name, got, value)
+		}
+	}
+	for _, name := range []string{"state", "nonce", "code_challenge"} {
+		if query.Get(name) == "" {
+			t.Errorf("auth URL has no %s", name)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.issued++
+	code := fmt.Sprintf("code-%d", p.issued)
+	p.codes[code] = fakeGrant{nonce: query.Get("nonce"), challenge: query.Get("code_challenge")}
+	return query.Get("state"), code
+}
+
+func TestOIDCExchange(t *testing.T) {
+	p := newFakeOIDCProvider(t)
+	otherKey, err := rsa.GenerateKey(crand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		// The nonce we expect, when it isn't the one the provider was given
+		nonce string
+		// The verifier we send, when it isn't the one the challenge was for
+		verifier    string
+		edit        func(claims map[string]any)
+		signer      *rsa.PrivateKey
+		omitIDToken bool
+		wantErr     bool
+	}{
+		"valid": {},
+		"nonce mismatch": {
+			nonce:   "someone-elses-nonce",
+			wantErr: true,
+		},
+		"no nonce": {
+			edit:    func(claims map[string]any) { delete(claims, "nonce") },
+			wantErr: true,
+		},
+		"wrong code verifier": {
+			verifier: oauth2.GenerateVerifier(),
+			wantErr:  true,
+		},
+		"signed with another key": {
+			signer:  otherKey,
+			wantErr: true,
+		},
+		"wrong issuer": {
+			edit:    func(claims map[string]any) { claims["iss"] = "https://evil.example.com" },
+			wantErr: true,
+		},
+		"wrong audience": {
+			edit:    func(claims map[string]any) { claims["aud"] = "another-client" },
+			wantErr: true,
+		},
+		"audiences without us": {
+			edit:    func(claims map[string]any) { claims["aud"] = []string{"another-client", "a-third"} },
+			wantErr: true,
+		},
+		"expired": {
+			edit:    func(claims map[string]any) { claims["exp"] = time.Now().Add(-time.Hour).Unix() },
+			wantErr: true,
+		},
+		"access token hash mismatch": {
+			edit:    func(claims map[string]any) { claims["at_hash"] = "AAAAAAAAAAAAAAAAAAAAAA" },
+			wantErr: true,
+		},
+		"no id token": {
+			omitIDToken: true,
+			wantErr:     true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			p.mu.Lock()
+			p.edit, p.signer, p.omitIDToken = tc.edit, tc.signer, tc.omitIDToken
+			p.mu.Unlock()
+
+			nonce, verifier := "the-nonce", oauth2.GenerateVerifier()
+			code := p.grant(nonce, verifier)
+			if tc.nonce != "" {
+				nonce = tc.nonce
+			}
+			if tc.verifier != "" {
+				verifier = tc.verifier
+			}
+
+			claims, err := p.service(nil).exchange(context.Background(), code, nonce, verifier)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("exchange() err = %v, want error %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			want := OIDCClaims{
+				Issuer:        p.server.URL,
+				Subject:       "user-1",
+				Email:         "Jo@Example.com",
+				EmailVerified: true,
+				GivenName:     "Jo",
+				FamilyName:    "Bloggs",
+			}
+			if *claims != want {
+				t.Errorf("exchange() = %+v, want %+v", *claims, want)
+			}
+		})
+	}
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	p := newFakeOIDCProvider(t)
+	service := p.service(nil)
+
+	// A provider claiming to be someone else is refused, and the failure
+	// isn't remembered
+	p.mu.Lock()
+	p.issuer = "https://evil.example.com"
+	p.mu.Unlock()
+	_, err := service.discover(context.Background())
+	if err == nil {
+		t.Fatal("discover() with the wrong issuer err = nil, want an error")
+	}
+
+	p.mu.Lock()
+	p.issuer = ""
+	p.mu.Unlock()
+	for i := 0; i < 2; i++ {
+		verifier := oauth2.GenerateVerifier()
+		code := p.grant("the-nonce", verifier)
+		_, err = service.exchange(context.Background(), code, "the-nonce", verifier)
+		if err != nil {
+			t.Fatalf("exchange() err = %v", err)
+		}
+	}
+
+	// Once for the failure, once for both sign ins
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discoveries != 2 {
+		t.Errorf("discovery fetched %d times, want 2", p.discoveries)
+	}
+}
+
+func TestOIDCBeginFinish(t *testing.T) {
+	db := testDB(t)
+	p := newFakeOIDCProvider(t)
+	service := p.service(db)
+	ctx := context.Background()
+
+	login, err := service.Begin(ctx, 0, true)
+	if err != nil {
+		t.Fatalf("Begin() err = %v", err)
+	}
+	state, code := p.authorize(t, login.AuthURL)
+	if state != login.State {
+		t.Errorf("auth URL state = %q, want %q", state, login.State)
+	}
+
+	_, _, err = service.Finish(ctx, "not-the-state", code)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Finish() with another state err = %v, want ErrNotFound", err)
+	}
+
+	finished, claims, err := service.Finish(ctx, state, code)
+	if err != nil {
+		t.Fatalf("Finish() err = %v", err)
+	}
+	if !finished.Remember || finished.LinkUserID != 0 {
+		t.Errorf("Finish() login = %+v, want remembered and not linking", finished)
+	}
+	if claims.Subject != "user-1" {
+		t.Errorf("Finish() subject = %q, want %q", claims.Subject, "user-1")
+	}
+
+	// Each state can only be used once
+	_, _, err = service.Finish(ctx, state, code)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Finish() again err = %v, want ErrNotFound", err)
+	}
+
+	// Linking remembers who to link to
+	user := testUser(t, db, "jo@example.com")
+	login, err = service.Begin(ctx, user.ID, false)
+	if err != nil {
+		t.Fatalf("Begin() err = %v", err)
+	}
+	state, code = p.authorize(t, login.AuthURL)
+	finished, _, err = service.Finish(ctx, state, code)
+	if err != nil {
+		t.Fatalf("Finish() err = %v", err)
+	}
+	if finished.LinkUserID != user.ID || finished.Remember {
+		t.Errorf("Finish() login = %+v, want linking to user %d", finished, user.ID)
+	}
+
+	// A token the provider got wrong fails the sign in
+	p.mu.Lock()
+	p.edit = func(claims map[string]any) { claims["aud"] = "another-client" }
+	p.mu.Unlock()
+	login, err = service.Begin(ctx, 0, false)
+	if err != nil {
+		t.Fatalf("Begin() err = %v", err)
+	}
+	state, code = p.authorize(t, login.AuthURL)
+	_, _, err = service.Finish(ctx, state, code)
+	if !errors.Is(err, ErrOIDCFailed) {
+		t.Errorf("Finish() with the wrong audience err = %v, want ErrOIDCFailed", err)
+	}
+	p.mu.Lock()
+	p.edit = nil
+	p.mu.Unlock()
+
+	// As does taking too long at the provider
+	service.Duration = -time.Minute
+	login, err = service.Begin(ctx, 0, false)
+	if err != nil {
+		t.Fatalf("Begin() err = %v", err)
+	}
+	_, err = service.Begin(ctx, 0, false)
+	if err != nil {
+		t.Fatalf("Begin() err = %v", err)
+	}
+	state, code = p.authorize(t, login.AuthURL)
+	_, _, err = service.Finish(ctx, state, code)
+	if !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("Finish() after expiry err = %v, want ErrTokenExpired", err)
+	}
+
+	n, err := service.DeleteExpired()
+	if err != nil {
+		t.Fatalf("DeleteExpired() err = %v", err)
+	}
+	if n != 1 {
+		t.Errorf("DeleteExpired() = %d, want 1", n)
+	}
+}
@@ -0,0 +1,231 @@
+package models
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"taran1s.share/rand"
+)
+
+// Algorithms for new password hashes. Hashes made with either can always
+// be checked, whichever is configured
+const (
+	PasswordBcrypt   = "bcrypt"
+	PasswordArgon2id = "argon2id"
+)
+
+var ErrUnknownPasswordHash = errors.New("unknown password hash format")
+
+// Argon2id settings, stored in each hash so they can be raised later
+type Argon2Params struct {
+	// In KiB
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+var DefaultArgon2Params = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// How new password hashes are made. The zero value makes bcrypt hashes at
+// the default cost
+type PasswordConfig struct {
+	Algorithm string
+	// Defaults to bcrypt.DefaultCost
+	BcryptCost int
+	// Unset fields use DefaultArgon2Params
+	Argon2 Argon2Params
+}
+
+// Makes and checks password hashes
+type PasswordHasher struct {
+	PasswordConfig
+
+	dummyOnce sync.Once
+	dummyHash string
+}
+
+func NewPasswordHasher(config PasswordConfig) (*PasswordHasher, error) {
+	hasher := &PasswordHasher{PasswordConfig: config}
+
+	switch hasher.algorithm() {
+	case PasswordBcrypt:
+		cost := hasher.bcryptCost()
+		if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case PasswordArgon2id:
+	default:
+		return nil, fmt.Errorf("unknown password algorithm %q", config.Algorithm)
+	}
+
+	return hasher, nil
+}
+
+// Used where there is no configuration, such as gallery passphrases
+var defaultPasswordHasher = &PasswordHasher{}
+
+func (hasher *PasswordHasher) algorithm() string {
+	if hasher.Algorithm == "" {
+		return PasswordBcrypt
+	}
+	return hasher.Algorithm
+}
+
+func (hasher *PasswordHasher) bcryptCost() int {
+	if hasher.BcryptCost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return hasher.BcryptCost
+}
+
+func (hasher *PasswordHasher) argon2Params() Argon2Params {
+	params := hasher.Argon2
+	if params.Memory == 0 {
+		params.Memory = DefaultArgon2Params.Memory
+	}
+	if params.Iterations == 0 {
+		params.Iterations = DefaultArgon2Params.Iterations
+	}
+	if params.Parallelism == 0 {
+		params.Parallelism = DefaultArgon2Params.Parallelism
+	}
+	if params.SaltLength == 0 {
+		params.SaltLength = DefaultArgon2Params.SaltLength
+	}
+	if params.KeyLength == 0 {
+		params.KeyLength = DefaultArgon2Params.KeyLength
+	}
+	return params
+}
+
+func (hasher *PasswordHasher) Hash(password string) (string, error) {
+	switch hasher.algorithm() {
+	case PasswordBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), hasher.bcryptCost())
+		if err != nil {
+			return "", fmt.Errorf("hash: %w", err)
+		}
+		return string(hash), nil
+	case PasswordArgon2id:
+		params := hasher.argon2Params()
+		salt, err := rand.Bytes(int(params.SaltLength))
+		if err != nil {
+			return "", fmt.Errorf("hash: %w", err)
+		}
+		key := argon2.IDKey([]byte(password), salt, params.Iterations,
+			params.Memory, params.Parallelism, params.KeyLength)
+
+		// The PHC string format used by other Argon2 libraries
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+			params.Memory, params.Iterations, params.Parallelism,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key)), nil
+	default:
+		return "", fmt.Errorf("hash: unknown password algorithm %q", hasher.Algorithm)
+	}
+}
+
+// Check a password against a hash made by either algorithm. rehash is true
+// when the password is right but the hash wasn't made with the current
+// algorithm and settings, so it should be replaced
+func (hasher *PasswordHasher) Check(hash, password string) (ok, rehash bool, err error) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		params, salt, key, err := parseArgon2Hash(hash)
+		if err != nil {
+			return false, false, err
+		}
+
+		other := argon2.IDKey([]byte(password), salt, params.Iterations,
+			params.Memory, params.Parallelism, params.KeyLength)
+		if subtle.ConstantTimeCompare(key, other) != 1 {
+			return false, false, nil
+		}
+
+		current := hasher.argon2Params()
+		rehash = hasher.algorithm() != PasswordArgon2id ||
+			params.Memory != current.Memory ||
+			params.Iterations != current.Iterations ||
+			params.Parallelism != current.Parallelism ||
+			params.KeyLength != current.KeyLength
+		return true, rehash, nil
+	}
+
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return false, false, ErrUnknownPasswordHash
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, false, nil
+	} else if err != nil {
+		return false, false, fmt.Errorf("check: %w", err)
+	}
+
+	rehash = hasher.algorithm() != PasswordBcrypt || cost != hasher.bcryptCost()
+	return true, rehash, nil
+}
+
+// Spend as long as a real password check when there's no hash to check
+// against, so response times don't show which addresses have accounts
+func (hasher *PasswordHasher) CheckDummy(password string) {
+	hasher.dummyOnce.Do(func() {
+		hash, err := hasher.Hash("dummy password")
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		hasher.dummyHash = hash
+	})
+	hasher.Check(hasher.dummyHash, password)
+}
+
+// Split "$argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>"
+func parseArgon2Hash(hash string) (Argon2Params, []byte, []byte, error) {
+	var params Argon2Params
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+
+	// argon2 panics rather than returning an error for zero rounds or threads
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil || params.Iterations == 0 || params.Parallelism == 0 {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, nil
+}
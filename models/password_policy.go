@@ -0,0 +1,148 @@
+package models
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	DefaultPasswordMinLength = 8
+	// bcrypt only uses this much of a password
+	bcryptMaxBytes = 72
+)
+
+// Matched by every way a new password can break the policy
+var ErrWeakPassword = errors.New("Password does not meet the requirements")
+
+// Says which rule a password broke, in words fit to show the user
+type PasswordPolicyError struct {
+	msg string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return e.msg
+}
+
+func (e *PasswordPolicyError) Is(target error) bool {
+	return target == ErrWeakPassword
+}
+
+// Rules for new passwords. The zero value only sets a minimum length
+type PasswordPolicy struct {
+	// In characters, defaults to DefaultPasswordMinLength
+	MinLength int
+	// Nil skips the check
+	Breached *BreachedPasswordList
+}
+
+var defaultPasswordPolicy = &PasswordPolicy{}
+
+func (policy *PasswordPolicy) minLength() int {
+	if policy.MinLength == 0 {
+		return DefaultPasswordMinLength
+	}
+	return policy.MinLength
+}
+
+// Check a new password for the account with the given email address.
+// hasher is what will hash it, as bcrypt can't take long passwords
+func (policy *PasswordPolicy) Check(hasher *PasswordHasher, email, password string) error {
+	if utf8.RuneCountInString(password) < policy.minLength() {
+		return &PasswordPolicyError{fmt.Sprintf("Password must be at least %d characters", policy.minLength())}
+	}
+
+	// Refused rather than cut short, so everything typed still counts
+	if hasher.algorithm() == PasswordBcrypt && len(password) > bcryptMaxBytes {
+		return &PasswordPolicyError{fmt.Sprintf(
+			"Password is too long. It can be up to %d bytes, which is fewer characters if it has accents or emoji", bcryptMaxBytes)}
+	}
+
+	email = normaliseEmail(email)
+	lower := strings.ToLower(strings.TrimSpace(password))
+	localPart, _, _ := strings.Cut(email, "@")
+	if email != "" && (lower == email || lower == localPart) {
+		return &PasswordPolicyError{"Password can't be your email address"}
+	}
+
+	if policy.Breached != nil {
+		breached, err := policy.Breached.Contains(password)
+		if err != nil {
+			return fmt.Errorf("check password: %w", err)
+		}
+		if breached {
+			return &PasswordPolicyError{"This password has appeared in a data breach, so it's one of the first an attacker would try. Please choose a different one"}
+		}
+	}
+
+	return nil
+}
+
+// Passwords known from data breaches, stored as in the Pwned Passwords
+// range API: the SHA-1 of each password is split after 5 hex characters
+// and Dir holds a file for each prefix, such as 21BD1.txt, listing the
+// suffixes with that prefix as SUFFIX:COUNT lines. Only one file is read
+// per check, and the password itself is never stored
+type BreachedPasswordList struct {
+	Dir string
+	// Passwords seen fewer times than this are allowed, 0 refuses all of them
+	MinCount int
+}
+
+func NewBreachedPasswordList(dir string, minCount int) (*BreachedPasswordList, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("breached password list: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("breached password list: %s is not a directory", dir)
+	}
+
+	return &BreachedPasswordList{
+		Dir:      dir,
+		MinCount: minCount,
+	}, nil
+}
+
+func (list *BreachedPasswordList) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	file, err := os.Open(filepath.Join(list.Dir, prefix+".txt"))
+	if errors.Is(err, os.ErrNotExist) {
+		// A partial list just doesn't know about this range
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("contains: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineSuffix, count, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if !strings.EqualFold(lineSuffix, suffix) {
+			continue
+		}
+
+		if list.MinCount > 0 {
+			n, err := strconv.Atoi(count)
+			if err == nil && n < list.MinCount {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("contains: %w", err)
+	}
+	return false, nil
+}
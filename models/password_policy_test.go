@@ -0,0 +1,228 @@
+package models
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A breached password list in a temporary directory, holding the given
+// passwords seen the given number of times
+func testBreachedList(t *testing.T, passwords map[string]int) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	files := map[string]string{}
+	for password, count := range passwords {
+		sum := sha1.Sum([]byte(password))
+		hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+		files[hash[:5]] += fmt.Sprintf("%s:%d\r\n", hash[5:], count)
+	}
+	for prefix, lines := range files {
+		err := os.WriteFile(filepath.Join(dir, prefix+".txt"), []byte(lines), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	dir := testBreachedList(t, map[string]int{
+		"password123": 250000,
+		"rarely seen": 2,
+	})
+	notDir := filepath.Join(t.TempDir(), "file")
+	err := os.WriteFile(notDir, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bcryptHasher := &PasswordHasher{}
+	argon2Hasher := &PasswordHasher{PasswordConfig: PasswordConfig{Algorithm: PasswordArgon2id}}
+
+	tests := map[string]struct {
+		policy   PasswordPolicy
+		hasher   *PasswordHasher
+		email    string
+		password string
+		wantWeak bool
+		// Some other error, from reading the breached list
+		wantErr bool
+	}{
+		"fine": {
+			password: "correct horse battery",
+		},
+		"too short": {
+			password: "short12",
+			wantWeak: true,
+		},
+		"exactly the minimum": {
+			password: "eight888",
+		},
+		"length is in characters": {
+			password: "ééééééé",
+			wantWeak: true,
+		},
+		"longer minimum": {
+			policy:   PasswordPolicy{MinLength: 12},
+			password: "elevenchars",
+			wantWeak: true,
+		},
+		"bcrypt limit": {
+			password: strings.Repeat("a", 72),
+		},
+		"over the bcrypt limit": {
+			password: strings.Repeat("a", 73),
+			wantWeak: true,
+		},
+		"over the bcrypt limit in bytes only": {
+			password: strings.Repeat("é", 37),
+			wantWeak: true,
+		},
+		"long with argon2id": {
+			hasher:   argon2Hasher,
+			password: strings.Repeat("a", 200),
+		},
+		"email address": {
+			email:    "Jo.Bloggs@Example.com",
+			password: " jo.bloggs@example.com ",
+			wantWeak: true,
+		},
+		"local part of the email address": {
+			email:    "jo.bloggs@example.com",
+			password: "JO.BLOGGS",
+			wantWeak: true,
+		},
+		"contains the local part": {
+			email:    "jo.bloggs@example.com",
+			password: "jo.bloggs rides again",
+		},
+		"breached": {
+			policy:   PasswordPolicy{Breached: &BreachedPasswordList{Dir: dir}},
+			password: "password123",
+			wantWeak: true,
+		},
+		"breached is case sensitive": {
+			policy:   PasswordPolicy{Breached: &BreachedPasswordList{Dir: dir}},
+			password: "Password123",
+		},
+		"breached but rarely": {
+			policy:   PasswordPolicy{Breached: &BreachedPasswordList{Dir: dir, MinCount: 10}},
+			password: "rarely seen",
+		},
+		"no breached list": {
+			password: "password123",
+		},
+		"breached list can't be read": {
+			policy:   PasswordPolicy{Breached: &BreachedPasswordList{Dir: notDir}},
+			password: "password123",
+			wantErr:  true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			hasher := tc.hasher
+			if hasher == nil {
+				hasher = bcryptHasher
+			}
+
+			err := tc.policy.Check(hasher, tc.email, tc.password)
+			if errors.Is(err, ErrWeakPassword) != tc.wantWeak {
+				t.Fatalf("Check() err = %v, want weak %v", err, tc.wantWeak)
+			}
+			if (err != nil && !tc.wantWeak) != tc.wantErr {
+				t.Fatalf("Check() err = %v, want error %v", err, tc.wantErr)
+			}
+
+			// What's wrong is said in words the user can read
+			var policyErr *PasswordPolicyError
+			if tc.wantWeak && (!errors.As(err, &policyErr) || policyErr.Error() == "") {
+				t.Errorf("Check() err = %#v, want a *PasswordPolicyError", err)
+			}
+		})
+	}
+}
+
+func TestBreachedPasswordList(t *testing.T) {
+	dir := testBreachedList(t, map[string]int{
+		"password123": 250000,
+		"letmein":     5000,
+		"rarely seen": 2,
+	})
+
+	// Files from other tools may use lower case hex and no counts
+	sum := sha1.Sum([]byte("lower case"))
+	hash := hex.EncodeToString(sum[:])
+	err := os.WriteFile(filepath.Join(dir, strings.ToUpper(hash[:5])+".txt"), []byte(hash[5:]+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		minCount int
+		password string
+		want     bool
+	}{
+		"listed":                    {password: "password123", want: true},
+		"not listed":                {password: "correct horse battery"},
+		"no file for the prefix":    {password: "another unlisted password"},
+		"under the minimum count":   {minCount: 10, password: "rarely seen"},
+		"over the minimum count":    {minCount: 10, password: "letmein", want: true},
+		"no minimum":                {password: "rarely seen", want: true},
+		"lower case hex":            {password: "lower case", want: true},
+		"no count with a minimum":   {minCount: 10, password: "lower case", want: true},
+		"only the exact password":   {password: "password1234"},
+		"exactly the minimum count": {minCount: 5000, password: "letmein", want: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			list, err := NewBreachedPasswordList(dir, tc.minCount)
+			if err != nil {
+				t.Fatalf("NewBreachedPasswordList() err = %v", err)
+			}
+
+			got, err := list.Contains(tc.password)
+			if err != nil {
+				t.Fatalf("Contains() err = %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("Contains(%q) = %v, want %v", tc.password, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewBreachedPasswordList(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "00000.txt")
+	err := os.WriteFile(file, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		dir     string
+		wantErr bool
+	}{
+		"directory":       {dir: dir},
+		"missing":         {dir: filepath.Join(dir, "missing"), wantErr: true},
+		"not a directory": {dir: file, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewBreachedPasswordList(tc.dir, 0)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("NewBreachedPasswordList(%q) err = %v, want error %v", tc.dir, err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
@@ -39,14 +40,14 @@ func (service *PasswordResetService) hash(token string) string {
 
 func (service *PasswordResetService) Create(email string) (*PasswordReset, error) {
 	email = strings.ToLower(email)
-	fmt.Println(email)
 	var userID int
 	row := service.DB.QueryRow(`
 		SELECT id FROM users WHERE email = $1;`, email)
 
 	err := row.Scan(&userID)
-
-	if err != nil {
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
 		return nil, fmt.Errorf("create: %w", err)
 	}
 
@@ -98,7 +99,7 @@ func (service *PasswordResetService) delete(id int) error {
 	return nil
 }
 
-func (service *PasswordResetService) Consume(token string) (*User, error) {
+func (service *PasswordResetService) lookup(token string) (*PasswordReset, *User, error) {
 	tokenHash := service.hash(token)
 	var user User
 	var pwReset PasswordReset
@@ -118,16 +119,34 @@ func (service *PasswordResetService) Consume(token string) (*User, error) {
 		&user.ID, &user.Email, &user.PasswordHash)
 
 	if err != nil {
-		return nil, fmt.Errorf("consume: %w", err)
+		return nil, nil, err
 	}
 
 	if time.Now().After(pwReset.ExpiresAt) {
-		return nil, ErrTokenExpired
+		return nil, nil, ErrTokenExpired
+	}
+
+	return &pwReset, &user, nil
+}
+
+// The user a reset token belongs to, without using the token up
+func (service *PasswordResetService) User(token string) (*User, error) {
+	_, user, err := service.lookup(token)
+	if err != nil {
+		return nil, fmt.Errorf("user: %w", err)
+	}
+	return user, nil
+}
+
+func (service *PasswordResetService) Consume(token string) (*User, error) {
+	pwReset, user, err := service.lookup(token)
+	if err != nil {
+		return nil, fmt.Errorf("consume: %w", err)
 	}
 
 	err = service.delete(pwReset.ID)
 	if err != nil {
 		return nil, fmt.Errorf("consume: %w", err)
 	}
-	return &user, nil
+	return user, nil
 }
@@ -0,0 +1,262 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Argon2id settings cheap enough for tests
+var testArgon2Params = Argon2Params{Memory: 1024, Iterations: 1, Parallelism: 1}
+
+func TestPasswordHasher(t *testing.T) {
+	tests := map[string]struct {
+		config     PasswordConfig
+		wantPrefix string
+	}{
+		"bcrypt": {
+			config:     PasswordConfig{BcryptCost: bcrypt.MinCost},
+			wantPrefix: "$2a$04$",
+		},
+		"argon2id": {
+			config:     PasswordConfig{Algorithm: PasswordArgon2id, Argon2: testArgon2Params},
+			wantPrefix: "$argon2id$v=19$m=1024,t=1,p=1$",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			hasher, err := NewPasswordHasher(tc.config)
+			if err != nil {
+				t.Fatalf("NewPasswordHasher() err = %v", err)
+			}
+
+			hash, err := hasher.Hash("correct horse battery")
+			if err != nil {
+				t.Fatalf("Hash() err = %v", err)
+			}
+			if !strings.HasPrefix(hash, tc.wantPrefix) {
+				t.Errorf("Hash() = %q, want prefix %q", hash, tc.wantPrefix)
+			}
+
+			// Salted, so the same password never hashes the same way twice
+			other, err := hasher.Hash("correct horse battery")
+			if err != nil {
+				t.Fatalf("Hash() err = %v", err)
+			}
+			if other == hash {
+				t.Error("Hash() gave the same hash twice")
+			}
+
+			ok, rehash, err := hasher.Check(hash, "correct horse battery")
+			if err != nil || !ok || rehash {
+				t.Errorf("Check() right password = %v, %v, %v, want ok and no rehash", ok, rehash, err)
+			}
+			ok, rehash, err = hasher.Check(hash, "Correct horse battery")
+			if err != nil || ok || rehash {
+				t.Errorf("Check() wrong password = %v, %v, %v, want not ok", ok, rehash, err)
+			}
+		})
+	}
+}
+
+func TestPasswordRehash(t *testing.T) {
+	bcrypt4 := PasswordConfig{BcryptCost: bcrypt.MinCost}
+	argon2 := PasswordConfig{Algorithm: PasswordArgon2id, Argon2: testArgon2Params}
+	changed := func(edit func(params *Argon2Params)) PasswordConfig {
+		config := argon2
+		edit(&config.Argon2)
+		return config
+	}
+
+	tests := map[string]struct {
+		hashedWith PasswordConfig
+		checkWith  PasswordConfig
+		want       bool
+	}{
+		"same bcrypt cost": {
+			hashedWith: bcrypt4,
+			checkWith:  bcrypt4,
+		},
+		"bcrypt cost raised": {
+			hashedWith: bcrypt4,
+			checkWith:  PasswordConfig{BcryptCost: bcrypt.MinCost + 1},
+			want:       true,
+		},
+		"bcrypt cost lowered": {
+			hashedWith: PasswordConfig{BcryptCost: bcrypt.MinCost + 1},
+			checkWith:  bcrypt4,
+			want:       true,
+		},
+		"bcrypt to argon2id": {
+			hashedWith: bcrypt4,
+			checkWith:  argon2,
+			want:       true,
+		},
+		"argon2id to bcrypt": {
+			hashedWith: argon2,
+			checkWith:  bcrypt4,
+			want:       true,
+		},
+		"same argon2id params": {
+			hashedWith: argon2,
+			checkWith:  argon2,
+		},
+		"argon2id memory raised": {
+			hashedWith: argon2,
+			checkWith:  changed(func(params *Argon2Params) { params.Memory = 2048 }),
+			want:       true,
+		},
+		"argon2id iterations raised": {
+			hashedWith: argon2,
+			checkWith:  changed(func(params *Argon2Params) { params.Iterations = 2 }),
+			want:       true,
+		},
+		"argon2id parallelism raised": {
+			hashedWith: argon2,
+			checkWith:  changed(func(params *Argon2Params) { params.Parallelism = 2 }),
+			want:       true,
+		},
+		"argon2id key length raised": {
+			hashedWith: argon2,
+			checkWith:  changed(func(params *Argon2Params) { params.KeyLength = 64 }),
+			want:       true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			hash, err := (&PasswordHasher{PasswordConfig: tc.hashedWith}).Hash("correct horse battery")
+			if err != nil {
+				t.Fatalf("Hash() err = %v", err)
+			}
+
+			checker := &PasswordHasher{PasswordConfig: tc.checkWith}
+			ok, rehash, err := checker.Check(hash, "correct horse battery")
+			if err != nil || !ok {
+				t.Fatalf("Check() = %v, %v, want ok", ok, err)
+			}
+			if rehash != tc.want {
+				t.Errorf("Check() rehash = %v, want %v", rehash, tc.want)
+			}
+
+			// Only the right password asks for a rehash
+			_, rehash, _ = checker.Check(hash, "wrong")
+			if rehash {
+				t.Error("Check() wrong password rehash = true, want false")
+			}
+		})
+	}
+}
+
+func TestParseArgon2Hash(t *testing.T) {
+	// "salt-salt-salt!!" and "key-key-key-key-key-key-key-key!"
+	salt := "c2FsdC1zYWx0LXNhbHQhIQ"
+	key := "a2V5LWtleS1rZXkta2V5LWtleS1rZXkta2V5LWtleSE"
+
+	params, _, _, err := parseArgon2Hash("$argon2id$v=19$m=1024,t=2,p=3$" + salt + "$" + key)
+	if err != nil {
+		t.Fatalf("parseArgon2Hash() err = %v", err)
+	}
+	want := Argon2Params{Memory: 1024, Iterations: 2, Parallelism: 3, SaltLength: 16, KeyLength: 32}
+	if params != want {
+		t.Errorf("parseArgon2Hash() = %+v, want %+v", params, want)
+	}
+
+	malformed := map[string]string{
+		"empty":             "",
+		"not a hash":        "hunter2",
+		"truncated bcrypt":  "$2a$10$abc",
+		"missing key":       "$argon2id$v=19$m=1024,t=1,p=1$" + salt,
+		"extra part":        "$argon2id$v=19$m=1024,t=1,p=1$" + salt + "$" + key + "$",
+		"old version":       "$argon2id$v=16$m=1024,t=1,p=1$" + salt + "$" + key,
+		"no version":        "$argon2id$$m=1024,t=1,p=1$" + salt + "$" + key,
+		"params misordered": "$argon2id$v=19$t=1,m=1024,p=1$" + salt + "$" + key,
+		"zero iterations":   "$argon2id$v=19$m=1024,t=0,p=1$" + salt + "$" + key,
+		"zero parallelism":  "$argon2id$v=19$m=1024,t=1,p=0$" + salt + "$" + key,
+		"salt not base64":   "$argon2id$v=19$m=1024,t=1,p=1$not*base64$" + key,
+		"padded key":        "$argon2id$v=19$m=1024,t=1,p=1$" + salt + "$" + key + "=",
+		"empty key":         "$argon2id$v=19$m=1024,t=1,p=1$" + salt + "$",
+	}
+
+	hasher := &PasswordHasher{}
+	for name, hash := range malformed {
+		t.Run(name, func(t *testing.T) {
+			ok, _, err := hasher.Check(hash, "correct horse battery")
+			if ok || !errors.Is(err, ErrUnknownPasswordHash) {
+				t.Errorf("Check(%q) = %v, %v, want ErrUnknownPasswordHash", hash, ok, err)
+			}
+		})
+	}
+}
+
+func TestNewPasswordHasher(t *testing.T) {
+	tests := map[string]struct {
+		config  PasswordConfig
+		wantErr bool
+	}{
+		"zero value":        {config: PasswordConfig{}},
+		"bcrypt":            {config: PasswordConfig{Algorithm: PasswordBcrypt, BcryptCost: 12}},
+		"bcrypt cost low":   {config: PasswordConfig{BcryptCost: bcrypt.MinCost - 1}, wantErr: true},
+		"bcrypt cost high":  {config: PasswordConfig{BcryptCost: bcrypt.MaxCost + 1}, wantErr: true},
+		"argon2id":          {config: PasswordConfig{Algorithm: PasswordArgon2id}},
+		"unknown algorithm": {config: PasswordConfig{Algorithm: "scrypt"}, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewPasswordHasher(tc.config)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("NewPasswordHasher() err = %v, want error %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// Signing in upgrades a hash made with old settings, and only then
+func TestAuthenticateRehash(t *testing.T) {
+	db := testDB(t)
+	testUser(t, db, "jo@example.com")
+
+	service := &UserService{
+		DB:        db,
+		Passwords: &PasswordHasher{PasswordConfig: PasswordConfig{Algorithm: PasswordArgon2id, Argon2: testArgon2Params}},
+	}
+	hashOf := func() string {
+		t.Helper()
+		var hash string
+		err := db.QueryRow(`SELECT password_hash FROM users WHERE email = 'jo@example.com';`).Scan(&hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+
+	_, err := service.Authenticate("jo@example.com", "wrong password")
+	if !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("Authenticate() wrong password err = %v, want ErrInvalidCredentials", err)
+	}
+	if hash := hashOf(); !strings.HasPrefix(hash, "$2a$") {
+		t.Fatalf("hash after a failed sign in = %q, want the bcrypt hash kept", hash)
+	}
+
+	_, err = service.Authenticate("jo@example.com", "correct horse battery")
+	if err != nil {
+		t.Fatalf("Authenticate() err = %v", err)
+	}
+	upgraded := hashOf()
+	if !strings.HasPrefix(upgraded, "$argon2id$") {
+		t.Fatalf("hash after signing in = %q, want an argon2id hash", upgraded)
+	}
+
+	// Already current, so it's left alone
+	_, err = service.Authenticate("jo@example.com", "correct horse battery")
+	if err != nil {
+		t.Fatalf("Authenticate() with the new hash err = %v", err)
+	}
+	if hashOf() != upgraded {
+		t.Error("a current hash was replaced")
+	}
+}
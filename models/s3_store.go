@@ -0,0 +1,324 @@
+package models
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Connection details for an S3 compatible object store such as MinIO
+type S3Config struct {
+	// e.g. http://localhost:9000
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+}
+
+// Stores images in an S3 compatible bucket using path-style requests
+// signed with AWS Signature Version 4
+type S3ImageStore struct {
+	config   S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+func NewS3ImageStore(config S3Config) (*S3ImageStore, error) {
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("s3 image store: bucket is required")
+	}
+
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("s3 image store: invalid endpoint %q", config.Endpoint)
+	}
+
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+
+	return &S3ImageStore{
+		config:   config,
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 60 * time.Second},
+	}, nil
+}
+
+func (store *S3ImageStore) Put(key string, contents io.Reader) error {
+	body, err := io.ReadAll(contents)
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+
+	resp, err := store.do(http.MethodPut, key, nil, body)
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("put: %w", s3Error(resp))
+	}
+
+	return nil
+}
+
+func (store *S3ImageStore) Get(key string) (io.ReadCloser, error) {
+	resp, err := store.do(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("get: %w", err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotFound
+	default:
+		defer resp.Body.Close()
+		return nil, fmt.Errorf("get: %w", s3Error(resp))
+	}
+}
+
+func (store *S3ImageStore) Delete(key string) error {
+	resp, err := store.do(http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("delete: %w", s3Error(resp))
+	}
+
+	return nil
+}
+
+func (store *S3ImageStore) List(prefix string) ([]ObjectInfo, error) {
+	var result struct {
+		Contents []struct {
+			Key          string
+			Size         int64
+			LastModified time.Time
+		}
+		IsTruncated           bool
+		NextContinuationToken string
+	}
+
+	var objects []ObjectInfo
+	token := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := store.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, fmt.Errorf("list: %w", err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			err = s3Error(resp)
+			resp.Body.Close()
+			return nil, fmt.Errorf("list: %w", err)
+		}
+
+		result.Contents = nil
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("list: %w", err)
+		}
+
+		for _, object := range result.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:     object.Key,
+				Size:    object.Size,
+				ModTime: object.LastModified,
+			})
+		}
+
+		if !result.IsTruncated {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (store *S3ImageStore) Stat(key string) (ObjectInfo, error) {
+	resp, err := store.do(http.MethodHead, key, nil, nil)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("stat: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return ObjectInfo{}, ErrNotFound
+	default:
+		return ObjectInfo{}, fmt.Errorf("stat: %w", s3Error(resp))
+	}
+
+	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("stat: %w", err)
+	}
+
+	modTime, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("stat: %w", err)
+	}
+
+	return ObjectInfo{
+		Key:     key,
+		Size:    size,
+		ModTime: modTime,
+	}, nil
+}
+
+func s3Error(resp *http.Response) error {
+	var body struct {
+		Code    string
+		Message string
+	}
+	xml.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&body)
+	if body.Code == "" {
+		return fmt.Errorf("s3: %s", resp.Status)
+	}
+	return fmt.Errorf("s3: %s: %s: %s", resp.Status, body.Code, body.Message)
+}
+
+// Build, sign and send a request for key in the configured bucket
+func (store *S3ImageStore) do(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	segments := []string{store.config.Bucket}
+	if key != "" {
+		segments = append(segments, strings.Split(key, "/")...)
+	}
+
+	basePath := strings.TrimSuffix(store.endpoint.Path, "/")
+	rawPath := basePath
+	for _, segment := range segments {
+		rawPath += "/" + s3Escape(segment)
+	}
+
+	u := *store.endpoint
+	u.Path = basePath + "/" + strings.Join(segments, "/")
+	u.RawPath = rawPath
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+
+	store.sign(req, rawPath, body, time.Now().UTC())
+
+	return store.client.Do(req)
+}
+
+func (store *S3ImageStore) sign(req *http.Request, canonicalURI string, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-date":           amzDate,
+		"x-amz-content-sha256": hex.EncodeToString(payloadHash[:]),
+	}
+
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + store.config.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+store.config.SecretKey), date)
+	key = hmacSHA256(key, store.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		store.config.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Percent-encode everything except the unreserved characters, as required
+// by the SigV4 canonical request
+func s3Escape(s string) string {
+	var sb strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case b >= 'A' && b <= 'Z', b >= 'a' && b <= 'z', b >= '0' && b <= '9',
+			b == '-', b == '_', b == '.', b == '~':
+			sb.WriteByte(b)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	var keys []string
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
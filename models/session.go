@@ -4,7 +4,9 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"time"
 
 	"taran1s.share/rand"
 )
@@ -12,19 +14,68 @@ import (
 const (
 	// The minimum number of bytes to be used for each session token
 	MinBytesPerToken = 32
+	// How often a session's last seen time is written back, so busy
+	// sessions don't cost a write on every request
+	SessionTouchInterval = time.Minute
+	// User agents are stored for display only, so very long ones are cut
+	maxUserAgentLength = 512
+
+	// How long a session lasts however active it is, and how long it can go
+	// unused before it ends early
+	DefaultSessionDuration    = 24 * time.Hour
+	DefaultSessionIdleTimeout = 30 * time.Minute
+	// The same for sessions where the user ticked "remember me"
+	DefaultRememberDuration    = 30 * 24 * time.Hour
+	DefaultRememberIdleTimeout = 7 * 24 * time.Hour
 )
 
+var ErrSessionExpired error = fmt.Errorf("Session expired")
+
 type Session struct {
 	ID     int
 	UserID int
 	// Token is only set when creating a new session
-	Token     string
-	TokenHash string
+	Token      string
+	TokenHash  string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	// The browser and address the session was created from
+	UserAgent string
+	IPAddress string
+	// Remembered sessions last longer and survive the browser closing
+	Remember bool
+	// The session ends at ExpiresAt, or earlier at IdleExpiresAt if it isn't
+	// used. Activity pushes IdleExpiresAt back but never past ExpiresAt
+	ExpiresAt     time.Time
+	IdleExpiresAt time.Time
 }
 
+// Zero durations use the matching Default constants
 type SessionService struct {
-	DB            *sql.DB
-	BytesPerToken int
+	DB                  *sql.DB
+	BytesPerToken       int
+	Duration            time.Duration
+	IdleTimeout         time.Duration
+	RememberDuration    time.Duration
+	RememberIdleTimeout time.Duration
+}
+
+// The absolute lifetime and idle timeout for a session
+func (ss *SessionService) timeouts(remember bool) (time.Duration, time.Duration) {
+	duration, idle := ss.Duration, ss.IdleTimeout
+	defaultDuration, defaultIdle := DefaultSessionDuration, DefaultSessionIdleTimeout
+	if remember {
+		duration, idle = ss.RememberDuration, ss.RememberIdleTimeout
+		defaultDuration, defaultIdle = DefaultRememberDuration, DefaultRememberIdleTimeout
+	}
+
+	if duration <= 0 {
+		duration = defaultDuration
+	}
+	if idle <= 0 {
+		idle = defaultIdle
+	}
+	return duration, min(idle, duration)
 }
 
 // Helper to hash tokens
@@ -33,7 +84,9 @@ func (ss *SessionService) hash(token string) string {
 	return base64.URLEncoding.EncodeToString(tokenhash[:])
 }
 
-func (ss *SessionService) Create(userID int) (*Session, error) {
+// Start a new session. Users can have any number of sessions, one for each
+// browser they sign in from
+func (ss *SessionService) Create(userID int, userAgent, ipAddress string, remember bool) (*Session, error) {
 	bytesPerToken := ss.BytesPerToken
 	if bytesPerToken < MinBytesPerToken {
 		bytesPerToken = MinBytesPerToken
@@ -44,20 +97,33 @@ func (ss *SessionService) Create(userID int) (*Session, error) {
 		return nil, fmt.Errorf("create: %w", err)
 	}
 
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+
+	duration, idle := ss.timeouts(remember)
+	now := time.Now()
+
 	session := Session{
-		UserID:    userID,
-		Token:     token,
-		TokenHash: ss.hash(token),
+		UserID:        userID,
+		Token:         token,
+		TokenHash:     ss.hash(token),
+		UserAgent:     userAgent,
+		IPAddress:     ipAddress,
+		Remember:      remember,
+		ExpiresAt:     now.Add(duration),
+		IdleExpiresAt: now.Add(idle),
 	}
 
 	row := ss.DB.QueryRow(`
-		INSERT INTO sessions (user_id, token_hash)
-		VALUES($1,$2) ON CONFLICT (user_id) DO
-		UPDATE
-		SET token_hash = $2
-		RETURNING id;`, session.UserID, session.TokenHash)
+		INSERT INTO sessions (user_id, token_hash, user_agent, ip_address,
+			remember, expires_at, idle_expires_at)
+		VALUES($1,$2,$3,$4,$5,$6,$7)
+		RETURNING id, created_at, last_seen_at;`,
+		session.UserID, session.TokenHash, session.UserAgent, session.IPAddress,
+		session.Remember, session.ExpiresAt, session.IdleExpiresAt)
 
-	err = row.Scan(&session.ID)
+	err = row.Scan(&session.ID, &session.CreatedAt, &session.LastSeenAt)
 	if err != nil {
 		return nil, fmt.Errorf("create: %w", err)
 	}
@@ -65,23 +131,114 @@ func (ss *SessionService) Create(userID int) (*Session, error) {
 	return &session, nil
 }
 
+// The user a session token belongs to. Returns ErrSessionExpired once the
+// session has passed either of its timeouts, otherwise using the session
+// pushes its idle timeout back
 func (ss *SessionService) User(token string) (*User, error) {
 	user := User{}
 
+	var session Session
 	row := ss.DB.QueryRow(`
-		SELECT users.id, users.email, users.forename, users.surname, users.password_hash
+		SELECT sessions.id, sessions.last_seen_at, sessions.remember,
+			sessions.expires_at, sessions.idle_expires_at,
+			users.id, users.email, users.forename, users.surname, users.password_hash,
+			users.email_verified_at
 		FROM sessions
 		JOIN users ON sessions.user_id = users.id
 		WHERE sessions.token_hash = $1`, ss.hash(token))
 
-	err := row.Scan(&user.ID, &user.Email, &user.Forename, &user.Surname, &user.PasswordHash)
-	if err != nil {
+	err := row.Scan(&session.ID, &session.LastSeenAt, &session.Remember,
+		&session.ExpiresAt, &session.IdleExpiresAt,
+		&user.ID, &user.Email, &user.Forename, &user.Surname, &user.PasswordHash,
+		&user.EmailVerifiedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
 		return nil, fmt.Errorf("user: %w", err)
 	}
 
+	now := time.Now()
+	if now.After(session.ExpiresAt) || now.After(session.IdleExpiresAt) {
+		return nil, ErrSessionExpired
+	}
+
+	if time.Since(session.LastSeenAt) > SessionTouchInterval {
+		_, idle := ss.timeouts(session.Remember)
+		_, err = ss.DB.Exec(`
+			UPDATE sessions
+			SET last_seen_at = NOW(),
+				idle_expires_at = LEAST($2, expires_at)
+			WHERE id = $1;`, session.ID, now.Add(idle))
+		if err != nil {
+			// Not worth failing the request over
+			fmt.Printf("touching session %d: %v\n", session.ID, err)
+		}
+	}
+
 	return &user, nil
 }
 
+// The session a token belongs to
+func (ss *SessionService) Current(token string) (*Session, error) {
+	session := Session{
+		TokenHash: ss.hash(token),
+	}
+
+	row := ss.DB.QueryRow(`
+		SELECT id, user_id, created_at, last_seen_at, user_agent, ip_address,
+			remember, expires_at, idle_expires_at
+		FROM sessions
+		WHERE token_hash = $1;`, session.TokenHash)
+
+	err := row.Scan(&session.ID, &session.UserID, &session.CreatedAt,
+		&session.LastSeenAt, &session.UserAgent, &session.IPAddress,
+		&session.Remember, &session.ExpiresAt, &session.IdleExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("current: %w", err)
+	}
+
+	return &session, nil
+}
+
+// Every session a user has, most recently used first
+func (ss *SessionService) ByUserID(userID int) ([]Session, error) {
+	rows, err := ss.DB.Query(`
+		SELECT id, created_at, last_seen_at, user_agent, ip_address,
+			remember, expires_at, idle_expires_at
+		FROM sessions
+		WHERE user_id = $1
+			AND expires_at > NOW() AND idle_expires_at > NOW()
+		ORDER BY last_seen_at DESC;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("byuserid: %w", err)
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		session := Session{
+			UserID: userID,
+		}
+
+		err := rows.Scan(&session.ID, &session.CreatedAt, &session.LastSeenAt,
+			&session.UserAgent, &session.IPAddress,
+			&session.Remember, &session.ExpiresAt, &session.IdleExpiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("byuserid: %w", err)
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("byuserid: %w", err)
+	}
+
+	return sessions, nil
+}
+
 func (ss *SessionService) Delete(token string) error {
 	tokenHash := ss.hash(token)
 	_, err := ss.DB.Exec(`
@@ -92,3 +249,55 @@ func (ss *SessionService) Delete(token string) error {
 	}
 	return nil
 }
+
+// Revoke one of a user's sessions. The user ID is required so users can
+// only revoke their own sessions
+func (ss *SessionService) DeleteID(userID, id int) error {
+	result, err := ss.DB.Exec(`
+		DELETE FROM sessions
+		WHERE id = $1 AND user_id = $2;`, id, userID)
+	if err != nil {
+		return fmt.Errorf("deleteid: %w", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("deleteid: %w", err)
+	}
+
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// Sign a user out everywhere
+func (ss *SessionService) DeleteAll(userID int) error {
+	_, err := ss.DB.Exec(`
+		DELETE FROM sessions
+		WHERE user_id = $1;`, userID)
+	if err != nil {
+		return fmt.Errorf("deleteall: %w", err)
+	}
+	return nil
+}
+
+// Remove sessions past either of their timeouts, returning how many were
+// removed. Expired sessions are already refused so this just keeps the
+// table small
+func (ss *SessionService) DeleteExpired() (int64, error) {
+	result, err := ss.DB.Exec(`
+		DELETE FROM sessions
+		WHERE expires_at < NOW() OR idle_expires_at < NOW();`)
+	if err != nil {
+		return 0, fmt.Errorf("deleteexpired: %w", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("deleteexpired: %w", err)
+	}
+
+	return n, nil
+}
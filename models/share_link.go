@@ -0,0 +1,224 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"taran1s.share/rand"
+)
+
+const (
+	DefaultShareLinkDuration = 7 * 24 * time.Hour
+)
+
+var ErrShareLinkUsedUp error = fmt.Errorf("Share link has reached its view limit")
+
+// A link that lets anyone holding the token view a gallery, whatever its
+// visibility, until it expires or runs out of views
+type ShareLink struct {
+	ID        int
+	GalleryID int
+	// Only set when created
+	Token     string
+	TokenHash string
+	ExpiresAt time.Time
+	// Zero means unlimited
+	MaxViews  int
+	Views     int
+	CreatedAt time.Time
+}
+
+type ShareLinkService struct {
+	DB            *sql.DB
+	BytesPerToken int
+	Duration      time.Duration
+}
+
+func (service *ShareLinkService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+// Create a share link for a gallery. A zero duration uses the service's
+// Duration and a maxViews of zero means the link can be viewed any number
+// of times before it expires
+func (service *ShareLinkService) Create(galleryID int, duration time.Duration, maxViews int) (*ShareLink, error) {
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+
+	if duration <= 0 {
+		duration = service.Duration
+	}
+	if duration <= 0 {
+		duration = DefaultShareLinkDuration
+	}
+
+	if maxViews < 0 {
+		maxViews = 0
+	}
+
+	link := ShareLink{
+		GalleryID: galleryID,
+		Token:     token,
+		TokenHash: service.hash(token),
+		ExpiresAt: time.Now().Add(duration),
+		MaxViews:  maxViews,
+	}
+
+	row := service.DB.QueryRow(`
+		INSERT INTO share_links (gallery_id, token_hash, expires_at, max_views)
+		VALUES ($1,$2,$3,NULLIF($4, 0))
+		RETURNING id, created_at;`,
+		link.GalleryID, link.TokenHash, link.ExpiresAt, link.MaxViews)
+
+	err = row.Scan(&link.ID, &link.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+
+	return &link, nil
+}
+
+// Every link for a gallery, including expired ones so the owner can see
+// what has been handed out
+func (service *ShareLinkService) ByGalleryID(galleryID int) ([]ShareLink, error) {
+	rows, err := service.DB.Query(`
+		SELECT id, token_hash, expires_at, COALESCE(max_views, 0), views, created_at
+		FROM share_links
+		WHERE gallery_id = $1
+		ORDER BY created_at DESC;`, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("bygalleryid: %w", err)
+	}
+	defer rows.Close()
+
+	var links []ShareLink
+	for rows.Next() {
+		link := ShareLink{
+			GalleryID: galleryID,
+		}
+
+		err := rows.Scan(&link.ID, &link.TokenHash, &link.ExpiresAt,
+			&link.MaxViews, &link.Views, &link.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("bygalleryid: %w", err)
+		}
+
+		links = append(links, link)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("bygalleryid: %w", err)
+	}
+
+	return links, nil
+}
+
+// Revoke a link. The gallery ID is required so a link can only be revoked
+// through the gallery it belongs to
+func (service *ShareLinkService) Delete(galleryID, id int) error {
+	result, err := service.DB.Exec(`
+		DELETE FROM share_links
+		WHERE id = $1 AND gallery_id = $2;`, id, galleryID)
+	if err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (service *ShareLinkService) byToken(token string) (*ShareLink, error) {
+	link := ShareLink{
+		TokenHash: service.hash(token),
+	}
+
+	row := service.DB.QueryRow(`
+		SELECT id, gallery_id, expires_at, COALESCE(max_views, 0), views, created_at
+		FROM share_links
+		WHERE token_hash = $1;`, link.TokenHash)
+
+	err := row.Scan(&link.ID, &link.GalleryID, &link.ExpiresAt,
+		&link.MaxViews, &link.Views, &link.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("bytoken: %w", err)
+	}
+
+	return &link, nil
+}
+
+// Check a token is still usable without counting a view. Used for the
+// images on a shared page, which shouldn't each use up a view. Fails the
+// same way as View once the link has expired or its views are used up
+func (service *ShareLinkService) Check(token string) (*ShareLink, error) {
+	link, err := service.byToken(token)
+	if err != nil {
+		return nil, fmt.Errorf("check: %w", err)
+	}
+
+	if time.Now().After(link.ExpiresAt) {
+		return nil, ErrTokenExpired
+	}
+
+	if link.MaxViews > 0 && link.Views >= link.MaxViews {
+		return nil, ErrShareLinkUsedUp
+	}
+
+	return link, nil
+}
+
+// Record a view of the shared gallery, failing once the link has expired
+// or its views are used up
+func (service *ShareLinkService) View(token string) (*ShareLink, error) {
+	link := ShareLink{
+		TokenHash: service.hash(token),
+	}
+
+	// Checking and counting in one statement stops two simultaneous views
+	// both squeezing through the last remaining view
+	row := service.DB.QueryRow(`
+		UPDATE share_links
+		SET views = views + 1
+		WHERE token_hash = $1
+			AND expires_at > NOW()
+			AND (max_views IS NULL OR views < max_views)
+		RETURNING id, gallery_id, expires_at, COALESCE(max_views, 0), views, created_at;`,
+		link.TokenHash)
+
+	err := row.Scan(&link.ID, &link.GalleryID, &link.ExpiresAt,
+		&link.MaxViews, &link.Views, &link.CreatedAt)
+	if err == nil {
+		return &link, nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("view: %w", err)
+	}
+
+	// Work out why the update didn't match
+	_, err = service.Check(token)
+	if err != nil {
+		return nil, fmt.Errorf("view: %w", err)
+	}
+
+	return nil, fmt.Errorf("view: %w", ErrNotFound)
+}
@@ -0,0 +1,147 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"taran1s.share/rand"
+)
+
+const (
+	DefaultSignInLinkDuration = 15 * time.Minute
+)
+
+// A single use link that signs the user in without their password
+type SignInLink struct {
+	ID     int
+	UserID int
+	// Only set when created
+	Token     string
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+type SignInLinkService struct {
+	DB            *sql.DB
+	BytesPerToken int
+	Duration      time.Duration
+}
+
+func (service *SignInLinkService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+// Issue a link for the account with this email address, replacing any
+// earlier one. Returns ErrNotFound if there is no such account and
+// ErrResendTooSoon if a link was sent very recently
+func (service *SignInLinkService) Create(email string) (*SignInLink, error) {
+	email = strings.ToLower(email)
+
+	var userID int
+	row := service.DB.QueryRow(`
+		SELECT id FROM users WHERE email = $1;`, email)
+
+	err := row.Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+
+	duration := service.Duration
+	if duration == 0 {
+		duration = DefaultSignInLinkDuration
+	}
+
+	link := SignInLink{
+		UserID:    userID,
+		Token:     token,
+		TokenHash: service.hash(token),
+		ExpiresAt: time.Now().Add(duration),
+	}
+
+	row = service.DB.QueryRow(`
+		INSERT INTO sign_in_links (user_id, token_hash, expires_at)
+		VALUES ($1,$2,$3) ON CONFLICT (user_id) DO
+		UPDATE
+		SET token_hash = $2, created_at = NOW(), expires_at = $3
+		WHERE sign_in_links.created_at < $4
+		RETURNING id;`, link.UserID, link.TokenHash, link.ExpiresAt,
+		time.Now().Add(-MinResendInterval))
+
+	err = row.Scan(&link.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrResendTooSoon
+	} else if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+
+	return &link, nil
+}
+
+// The user a link belongs to, without using it up. Email scanners open
+// links to check them, so only Consume signs anyone in
+func (service *SignInLinkService) User(token string) (*User, error) {
+	var user User
+	var expiresAt time.Time
+	row := service.DB.QueryRow(`
+		SELECT users.id, users.email, sign_in_links.expires_at
+		FROM sign_in_links
+			JOIN users ON users.id = sign_in_links.user_id
+		WHERE sign_in_links.token_hash = $1;`, service.hash(token))
+
+	err := row.Scan(&user.ID, &user.Email, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("user: %w", err)
+	}
+
+	if time.Now().After(expiresAt) {
+		return nil, ErrTokenExpired
+	}
+
+	return &user, nil
+}
+
+// Use up a link, returning the user it signs in. The email address comes
+// back too as signing in resets the throttle kept against it
+func (service *SignInLinkService) Consume(token string) (*User, error) {
+	var user User
+	var expiresAt time.Time
+	row := service.DB.QueryRow(`
+		DELETE FROM sign_in_links
+		USING users
+		WHERE sign_in_links.token_hash = $1 AND users.id = sign_in_links.user_id
+		RETURNING users.id, users.email, users.forename, users.surname,
+			sign_in_links.expires_at;`, service.hash(token))
+
+	err := row.Scan(&user.ID, &user.Email, &user.Forename, &user.Surname, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("consume: %w", err)
+	}
+
+	if time.Now().After(expiresAt) {
+		return nil, ErrTokenExpired
+	}
+
+	return &user, nil
+}
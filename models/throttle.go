@@ -0,0 +1,608 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrAccountLocked = errors.New("This account is temporarily locked after too many failed sign in attempts")
+
+// Returned when a throttle turns a request away. Err is ErrTooManyAttempts
+// or ErrAccountLocked
+type ThrottleError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *ThrottleError) Error() string {
+	return fmt.Sprintf("%s (retry in %s)", e.Err, e.RetryAfter.Round(time.Second))
+}
+
+func (e *ThrottleError) Unwrap() error {
+	return e.Err
+}
+
+// How many attempts a single key gets and what happens after that
+type ThrottlePolicy struct {
+	// Attempts allowed before delays start
+	FreeAttempts int
+	// The wait after the first attempt over FreeAttempts. It doubles with
+	// each attempt after that, up to MaxDelay. Without a MaxDelay it stays
+	// at BaseDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Attempts that lock the key for LockFor, 0 never locks
+	LockAfter int
+	LockFor   time.Duration
+	// Attempts older than this are forgotten
+	Window time.Duration
+}
+
+// How long to wait after the given number of attempts
+func (policy ThrottlePolicy) delay(attempts int) time.Duration {
+	over := attempts - policy.FreeAttempts
+	if over <= 0 || policy.BaseDelay == 0 {
+		return 0
+	}
+
+	delay := policy.BaseDelay
+	for i := 1; i < over && delay < policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	if policy.MaxDelay > 0 && delay > policy.MaxDelay {
+		delay = policy.MaxDelay
+	}
+	return delay
+}
+
+// Why a key in the given state has to wait before another attempt, or nil
+// if it can go ahead
+func (policy ThrottlePolicy) refuse(state ThrottleState, now time.Time) error {
+	if now.Before(state.LockedUntil) {
+		return &ThrottleError{Err: ErrAccountLocked, RetryAfter: state.LockedUntil.Sub(now)}
+	}
+
+	if now.Sub(state.LastAttempt) > policy.Window {
+		return nil
+	}
+
+	// Reserved attempts count before they fail, so parallel guesses can't
+	// take a key past its lock
+	if policy.LockAfter > 0 && state.Attempts >= policy.LockAfter {
+		return &ThrottleError{Err: ErrAccountLocked, RetryAfter: policy.LockFor}
+	}
+
+	next := state.LastAttempt.Add(policy.delay(state.Attempts))
+	if now.Before(next) {
+		return &ThrottleError{Err: ErrTooManyAttempts, RetryAfter: next.Sub(now)}
+	}
+	return nil
+}
+
+// What a store knows about a key
+type ThrottleState struct {
+	Attempts    int
+	LastAttempt time.Time
+	LockedUntil time.Time
+}
+
+// Where throttles keep their counts. The memory store is fine for a single
+// server, the Postgres store shares counts between several
+type ThrottleStore interface {
+	// Get returns the zero state for unknown or expired keys
+	Get(key string) (ThrottleState, error)
+	// Add counts an attempt, starting again from one if the last attempt
+	// was longer than window ago
+	Add(key string, window time.Duration) (ThrottleState, error)
+	// Reserve is Add for attempts that policy still allows, checked and
+	// counted in one step. Otherwise it returns a *ThrottleError and
+	// counts nothing
+	Reserve(key string, policy ThrottlePolicy) (ThrottleState, error)
+	// Release takes back an attempt counted by Reserve
+	Release(key string) error
+	// Lock stops the key being used until the given time and clears its
+	// attempts
+	Lock(key string, until time.Time) error
+	Reset(key string) error
+	DeleteExpired() (int64, error)
+}
+
+const (
+	ThrottleStoreMemory   = "memory"
+	ThrottleStorePostgres = "postgres"
+)
+
+func NewThrottleStore(backend string, db *sql.DB) (ThrottleStore, error) {
+	switch backend {
+	case "", ThrottleStoreMemory:
+		return &MemoryThrottleStore{}, nil
+	case ThrottleStorePostgres:
+		return &PostgresThrottleStore{DB: db}, nil
+	default:
+		return nil, fmt.Errorf("unknown throttle store %q", backend)
+	}
+}
+
+// Limits attempts at something by email address and by client IP. The
+// email limit protects one account from being guessed at from many
+// addresses, the IP limit stops one client trying many accounts
+type Throttle struct {
+	Store ThrottleStore
+	// Keeps this throttle's keys apart from others sharing the store
+	Name  string
+	Email ThrottlePolicy
+	IP    ThrottlePolicy
+}
+
+// Password guessing. Accounts lock after repeated failures, clients that
+// fail across many accounts are only slowed down as they may be shared
+func NewSignInThrottle(store ThrottleStore) *Throttle {
+	return &Throttle{
+		Store: store,
+		Name:  "signin",
+		Email: ThrottlePolicy{
+			FreeAttempts: 3,
+			BaseDelay:    time.Second,
+			MaxDelay:     time.Minute,
+			LockAfter:    10,
+			LockFor:      15 * time.Minute,
+			Window:       time.Hour,
+		},
+		IP: ThrottlePolicy{
+			FreeAttempts: 20,
+			BaseDelay:    time.Second,
+			MaxDelay:     5 * time.Minute,
+			Window:       time.Hour,
+		},
+	}
+}
+
+// Reset emails, so the form can't be used to flood someone's inbox
+func NewForgotPasswordThrottle(store ThrottleStore) *Throttle {
+	return &Throttle{
+		Store: store,
+		Name:  "forgotpw",
+		Email: ThrottlePolicy{
+			FreeAttempts: 3,
+			BaseDelay:    time.Minute,
+			MaxDelay:     time.Hour,
+			Window:       24 * time.Hour,
+		},
+		IP: ThrottlePolicy{
+			FreeAttempts: 10,
+			BaseDelay:    time.Second,
+			MaxDelay:     10 * time.Minute,
+			Window:       time.Hour,
+		},
+	}
+}
+
+func normaliseEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func (throttle *Throttle) emailKey(email string) string {
+	return throttle.Name + ":email:" + normaliseEmail(email)
+}
+
+func (throttle *Throttle) ipKey(ip string) string {
+	return throttle.Name + ":ip:" + ip
+}
+
+// Returns a *ThrottleError if the client has to wait before trying again
+func (throttle *Throttle) Check(ip, email string) error {
+	now := time.Now()
+
+	keys := []struct {
+		key    string
+		policy ThrottlePolicy
+	}{
+		{throttle.emailKey(email), throttle.Email},
+		{throttle.ipKey(ip), throttle.IP},
+	}
+
+	for _, k := range keys {
+		state, err := throttle.Store.Get(k.key)
+		if err != nil {
+			return fmt.Errorf("check: %w", err)
+		}
+
+		err = k.policy.refuse(state, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Count an attempt against the email address and IP before it is checked,
+// or return a *ThrottleError if the client has to wait. Checking and
+// counting together means a burst of parallel guesses can't all get in
+// before the first is counted. A right answer should be released, a wrong
+// one passed to Fail
+func (throttle *Throttle) Reserve(ip, email string) error {
+	emailKey := throttle.emailKey(email)
+	_, err := throttle.Store.Reserve(emailKey, throttle.Email)
+	if err != nil {
+		return fmt.Errorf("reserve: %w", err)
+	}
+
+	_, err = throttle.Store.Reserve(throttle.ipKey(ip), throttle.IP)
+	if err != nil {
+		// Nothing was tried, so it doesn't count against the account
+		releaseErr := throttle.Store.Release(emailKey)
+		return fmt.Errorf("reserve: %w", errors.Join(err, releaseErr))
+	}
+
+	return nil
+}
+
+// Take back a reserved attempt that turned out to be right
+func (throttle *Throttle) Release(ip, email string) error {
+	err := throttle.Store.Release(throttle.emailKey(email))
+	if err != nil {
+		return fmt.Errorf("release: %w", err)
+	}
+
+	err = throttle.Store.Release(throttle.ipKey(ip))
+	if err != nil {
+		return fmt.Errorf("release: %w", err)
+	}
+	return nil
+}
+
+// Keep a reserved attempt that turned out to be wrong, locking the email
+// address once it has had too many. Returns true when this attempt locked
+// it
+func (throttle *Throttle) Fail(email string) (bool, error) {
+	if throttle.Email.LockAfter == 0 {
+		return false, nil
+	}
+
+	key := throttle.emailKey(email)
+	state, err := throttle.Store.Get(key)
+	if err != nil {
+		return false, fmt.Errorf("fail: %w", err)
+	}
+	if state.Attempts < throttle.Email.LockAfter {
+		return false, nil
+	}
+
+	err = throttle.Store.Lock(key, time.Now().Add(throttle.Email.LockFor))
+	if err != nil {
+		return false, fmt.Errorf("fail: %w", err)
+	}
+	return true, nil
+}
+
+// Count an attempt against the email address and IP. Returns true when
+// this attempt locked the email address
+func (throttle *Throttle) Add(ip, email string) (bool, error) {
+	_, err := throttle.Store.Add(throttle.ipKey(ip), throttle.IP.Window)
+	if err != nil {
+		return false, fmt.Errorf("add: %w", err)
+	}
+
+	key := throttle.emailKey(email)
+	state, err := throttle.Store.Add(key, throttle.Email.Window)
+	if err != nil {
+		return false, fmt.Errorf("add: %w", err)
+	}
+
+	if throttle.Email.LockAfter == 0 || state.Attempts < throttle.Email.LockAfter {
+		return false, nil
+	}
+
+	err = throttle.Store.Lock(key, time.Now().Add(throttle.Email.LockFor))
+	if err != nil {
+		return false, fmt.Errorf("add: %w", err)
+	}
+	return true, nil
+}
+
+// Forget the attempts against an email address, after a successful sign in.
+// The IP count is kept so an attacker can't clear it by signing in to an
+// account of their own between guesses
+func (throttle *Throttle) Reset(email string) error {
+	err := throttle.Store.Reset(throttle.emailKey(email))
+	if err != nil {
+		return fmt.Errorf("reset: %w", err)
+	}
+	return nil
+}
+
+type memoryThrottleEntry struct {
+	state     ThrottleState
+	expiresAt time.Time
+}
+
+// Keeps counts in this process, they are lost on restart
+type MemoryThrottleStore struct {
+	mu      sync.Mutex
+	entries map[string]*memoryThrottleEntry
+}
+
+func (store *MemoryThrottleStore) Get(key string) (ThrottleState, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	entry, ok := store.entries[key]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return ThrottleState{}, nil
+	}
+	return entry.state, nil
+}
+
+func (store *MemoryThrottleStore) Add(key string, window time.Duration) (ThrottleState, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	entry := store.entry(key)
+	entry.count(time.Now(), window)
+	return entry.state, nil
+}
+
+func (store *MemoryThrottleStore) Reserve(key string, policy ThrottlePolicy) (ThrottleState, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	entry := store.entry(key)
+	if now.After(entry.expiresAt) {
+		entry.state = ThrottleState{}
+	}
+
+	err := policy.refuse(entry.state, now)
+	if err != nil {
+		return entry.state, err
+	}
+
+	entry.count(now, policy.Window)
+	return entry.state, nil
+}
+
+func (store *MemoryThrottleStore) Release(key string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	entry, ok := store.entries[key]
+	if ok && entry.state.Attempts > 0 {
+		entry.state.Attempts--
+	}
+	return nil
+}
+
+// The entry for key, added if it's new. Callers hold mu
+func (store *MemoryThrottleStore) entry(key string) *memoryThrottleEntry {
+	if store.entries == nil {
+		store.entries = map[string]*memoryThrottleEntry{}
+	}
+
+	entry, ok := store.entries[key]
+	if !ok {
+		entry = &memoryThrottleEntry{}
+		store.entries[key] = entry
+	}
+	return entry
+}
+
+func (entry *memoryThrottleEntry) count(now time.Time, window time.Duration) {
+	if now.Sub(entry.state.LastAttempt) > window {
+		entry.state.Attempts = 0
+	}
+	entry.state.Attempts++
+	entry.state.LastAttempt = now
+
+	entry.expiresAt = now.Add(window)
+	if entry.state.LockedUntil.After(entry.expiresAt) {
+		entry.expiresAt = entry.state.LockedUntil
+	}
+}
+
+func (store *MemoryThrottleStore) Lock(key string, until time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	entry, ok := store.entries[key]
+	if !ok {
+		return nil
+	}
+
+	entry.state.Attempts = 0
+	entry.state.LockedUntil = until
+	if until.After(entry.expiresAt) {
+		entry.expiresAt = until
+	}
+	return nil
+}
+
+func (store *MemoryThrottleStore) Reset(key string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	delete(store.entries, key)
+	return nil
+}
+
+func (store *MemoryThrottleStore) DeleteExpired() (int64, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var n int64
+	now := time.Now()
+	for key, entry := range store.entries {
+		if now.After(entry.expiresAt) {
+			delete(store.entries, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Keeps counts in the login_throttles table so every server sees them
+type PostgresThrottleStore struct {
+	DB *sql.DB
+}
+
+func (store *PostgresThrottleStore) Get(key string) (ThrottleState, error) {
+	var state ThrottleState
+	var lockedUntil sql.NullTime
+
+	row := store.DB.QueryRow(`
+		SELECT attempts, last_attempt_at, locked_until
+		FROM login_throttles
+		WHERE key = $1 AND expires_at > $2;`, key, time.Now())
+
+	err := row.Scan(&state.Attempts, &state.LastAttempt, &lockedUntil)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ThrottleState{}, nil
+	} else if err != nil {
+		return state, fmt.Errorf("get: %w", err)
+	}
+	state.LockedUntil = lockedUntil.Time
+
+	return state, nil
+}
+
+func (store *PostgresThrottleStore) Add(key string, window time.Duration) (ThrottleState, error) {
+	var state ThrottleState
+	var lockedUntil sql.NullTime
+	now := time.Now()
+
+	row := store.DB.QueryRow(`
+		INSERT INTO login_throttles (key, attempts, last_attempt_at, expires_at)
+		VALUES ($1, 1, $2, $3)
+		ON CONFLICT (key) DO UPDATE
+		SET attempts = CASE
+				WHEN login_throttles.last_attempt_at < $4 THEN 1
+				ELSE login_throttles.attempts + 1
+			END,
+			last_attempt_at = $2,
+			expires_at = GREATEST($3, login_throttles.locked_until)
+		RETURNING attempts, last_attempt_at, locked_until;`,
+		key, now, now.Add(window), now.Add(-window))
+
+	err := row.Scan(&state.Attempts, &state.LastAttempt, &lockedUntil)
+	if err != nil {
+		return state, fmt.Errorf("add: %w", err)
+	}
+	state.LockedUntil = lockedUntil.Time
+
+	return state, nil
+}
+
+// The row is locked while the policy is checked, so parallel reservations
+// for a key take turns
+func (store *PostgresThrottleStore) Reserve(key string, policy ThrottlePolicy) (ThrottleState, error) {
+	tx, err := store.DB.Begin()
+	if err != nil {
+		return ThrottleState{}, fmt.Errorf("reserve: %w", err)
+	}
+	defer tx.Rollback()
+
+	// There has to be a row to lock. A new one looks expired, and goes
+	// again with the rollback if the attempt is refused
+	now := time.Now()
+	_, err = tx.Exec(`
+		INSERT INTO login_throttles (key, attempts, last_attempt_at, expires_at)
+		VALUES ($1, 0, $2, $2)
+		ON CONFLICT (key) DO NOTHING;`, key, now)
+	if err != nil {
+		return ThrottleState{}, fmt.Errorf("reserve: %w", err)
+	}
+
+	var state ThrottleState
+	var lockedUntil sql.NullTime
+	var expiresAt time.Time
+	row := tx.QueryRow(`
+		SELECT attempts, last_attempt_at, locked_until, expires_at
+		FROM login_throttles
+		WHERE key = $1
+		FOR UPDATE;`, key)
+	err = row.Scan(&state.Attempts, &state.LastAttempt, &lockedUntil, &expiresAt)
+	if err != nil {
+		return state, fmt.Errorf("reserve: %w", err)
+	}
+	state.LockedUntil = lockedUntil.Time
+	if !now.Before(expiresAt) {
+		state = ThrottleState{}
+	}
+
+	err = policy.refuse(state, now)
+	if err != nil {
+		return state, err
+	}
+
+	if now.Sub(state.LastAttempt) > policy.Window {
+		state.Attempts = 0
+	}
+	state.Attempts++
+	state.LastAttempt = now
+	expiresAt = now.Add(policy.Window)
+	if state.LockedUntil.After(expiresAt) {
+		expiresAt = state.LockedUntil
+	}
+
+	_, err = tx.Exec(`
+		UPDATE login_throttles
+		SET attempts = $2, last_attempt_at = $3, locked_until = $4, expires_at = $5
+		WHERE key = $1;`, key, state.Attempts, state.LastAttempt,
+		sql.NullTime{Time: state.LockedUntil, Valid: !state.LockedUntil.IsZero()}, expiresAt)
+	if err != nil {
+		return state, fmt.Errorf("reserve: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return state, fmt.Errorf("reserve: %w", err)
+	}
+	return state, nil
+}
+
+func (store *PostgresThrottleStore) Release(key string) error {
+	_, err := store.DB.Exec(`
+		UPDATE login_throttles
+		SET attempts = GREATEST(attempts - 1, 0)
+		WHERE key = $1;`, key)
+	if err != nil {
+		return fmt.Errorf("release: %w", err)
+	}
+	return nil
+}
+
+func (store *PostgresThrottleStore) Lock(key string, until time.Time) error {
+	_, err := store.DB.Exec(`
+		UPDATE login_throttles
+		SET attempts = 0, locked_until = $2, expires_at = GREATEST(expires_at, $2)
+		WHERE key = $1;`, key, until)
+	if err != nil {
+		return fmt.Errorf("lock: %w", err)
+	}
+	return nil
+}
+
+func (store *PostgresThrottleStore) Reset(key string) error {
+	_, err := store.DB.Exec(`
+		DELETE FROM login_throttles
+		WHERE key = $1;`, key)
+	if err != nil {
+		return fmt.Errorf("reset: %w", err)
+	}
+	return nil
+}
+
+func (store *PostgresThrottleStore) DeleteExpired() (int64, error) {
+	result, err := store.DB.Exec(`
+		DELETE FROM login_throttles
+		WHERE expires_at < NOW();`)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired: %w", err)
+	}
+
+	return result.RowsAffected()
+}
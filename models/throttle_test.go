@@ -0,0 +1,388 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestThrottlePolicyDelay(t *testing.T) {
+	policy := ThrottlePolicy{FreeAttempts: 3, BaseDelay: time.Second, MaxDelay: time.Minute}
+
+	tests := map[string]struct {
+		policy   ThrottlePolicy
+		attempts int
+		want     time.Duration
+	}{
+		"no attempts":         {policy: policy, attempts: 0},
+		"last free attempt":   {policy: policy, attempts: 3},
+		"first over":          {policy: policy, attempts: 4, want: time.Second},
+		"second over":         {policy: policy, attempts: 5, want: 2 * time.Second},
+		"doubles":             {policy: policy, attempts: 9, want: 32 * time.Second},
+		"capped":              {policy: policy, attempts: 10, want: time.Minute},
+		"stays capped":        {policy: policy, attempts: 1000, want: time.Minute},
+		"no delay configured": {policy: ThrottlePolicy{FreeAttempts: 1}, attempts: 5},
+		"no maximum": {
+			policy:   ThrottlePolicy{BaseDelay: time.Second},
+			attempts: 5,
+			want:     time.Second,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := tc.policy.delay(tc.attempts); got != tc.want {
+				t.Errorf("delay(%d) = %v, want %v", tc.attempts, got, tc.want)
+			}
+		})
+	}
+}
+
+// The wait a throttle asked for, failing unless it was for the reason
+// given and about as long as expected
+func checkThrottled(t *testing.T, err, want error, retryAfter time.Duration) {
+	t.Helper()
+
+	var throttleErr *ThrottleError
+	if !errors.As(err, &throttleErr) || !errors.Is(err, want) {
+		t.Fatalf("Check() err = %v, want %v", err, want)
+	}
+	if throttleErr.RetryAfter > retryAfter || throttleErr.RetryAfter < retryAfter-time.Minute/2 {
+		t.Errorf("RetryAfter = %v, want about %v", throttleErr.RetryAfter, retryAfter)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	throttle := &Throttle{
+		Store: &MemoryThrottleStore{},
+		Name:  "test",
+		Email: ThrottlePolicy{
+			FreeAttempts: 2,
+			BaseDelay:    time.Minute,
+			MaxDelay:     time.Hour,
+			LockAfter:    5,
+			LockFor:      15 * time.Minute,
+			Window:       time.Hour,
+		},
+		IP: ThrottlePolicy{
+			FreeAttempts: 3,
+			BaseDelay:    time.Minute,
+			MaxDelay:     time.Hour,
+			Window:       time.Hour,
+		},
+	}
+
+	add := func(ip, email string, wantLocked bool) {
+		t.Helper()
+		locked, err := throttle.Add(ip, email)
+		if err != nil {
+			t.Fatalf("Add() err = %v", err)
+		}
+		if locked != wantLocked {
+			t.Fatalf("Add() locked = %v, want %v", locked, wantLocked)
+		}
+	}
+
+	// Free attempts go through straight away
+	for i := 0; i < 2; i++ {
+		err := throttle.Check("10.0.0.1", "jo@example.com")
+		if err != nil {
+			t.Fatalf("Check() on free attempt %d err = %v", i+1, err)
+		}
+		add("10.0.0.1", "jo@example.com", false)
+	}
+	err := throttle.Check("10.0.0.1", "jo@example.com")
+	if err != nil {
+		t.Fatalf("Check() after the free attempts err = %v", err)
+	}
+
+	// Then the account has to wait, whichever address it's tried from
+	add("10.0.0.1", "jo@example.com", false)
+	checkThrottled(t, throttle.Check("10.0.0.1", "jo@example.com"), ErrTooManyAttempts, time.Minute)
+	checkThrottled(t, throttle.Check("10.0.0.2", " Jo@Example.com "), ErrTooManyAttempts, time.Minute)
+
+	// The client can try other accounts until it runs out of its own
+	// attempts
+	err = throttle.Check("10.0.0.1", "sam@example.com")
+	if err != nil {
+		t.Fatalf("Check() for another account err = %v", err)
+	}
+	add("10.0.0.1", "sam@example.com", false)
+	checkThrottled(t, throttle.Check("10.0.0.1", "alex@example.com"), ErrTooManyAttempts, time.Minute)
+
+	// Enough failures lock the account
+	add("10.0.0.3", "jo@example.com", false)
+	add("10.0.0.4", "jo@example.com", true)
+	checkThrottled(t, throttle.Check("10.0.0.5", "jo@example.com"), ErrAccountLocked, 15*time.Minute)
+
+	// Signing in unlocks the account but not the client
+	err = throttle.Reset("JO@example.com")
+	if err != nil {
+		t.Fatalf("Reset() err = %v", err)
+	}
+	err = throttle.Check("10.0.0.5", "jo@example.com")
+	if err != nil {
+		t.Errorf("Check() after reset err = %v", err)
+	}
+	checkThrottled(t, throttle.Check("10.0.0.1", "jo@example.com"), ErrTooManyAttempts, time.Minute)
+}
+
+func TestThrottleReserve(t *testing.T) {
+	throttle := &Throttle{
+		Store: &MemoryThrottleStore{},
+		Name:  "test",
+		Email: ThrottlePolicy{
+			FreeAttempts: 2,
+			BaseDelay:    time.Minute,
+			MaxDelay:     time.Hour,
+			LockAfter:    3,
+			LockFor:      15 * time.Minute,
+			Window:       time.Hour,
+		},
+		IP: ThrottlePolicy{
+			FreeAttempts: 10,
+			BaseDelay:    time.Minute,
+			Window:       time.Hour,
+		},
+	}
+
+	reserve := func(ip, email string) {
+		t.Helper()
+		err := throttle.Reserve(ip, email)
+		if err != nil {
+			t.Fatalf("Reserve() err = %v", err)
+		}
+	}
+
+	// Right answers are taken back, so they never add up
+	for i := 0; i < 5; i++ {
+		reserve("10.0.0.1", "jo@example.com")
+		err := throttle.Release("10.0.0.1", "jo@example.com")
+		if err != nil {
+			t.Fatalf("Release() err = %v", err)
+		}
+	}
+
+	// Wrong ones are kept
+	for i := 0; i < 2; i++ {
+		reserve("10.0.0.1", "jo@example.com")
+		locked, err := throttle.Fail("jo@example.com")
+		if err != nil || locked {
+			t.Fatalf("Fail() = %v, %v, want not locked", locked, err)
+		}
+	}
+	reserve("10.0.0.2", "jo@example.com")
+
+	// The third attempt hasn't failed yet, but it still counts
+	checkThrottled(t, throttle.Reserve("10.0.0.3", "jo@example.com"), ErrAccountLocked, 15*time.Minute)
+
+	locked, err := throttle.Fail("jo@example.com")
+	if err != nil || !locked {
+		t.Fatalf("Fail() = %v, %v, want locked", locked, err)
+	}
+	checkThrottled(t, throttle.Reserve("10.0.0.3", "jo@example.com"), ErrAccountLocked, 15*time.Minute)
+
+	// Being turned away by the IP limit doesn't count against the account
+	for i := 0; i <= 10; i++ {
+		reserve("10.0.0.9", fmt.Sprintf("user%d@example.com", i))
+	}
+	checkThrottled(t, throttle.Reserve("10.0.0.9", "alex@example.com"), ErrTooManyAttempts, time.Minute)
+	state, err := throttle.Store.Get(throttle.emailKey("alex@example.com"))
+	if err != nil || state.Attempts != 0 {
+		t.Errorf("attempts for an address refused by IP = %+v, %v, want none", state, err)
+	}
+}
+
+// However many guesses arrive at once, only the free attempts get through
+// before the delay starts
+func TestThrottleReserveParallel(t *testing.T) {
+	stores := map[string]func(t *testing.T) ThrottleStore{
+		ThrottleStoreMemory: func(t *testing.T) ThrottleStore {
+			return &MemoryThrottleStore{}
+		},
+		ThrottleStorePostgres: func(t *testing.T) ThrottleStore {
+			return &PostgresThrottleStore{DB: testDB(t)}
+		},
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			throttle := &Throttle{
+				Store: newStore(t),
+				Name:  "test",
+				Email: ThrottlePolicy{
+					FreeAttempts: 3,
+					BaseDelay:    time.Minute,
+					LockAfter:    10,
+					LockFor:      time.Hour,
+					Window:       time.Hour,
+				},
+				IP: ThrottlePolicy{Window: time.Hour},
+			}
+
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			allowed := 0
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					err := throttle.Reserve("10.0.0.1", "jo@example.com")
+					var throttleErr *ThrottleError
+					if err != nil && !errors.As(err, &throttleErr) {
+						t.Errorf("Reserve() err = %v", err)
+						return
+					}
+					if err == nil {
+						mu.Lock()
+						allowed++
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+
+			// As many as would have got through one after another
+			if allowed != 4 {
+				t.Errorf("%d attempts allowed, want 4", allowed)
+			}
+		})
+	}
+}
+
+func TestThrottleStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) ThrottleStore{
+		ThrottleStoreMemory: func(t *testing.T) ThrottleStore {
+			return &MemoryThrottleStore{}
+		},
+		ThrottleStorePostgres: func(t *testing.T) ThrottleStore {
+			return &PostgresThrottleStore{DB: testDB(t)}
+		},
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+
+			state, err := store.Get("jo")
+			if err != nil || state.Attempts != 0 {
+				t.Fatalf("Get() unknown key = %+v, %v, want no attempts", state, err)
+			}
+			err = store.Lock("jo", time.Now().Add(time.Minute))
+			if err != nil {
+				t.Fatalf("Lock() unknown key err = %v", err)
+			}
+
+			for i := 1; i <= 3; i++ {
+				state, err = store.Add("jo", time.Hour)
+				if err != nil {
+					t.Fatalf("Add() err = %v", err)
+				}
+				if state.Attempts != i {
+					t.Errorf("Add() attempts = %d, want %d", state.Attempts, i)
+				}
+			}
+
+			until := time.Now().Add(time.Minute)
+			err = store.Lock("jo", until)
+			if err != nil {
+				t.Fatalf("Lock() err = %v", err)
+			}
+			state, err = store.Get("jo")
+			if err != nil {
+				t.Fatalf("Get() err = %v", err)
+			}
+			if state.Attempts != 0 || state.LockedUntil.Sub(until).Abs() > time.Millisecond {
+				t.Errorf("Get() after lock = %+v, want no attempts and locked until %v", state, until)
+			}
+
+			// Attempts count again from one after the lock
+			state, err = store.Add("jo", time.Hour)
+			if err != nil || state.Attempts != 1 || state.LockedUntil.IsZero() {
+				t.Errorf("Add() after lock = %+v, %v, want one attempt and still locked", state, err)
+			}
+
+			err = store.Reset("jo")
+			if err != nil {
+				t.Fatalf("Reset() err = %v", err)
+			}
+			state, err = store.Get("jo")
+			if err != nil || state != (ThrottleState{}) {
+				t.Errorf("Get() after reset = %+v, %v, want the zero state", state, err)
+			}
+
+			// An attempt whose window has already passed is forgotten
+			_, err = store.Add("sam", -time.Minute)
+			if err != nil {
+				t.Fatalf("Add() err = %v", err)
+			}
+			state, err = store.Get("sam")
+			if err != nil || state.Attempts != 0 {
+				t.Errorf("Get() expired key = %+v, %v, want no attempts", state, err)
+			}
+			n, err := store.DeleteExpired()
+			if err != nil || n != 1 {
+				t.Errorf("DeleteExpired() = %d, %v, want 1", n, err)
+			}
+
+			// Reserving counts like Add while the policy allows it, and
+			// counts nothing once it doesn't
+			policy := ThrottlePolicy{FreeAttempts: 1, BaseDelay: time.Hour, Window: time.Hour}
+			for i := 1; i <= 2; i++ {
+				state, err = store.Reserve("alex", policy)
+				if err != nil || state.Attempts != i {
+					t.Fatalf("Reserve() = %+v, %v, want %d attempts", state, err, i)
+				}
+			}
+			_, err = store.Reserve("alex", policy)
+			checkThrottled(t, err, ErrTooManyAttempts, time.Hour)
+
+			err = store.Release("alex")
+			if err != nil {
+				t.Fatalf("Release() err = %v", err)
+			}
+			state, err = store.Get("alex")
+			if err != nil || state.Attempts != 1 {
+				t.Errorf("Get() after release = %+v, %v, want one attempt", state, err)
+			}
+
+			// Released right down to nothing, and no further
+			for i := 0; i < 2; i++ {
+				err = store.Release("alex")
+				if err != nil {
+					t.Fatalf("Release() err = %v", err)
+				}
+			}
+			state, err = store.Get("alex")
+			if err != nil || state.Attempts != 0 {
+				t.Errorf("Get() after releasing everything = %+v, %v, want no attempts", state, err)
+			}
+
+			// A locked key can't be reserved
+			err = store.Lock("alex", time.Now().Add(time.Minute))
+			if err != nil {
+				t.Fatalf("Lock() err = %v", err)
+			}
+			_, err = store.Reserve("alex", policy)
+			checkThrottled(t, err, ErrAccountLocked, time.Minute)
+		})
+	}
+}
+
+func TestNewThrottleStore(t *testing.T) {
+	tests := map[string]bool{
+		"":                    true,
+		ThrottleStoreMemory:   true,
+		ThrottleStorePostgres: true,
+		"redis":               false,
+	}
+
+	for backend, wantOK := range tests {
+		_, err := NewThrottleStore(backend, nil)
+		if (err == nil) != wantOK {
+			t.Errorf("NewThrottleStore(%q) err = %v, want ok %v", backend, err, wantOK)
+		}
+	}
+}
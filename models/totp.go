@@ -0,0 +1,373 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"taran1s.share/rand"
+)
+
+const (
+	DefaultTOTPIssuer = "GoShare"
+	// RFC 6238 defaults, which are all most authenticator apps support
+	totpPeriod = 30
+	totpDigits = 6
+	// Accept codes from one step either side of now to allow for clock drift
+	totpSkew         = 1
+	totpSecretBytes  = 20
+	RecoveryCodes    = 10
+	recoveryCodeSize = 10
+)
+
+var (
+	ErrInvalidCode     error = fmt.Errorf("Invalid authentication code")
+	ErrTOTPNotEnrolled error = fmt.Errorf("Two-factor authentication is not set up")
+	ErrTOTPEnabled     error = fmt.Errorf("Two-factor authentication is already enabled")
+	base32NoPadding          = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// A secret waiting to be added to an authenticator app
+type TOTPEnrolment struct {
+	// Base32, for typing into the app by hand
+	Secret string
+	// otpauth:// URI, usually shown as a QR code
+	URI string
+}
+
+// Time-based one-time passwords (RFC 6238) as a second sign in factor, with
+// single use recovery codes for when the user loses their device
+type TOTPService struct {
+	DB *sql.DB
+	// Shown in the user's authenticator app
+	Issuer string
+}
+
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation from RFC 4226
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1_000_000)
+}
+
+func (service *TOTPService) hash(code string) string {
+	codeHash := sha256.Sum256([]byte(code))
+	return base64.URLEncoding.EncodeToString(codeHash[:])
+}
+
+// Recovery codes are compared without dashes, spaces or case so they can be
+// typed however the user likes
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToUpper(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
+
+// Whether the user has confirmed two-factor authentication
+func (service *TOTPService) Enabled(userID int) (bool, error) {
+	var enabled bool
+	row := service.DB.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM user_totp
+			WHERE user_id = $1 AND confirmed_at IS NOT NULL
+		);`, userID)
+
+	err := row.Scan(&enabled)
+	if err != nil {
+		return false, fmt.Errorf("enabled: %w", err)
+	}
+
+	return enabled, nil
+}
+
+func (service *TOTPService) enrolment(user *User, secret string) *TOTPEnrolment {
+	issuer := service.Issuer
+	if issuer == "" {
+		issuer = DefaultTOTPIssuer
+	}
+
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+
+	uri := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + user.Email,
+		RawQuery: query.Encode(),
+	}
+
+	return &TOTPEnrolment{
+		Secret: secret,
+		URI:    uri.String(),
+	}
+}
+
+// Start setting up two-factor authentication with a fresh secret. Nothing
+// changes for the user until they Confirm a code from it
+func (service *TOTPService) Begin(user *User) (*TOTPEnrolment, error) {
+	secretBytes, err := rand.Bytes(totpSecretBytes)
+	if err != nil {
+		return nil, fmt.Errorf("begin: %w", err)
+	}
+	secret := base32NoPadding.EncodeToString(secretBytes)
+
+	result, err := service.DB.Exec(`
+		INSERT INTO user_totp (user_id, secret)
+		VALUES ($1,$2) ON CONFLICT (user_id) DO
+		UPDATE
+		SET secret = $2, last_used_step = 0
+		WHERE user_totp.confirmed_at IS NULL;`, user.ID, secret)
+	if err != nil {
+		return nil, fmt.Errorf("begin: %w", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("begin: %w", err)
+	}
+
+	if n == 0 {
+		return nil, ErrTOTPEnabled
+	}
+
+	return service.enrolment(user, secret), nil
+}
+
+// The secret from Begin that is still waiting to be confirmed
+func (service *TOTPService) Pending(user *User) (*TOTPEnrolment, error) {
+	var secret string
+	row := service.DB.QueryRow(`
+		SELECT secret FROM user_totp
+		WHERE user_id = $1 AND confirmed_at IS NULL;`, user.ID)
+
+	err := row.Scan(&secret)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrTOTPNotEnrolled
+	} else if err != nil {
+		return nil, fmt.Errorf("pending: %w", err)
+	}
+
+	return service.enrolment(user, secret), nil
+}
+
+// Check a code from the secret started by Begin and switch two-factor
+// authentication on. Returns the user's recovery codes, which are only
+// stored hashed and so can't be shown again
+func (service *TOTPService) Confirm(userID int, code string) ([]string, error) {
+	err := service.checkTOTP(userID, code, false)
+	if err != nil {
+		return nil, fmt.Errorf("confirm: %w", err)
+	}
+
+	_, err = service.DB.Exec(`
+		UPDATE user_totp
+		SET confirmed_at = NOW()
+		WHERE user_id = $1;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("confirm: %w", err)
+	}
+
+	codes, err := service.RegenerateRecoveryCodes(userID)
+	if err != nil {
+		return nil, fmt.Errorf("confirm: %w", err)
+	}
+
+	return codes, nil
+}
+
+// Check a code from the user's authenticator app or one of their recovery
+// codes, which is used up. Returns ErrInvalidCode if neither matches
+func (service *TOTPService) Verify(userID int, code string) error {
+	err := service.checkTOTP(userID, code, true)
+	if err == nil || !errors.Is(err, ErrInvalidCode) {
+		return err
+	}
+
+	result, err := service.DB.Exec(`
+		UPDATE recovery_codes
+		SET used_at = NOW()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL;`,
+		userID, service.hash(normalizeRecoveryCode(code)))
+	if err != nil {
+		return fmt.Errorf("verify: %w", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("verify: %w", err)
+	}
+
+	if n == 0 {
+		return ErrInvalidCode
+	}
+
+	return nil
+}
+
+// Check a code against the user's secret, confirmed or not as requested.
+// A code is accepted at most once so one seen over someone's shoulder
+// can't be reused
+func (service *TOTPService) checkTOTP(userID int, code string, confirmed bool) error {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totpDigits {
+		return ErrInvalidCode
+	}
+
+	var secret string
+	var lastUsedStep int64
+	row := service.DB.QueryRow(`
+		SELECT secret, last_used_step FROM user_totp
+		WHERE user_id = $1 AND (confirmed_at IS NOT NULL) = $2;`, userID, confirmed)
+
+	err := row.Scan(&secret, &lastUsedStep)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrTOTPNotEnrolled
+	} else if err != nil {
+		return fmt.Errorf("check totp: %w", err)
+	}
+
+	secretBytes, err := base32NoPadding.DecodeString(secret)
+	if err != nil {
+		return fmt.Errorf("check totp: %w", err)
+	}
+
+	now := time.Now().Unix() / totpPeriod
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step <= lastUsedStep ||
+			!hmac.Equal([]byte(totpCode(secretBytes, step)), []byte(code)) {
+			continue
+		}
+
+		// The condition makes two requests racing with the same code
+		// accept it only once
+		result, err := service.DB.Exec(`
+			UPDATE user_totp
+			SET last_used_step = $2
+			WHERE user_id = $1 AND last_used_step < $2;`, userID, step)
+		if err != nil {
+			return fmt.Errorf("check totp: %w", err)
+		}
+
+		n, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("check totp: %w", err)
+		}
+
+		if n == 0 {
+			return ErrInvalidCode
+		}
+		return nil
+	}
+
+	return ErrInvalidCode
+}
+
+// Replace the user's recovery codes with a new set, returning them in the
+// form they should be shown
+func (service *TOTPService) RegenerateRecoveryCodes(userID int) ([]string, error) {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("regenerate recovery codes: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		DELETE FROM recovery_codes
+		WHERE user_id = $1;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("regenerate recovery codes: %w", err)
+	}
+
+	var codes []string
+	for i := 0; i < RecoveryCodes; i++ {
+		b, err := rand.Bytes(recoveryCodeSize)
+		if err != nil {
+			return nil, fmt.Errorf("regenerate recovery codes: %w", err)
+		}
+
+		// 16 characters, shown in groups of four
+		code := base32NoPadding.EncodeToString(b)
+		codes = append(codes, code[0:4]+"-"+code[4:8]+"-"+code[8:12]+"-"+code[12:16])
+
+		_, err = tx.Exec(`
+			INSERT INTO recovery_codes (user_id, code_hash)
+			VALUES ($1,$2);`, userID, service.hash(code))
+		if err != nil {
+			return nil, fmt.Errorf("regenerate recovery codes: %w", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("regenerate recovery codes: %w", err)
+	}
+
+	return codes, nil
+}
+
+// How many unused recovery codes the user has left
+func (service *TOTPService) RecoveryCodesLeft(userID int) (int, error) {
+	var n int
+	row := service.DB.QueryRow(`
+		SELECT COUNT(*) FROM recovery_codes
+		WHERE user_id = $1 AND used_at IS NULL;`, userID)
+
+	err := row.Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("recovery codes left: %w", err)
+	}
+
+	return n, nil
+}
+
+// Switch two-factor authentication off and throw away the secret and
+// recovery codes
+func (service *TOTPService) Disable(userID int) error {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("disable: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		DELETE FROM user_totp
+		WHERE user_id = $1;`, userID)
+	if err != nil {
+		return fmt.Errorf("disable: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM recovery_codes
+		WHERE user_id = $1;`, userID)
+	if err != nil {
+		return fmt.Errorf("disable: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("disable: %w", err)
+	}
+
+	return nil
+}
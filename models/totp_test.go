@@ -0,0 +1,156 @@
+package models
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The SHA-1 test vectors from RFC 6238, cut to six digits
+func TestTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+
+	tests := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+
+	for unix, want := range tests {
+		if got := totpCode(secret, unix/totpPeriod); got != want {
+			t.Errorf("totpCode at %d = %q, want %q", unix, got, want)
+		}
+	}
+}
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	tests := map[string]string{
+		"ABCD-EFGH-IJKL-MNOP":   "ABCDEFGHIJKLMNOP",
+		"abcd-efgh-ijkl-mnop":   "ABCDEFGHIJKLMNOP",
+		"abcd efgh ijkl mnop":   "ABCDEFGHIJKLMNOP",
+		"ABCDEFGHIJKLMNOP":      "ABCDEFGHIJKLMNOP",
+		" ab-cd efgh-ijklmnop ": "ABCDEFGHIJKLMNOP",
+	}
+
+	for code, want := range tests {
+		if got := normalizeRecoveryCode(code); got != want {
+			t.Errorf("normalizeRecoveryCode(%q) = %q, want %q", code, got, want)
+		}
+	}
+}
+
+func TestTOTPEnrolmentURI(t *testing.T) {
+	service := &TOTPService{Issuer: "Share"}
+	enrolment := service.enrolment(&User{Email: "jo@example.com"}, "JBSWY3DPEHPK3PXP")
+
+	uri, err := url.Parse(enrolment.URI)
+	if err != nil {
+		t.Fatalf("parsing %q: %v", enrolment.URI, err)
+	}
+	if uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Path != "/Share:jo@example.com" {
+		t.Errorf("URI = %q, want otpauth://totp/Share:jo@example.com", enrolment.URI)
+	}
+
+	query := uri.Query()
+	want := map[string]string{
+		"secret":    "JBSWY3DPEHPK3PXP",
+		"issuer":    "Share",
+		"algorithm": "SHA1",
+		"digits":    "6",
+		"period":    "30",
+	}
+	for key, value := range want {
+		if got := query.Get(key); got != value {
+			t.Errorf("URI %s = %q, want %q", key, got, value)
+		}
+	}
+}
+
+// A code from the user's app at the given step
+func testTOTPCode(t *testing.T, secret string, step int64) string {
+	t.Helper()
+	secretBytes, err := base32NoPadding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return totpCode(secretBytes, step)
+}
+
+func TestTOTPVerify(t *testing.T) {
+	db := testDB(t)
+	service := &TOTPService{DB: db}
+	user := testUser(t, db, "jo@example.com")
+
+	enrolment, err := service.Begin(user)
+	if err != nil {
+		t.Fatalf("Begin() err = %v", err)
+	}
+
+	err = service.Verify(user.ID, "000000")
+	if !errors.Is(err, ErrTOTPNotEnrolled) {
+		t.Errorf("Verify() before Confirm err = %v, want ErrTOTPNotEnrolled", err)
+	}
+
+	now := time.Now().Unix() / totpPeriod
+	codes, err := service.Confirm(user.ID, testTOTPCode(t, enrolment.Secret, now))
+	if err != nil {
+		t.Fatalf("Confirm() err = %v", err)
+	}
+	if len(codes) != RecoveryCodes {
+		t.Fatalf("Confirm() gave %d recovery codes, want %d", len(codes), RecoveryCodes)
+	}
+
+	_, err = service.Begin(user)
+	if !errors.Is(err, ErrTOTPEnabled) {
+		t.Errorf("Begin() once enabled err = %v, want ErrTOTPEnabled", err)
+	}
+
+	// In order, as each accepted code moves the last used step on
+	tests := []struct {
+		name    string
+		code    string
+		wantErr error
+	}{
+		{name: "code used to confirm", code: testTOTPCode(t, enrolment.Secret, now), wantErr: ErrInvalidCode},
+		{name: "next step", code: testTOTPCode(t, enrolment.Secret, now+1)},
+		{name: "replayed", code: testTOTPCode(t, enrolment.Secret, now+1), wantErr: ErrInvalidCode},
+		{name: "older step", code: testTOTPCode(t, enrolment.Secret, now), wantErr: ErrInvalidCode},
+		{name: "too far ahead", code: testTOTPCode(t, enrolment.Secret, now+3), wantErr: ErrInvalidCode},
+		{name: "wrong length", code: "12345", wantErr: ErrInvalidCode},
+		{name: "recovery code", code: strings.ToLower(codes[0])},
+		{name: "recovery code reused", code: codes[0], wantErr: ErrInvalidCode},
+		{name: "another recovery code", code: strings.ReplaceAll(codes[1], "-", " ")},
+		{name: "made up recovery code", code: "AAAA-BBBB-CCCC-DDDD", wantErr: ErrInvalidCode},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := service.Verify(user.ID, tc.code)
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("Verify(%q) err = %v, want %v", tc.code, err, tc.wantErr)
+			}
+		})
+	}
+
+	left, err := service.RecoveryCodesLeft(user.ID)
+	if err != nil {
+		t.Fatalf("RecoveryCodesLeft() err = %v", err)
+	}
+	if left != RecoveryCodes-2 {
+		t.Errorf("RecoveryCodesLeft() = %d, want %d", left, RecoveryCodes-2)
+	}
+
+	err = service.Disable(user.ID)
+	if err != nil {
+		t.Fatalf("Disable() err = %v", err)
+	}
+	enabled, err := service.Enabled(user.ID)
+	if err != nil || enabled {
+		t.Errorf("Enabled() after Disable = %v, %v, want false", enabled, err)
+	}
+}
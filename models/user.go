@@ -6,10 +6,10 @@ import (
 	"fmt"
 	"net/mail"
 	"strings"
+	"time"
 
 	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5/pgconn"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // This type stores our user data after authentication
@@ -19,10 +19,37 @@ type User struct {
 	Surname      string
 	Email        string
 	PasswordHash string
+	// Nil until the user follows the link in their verification email
+	EmailVerifiedAt *time.Time
+}
+
+func (u *User) EmailVerified() bool {
+	return u.EmailVerifiedAt != nil
 }
 
 type UserService struct {
 	DB *sql.DB
+	// How passwords are hashed, nil uses bcrypt at the default cost
+	Passwords *PasswordHasher
+	// Rules for new passwords, nil only sets a minimum length
+	Policy *PasswordPolicy
+}
+
+func (us *UserService) passwords() *PasswordHasher {
+	if us.Passwords == nil {
+		return defaultPasswordHasher
+	}
+	return us.Passwords
+}
+
+// Returns an error matching ErrWeakPassword if the password can't be used
+// for the account with this email address
+func (us *UserService) ValidatePassword(email, password string) error {
+	policy := us.Policy
+	if policy == nil {
+		policy = defaultPasswordPolicy
+	}
+	return policy.Check(us.passwords(), email, password)
 }
 
 // This type is used for unauthenticated users during sign in / register
@@ -36,20 +63,6 @@ type NewUser struct {
 	ConfirmPass string
 }
 
-// Helper functions for password hashing
-func getHashedPassword(password string) (string, error) {
-	hashBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		return "", err
-	}
-
-	return string(hashBytes), nil
-}
-
-func checkPassword(hash []byte, password string) bool {
-	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
-}
-
 // Helper to check email is valid format
 func checkEmail(email string) bool {
 	_, err := mail.ParseAddress(email)
@@ -72,7 +85,12 @@ func (us *UserService) Create(nu *NewUser) (*User, error) {
 		return nil, ErrPasswordMatch
 	}
 
-	hash, err := getHashedPassword(nu.Password)
+	err := us.ValidatePassword(nu.Email, nu.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := us.passwords().Hash(nu.Password)
 	if err != nil {
 		return nil, err
 	}
@@ -117,30 +135,143 @@ func (us *UserService) Authenticate(email, password string) (*User, error) {
 
 	err := row.Scan(&user.ID, &user.PasswordHash, &user.Forename, &user.Surname)
 	if errors.Is(sql.ErrNoRows, err) {
+		us.passwords().CheckDummy(password)
 		return nil, ErrInvalidCredentials
 	}
 	if err != nil {
 		return nil, err
 	}
 
-	if !checkPassword([]byte(user.PasswordHash), password) {
+	// Accounts made by signing in with an identity provider have no password
+	if user.PasswordHash == "" {
+		us.passwords().CheckDummy(password)
 		return nil, ErrInvalidCredentials
 	}
 
+	ok, rehash, err := us.passwords().Check(user.PasswordHash, password)
+	if err != nil {
+		return nil, fmt.Errorf("authenticate: %w", err)
+	}
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+
+	// This is the only time we have the password, so hashes made with old
+	// settings are upgraded now. Signing in still works if this fails
+	if rehash {
+		err = us.rehash(user, password)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	return user, nil
+}
+
+// Replace a user's hash with one made with the current settings, unless
+// the password was changed in the meantime
+func (us *UserService) rehash(user *User, password string) error {
+	hash, err := us.passwords().Hash(password)
+	if err != nil {
+		return fmt.Errorf("rehash: %w", err)
+	}
+
+	_, err = us.DB.Exec(`
+		UPDATE users
+		SET password_hash = $2
+		WHERE id = $1 AND password_hash = $3;`, user.ID, hash, user.PasswordHash)
+	if err != nil {
+		return fmt.Errorf("rehash: %w", err)
+	}
+
+	user.PasswordHash = hash
+	return nil
+}
+
+func (us *UserService) ByEmail(email string) (*User, error) {
+	email = strings.ToLower(email)
+
+	user := &User{
+		Email: email,
+	}
+
+	row := us.DB.QueryRow(`
+		SELECT id, forename, surname
+		FROM users
+		WHERE email = $1;`, email)
+
+	err := row.Scan(&user.ID, &user.Forename, &user.Surname)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("byemail: %w", err)
+	}
+
 	return user, nil
 }
 
-func (us *UserService) UpdatePassword(userID int, password string) error {
-	hashedBytes, err := getHashedPassword(password)
+// Check the password of a user who is already signed in, before letting
+// them change something important
+func (us *UserService) VerifyPassword(user *User, password string) error {
+	if user.PasswordHash == "" {
+		return ErrInvalidCredentials
+	}
+
+	ok, _, err := us.passwords().Check(user.PasswordHash, password)
+	if err != nil {
+		return fmt.Errorf("verify password: %w", err)
+	}
+	if !ok {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+func (us *UserService) UpdateName(user *User, forename, surname string) error {
+	forename = strings.TrimSpace(forename)
+	surname = strings.TrimSpace(surname)
+	if forename == "" || surname == "" {
+		return ErrNameRequired
+	}
+
+	_, err := us.DB.Exec(`
+		UPDATE users
+		SET forename = $2, surname = $3
+		WHERE id = $1;`, user.ID, forename, surname)
+	if err != nil {
+		return fmt.Errorf("update name: %w", err)
+	}
+
+	user.Forename = forename
+	user.Surname = surname
+	return nil
+}
+
+// Set a new password for a signed in user, who has to know their current one
+func (us *UserService) ChangePassword(user *User, current, password string) error {
+	err := us.VerifyPassword(user, current)
+	if err != nil {
+		return err
+	}
+
+	return us.UpdatePassword(user, password)
+}
+
+func (us *UserService) UpdatePassword(user *User, password string) error {
+	err := us.ValidatePassword(user.Email, password)
+	if err != nil {
+		return err
+	}
+
+	passwordHash, err := us.passwords().Hash(password)
 	if err != nil {
 		return fmt.Errorf("updatePassword: %w", err)
 	}
 
-	passwordHash := string(hashedBytes)
 	_, err = us.DB.Exec(`
 		UPDATE users
 		SET password_hash = $2
-		WHERE id = $1;`, userID, passwordHash)
+		WHERE id = $1;`, user.ID, passwordHash)
 
 	if err != nil {
 		return fmt.Errorf("updatePassword: %w", err)
@@ -0,0 +1,544 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"taran1s.share/rand"
+)
+
+const (
+	DefaultWebAuthnDisplayName = "GoShare"
+	DefaultCeremonyDuration    = 5 * time.Minute
+
+	// What a ceremony was started for, so a challenge issued for one can't
+	// be answered in another
+	ceremonyRegister     = "register"
+	ceremonySecondFactor = "second_factor"
+	ceremonyPasskey      = "passkey"
+)
+
+var (
+	ErrWebAuthnFailed error = fmt.Errorf("Your security key could not be verified")
+	ErrNoCredentials  error = fmt.Errorf("No security keys or passkeys are set up")
+)
+
+// Relying party settings. The RPID is the domain credentials are bound to
+// and the origins are the full URLs the site is served from
+type WebAuthnConfig struct {
+	RPID          string
+	RPDisplayName string
+	RPOrigins     []string
+}
+
+// A passkey or security key registered to a user
+type WebAuthnCredential struct {
+	ID         int
+	UserID     int
+	Name       string
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+	Credential webauthn.Credential
+}
+
+// WebAuthn registration and sign in ceremonies. Passkeys can be used on
+// their own to sign in, or as a second factor after a password
+type WebAuthnService struct {
+	DB            *sql.DB
+	WebAuthn      *webauthn.WebAuthn
+	BytesPerToken int
+	// How long the user has to answer a challenge
+	Duration time.Duration
+}
+
+func NewWebAuthnService(db *sql.DB, config WebAuthnConfig) (*WebAuthnService, error) {
+	displayName := config.RPDisplayName
+	if displayName == "" {
+		displayName = DefaultWebAuthnDisplayName
+	}
+
+	timeout := webauthn.TimeoutConfig{
+		Enforce:    true,
+		Timeout:    DefaultCeremonyDuration,
+		TimeoutUVD: DefaultCeremonyDuration,
+	}
+
+	wa, err := webauthn.New(&webauthn.Config{
+		RPID:          config.RPID,
+		RPDisplayName: displayName,
+		RPOrigins:     config.RPOrigins,
+		Timeouts: webauthn.TimeoutsConfig{
+			Login:        timeout,
+			Registration: timeout,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("new webauthn service: %w", err)
+	}
+
+	return &WebAuthnService{
+		DB:            db,
+		WebAuthn:      wa,
+		BytesPerToken: 32,
+		Duration:      DefaultCeremonyDuration,
+	}, nil
+}
+
+// The user handle stored on the authenticator. It has to identify the user
+// without giving away anything personal, so the ID is used
+func webAuthnUserHandle(userID int) []byte {
+	handle := make([]byte, 8)
+	binary.BigEndian.PutUint64(handle, uint64(userID))
+	return handle
+}
+
+// Adapts a user and their credentials to the webauthn.User interface
+type webAuthnUser struct {
+	user        *User
+	credentials []WebAuthnCredential
+}
+
+func (wu webAuthnUser) WebAuthnID() []byte {
+	return webAuthnUserHandle(wu.user.ID)
+}
+
+func (wu webAuthnUser) WebAuthnName() string {
+	return wu.user.Email
+}
+
+func (wu webAuthnUser) WebAuthnDisplayName() string {
+	name := strings.TrimSpace(wu.user.Forename + " " + wu.user.Surname)
+	if name == "" {
+		return wu.user.Email
+	}
+	return name
+}
+
+func (wu webAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (wu webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, len(wu.credentials))
+	for i, c := range wu.credentials {
+		credentials[i] = c.Credential
+	}
+	return credentials
+}
+
+func (wu webAuthnUser) descriptors() []protocol.CredentialDescriptor {
+	descriptors := make([]protocol.CredentialDescriptor, len(wu.credentials))
+	for i, c := range wu.credentials {
+		descriptors[i] = c.Credential.Descriptor()
+	}
+	return descriptors
+}
+
+func (service *WebAuthnService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+func (service *WebAuthnService) webAuthnUser(user *User) (webAuthnUser, error) {
+	credentials, err := service.ByUserID(user.ID)
+	if err != nil {
+		return webAuthnUser{}, err
+	}
+
+	return webAuthnUser{user: user, credentials: credentials}, nil
+}
+
+// Store the challenge for a ceremony, returning the token the browser
+// presents to finish it
+func (service *WebAuthnService) begin(userID int, purpose string, session *webauthn.SessionData) (string, error) {
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+
+	duration := service.Duration
+	if duration == 0 {
+		duration = DefaultCeremonyDuration
+	}
+
+	// Passkey sign in happens before we know who the user is
+	var owner *int
+	if userID != 0 {
+		owner = &userID
+	}
+
+	_, err = service.DB.Exec(`
+		INSERT INTO webauthn_ceremonies (user_id, token_hash, purpose, session_data, expires_at)
+		VALUES ($1,$2,$3,$4,$5);`, owner, service.hash(token), purpose, data,
+		time.Now().Add(duration))
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// Take the challenge for a ceremony so it can only be answered once
+func (service *WebAuthnService) finish(token string, userID int, purpose string) (*webauthn.SessionData, error) {
+	var data []byte
+	var expiresAt time.Time
+	row := service.DB.QueryRow(`
+		DELETE FROM webauthn_ceremonies
+		WHERE token_hash = $1 AND purpose = $2
+			AND COALESCE(user_id, 0) = $3
+		RETURNING session_data, expires_at;`, service.hash(token), purpose, userID)
+
+	err := row.Scan(&data, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(expiresAt) {
+		return nil, ErrTokenExpired
+	}
+
+	var session webauthn.SessionData
+	err = json.Unmarshal(data, &session)
+	if err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+// Start registering a new credential. Passkeys are preferred so the user can
+// sign in without a password later, but plain security keys work too
+func (service *WebAuthnService) BeginRegistration(user *User) (*protocol.CredentialCreation, string, error) {
+	wu, err := service.webAuthnUser(user)
+	if err != nil {
+		return nil, "", fmt.Errorf("begin registration: %w", err)
+	}
+
+	creation, session, err := service.WebAuthn.BeginRegistration(wu,
+		webauthn.WithExclusions(wu.descriptors()),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+	)
+	if err != nil {
+		return nil, "", fmt.Errorf("begin registration: %w", err)
+	}
+
+	token, err := service.begin(user.ID, ceremonyRegister, session)
+	if err != nil {
+		return nil, "", fmt.Errorf("begin registration: %w", err)
+	}
+
+	return creation, token, nil
+}
+
+// Check the browser's response to BeginRegistration and save the new
+// credential
+func (service *WebAuthnService) FinishRegistration(user *User, token, name string, response io.Reader) (*WebAuthnCredential, error) {
+	session, err := service.finish(token, user.ID, ceremonyRegister)
+	if err != nil {
+		return nil, fmt.Errorf("finish registration: %w", err)
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBody(response)
+	if err != nil {
+		return nil, fmt.Errorf("finish registration: %w: %w", ErrWebAuthnFailed, err)
+	}
+
+	wu, err := service.webAuthnUser(user)
+	if err != nil {
+		return nil, fmt.Errorf("finish registration: %w", err)
+	}
+
+	credential, err := service.WebAuthn.CreateCredential(wu, *session, parsed)
+	if err != nil {
+		return nil, fmt.Errorf("finish registration: %w: %w", ErrWebAuthnFailed, err)
+	}
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "Passkey"
+	}
+
+	transports := make([]string, len(credential.Transport))
+	for i, t := range credential.Transport {
+		transports[i] = string(t)
+	}
+
+	wc := WebAuthnCredential{
+		UserID:     user.ID,
+		Name:       name,
+		Credential: *credential,
+	}
+
+	row := service.DB.QueryRow(`
+		INSERT INTO webauthn_credentials (user_id, name, credential_id, public_key,
+			attestation_type, transports, aaguid, sign_count, backup_eligible, backup_state)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10)
+		RETURNING id, created_at;`, wc.UserID, wc.Name, credential.ID,
+		credential.PublicKey, credential.AttestationType, strings.Join(transports, ","),
+		credential.Authenticator.AAGUID, int64(credential.Authenticator.SignCount),
+		credential.Flags.BackupEligible, credential.Flags.BackupState)
+
+	err = row.Scan(&wc.ID, &wc.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("finish registration: %w", err)
+	}
+
+	return &wc, nil
+}
+
+// Start a second factor check for a user who has entered their password
+func (service *WebAuthnService) BeginLogin(user *User) (*protocol.CredentialAssertion, string, error) {
+	wu, err := service.webAuthnUser(user)
+	if err != nil {
+		return nil, "", fmt.Errorf("begin login: %w", err)
+	}
+
+	if len(wu.credentials) == 0 {
+		return nil, "", ErrNoCredentials
+	}
+
+	assertion, session, err := service.WebAuthn.BeginLogin(wu,
+		webauthn.WithUserVerification(protocol.VerificationDiscouraged))
+	if err != nil {
+		return nil, "", fmt.Errorf("begin login: %w", err)
+	}
+
+	token, err := service.begin(user.ID, ceremonySecondFactor, session)
+	if err != nil {
+		return nil, "", fmt.Errorf("begin login: %w", err)
+	}
+
+	return assertion, token, nil
+}
+
+func (service *WebAuthnService) FinishLogin(user *User, token string, response io.Reader) error {
+	session, err := service.finish(token, user.ID, ceremonySecondFactor)
+	if err != nil {
+		return fmt.Errorf("finish login: %w", err)
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBody(response)
+	if err != nil {
+		return fmt.Errorf("finish login: %w: %w", ErrWebAuthnFailed, err)
+	}
+
+	wu, err := service.webAuthnUser(user)
+	if err != nil {
+		return fmt.Errorf("finish login: %w", err)
+	}
+
+	credential, err := service.WebAuthn.ValidateLogin(wu, *session, parsed)
+	if err != nil {
+		return fmt.Errorf("finish login: %w: %w", ErrWebAuthnFailed, err)
+	}
+
+	err = service.used(credential)
+	if err != nil {
+		return fmt.Errorf("finish login: %w", err)
+	}
+
+	return nil
+}
+
+// Start a passwordless sign in. The browser offers whichever passkeys it
+// has for this site, so no email address is needed
+func (service *WebAuthnService) BeginPasskeyLogin() (*protocol.CredentialAssertion, string, error) {
+	// The passkey stands in for both factors, so the user has to unlock it
+	// with a PIN or biometric
+	assertion, session, err := service.WebAuthn.BeginDiscoverableLogin(
+		webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		return nil, "", fmt.Errorf("begin passkey login: %w", err)
+	}
+
+	token, err := service.begin(0, ceremonyPasskey, session)
+	if err != nil {
+		return nil, "", fmt.Errorf("begin passkey login: %w", err)
+	}
+
+	return assertion, token, nil
+}
+
+// Check a passkey sign in and return who it belongs to
+func (service *WebAuthnService) FinishPasskeyLogin(token string, response io.Reader) (*User, error) {
+	session, err := service.finish(token, 0, ceremonyPasskey)
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey login: %w", err)
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBody(response)
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey login: %w: %w", ErrWebAuthnFailed, err)
+	}
+
+	var user *User
+	handler := func(rawID, userHandle []byte) (webauthn.User, error) {
+		if len(userHandle) != 8 {
+			return nil, ErrNotFound
+		}
+
+		user = &User{
+			ID: int(binary.BigEndian.Uint64(userHandle)),
+		}
+
+		row := service.DB.QueryRow(`
+			SELECT email, forename, surname
+			FROM users
+			WHERE id = $1;`, user.ID)
+
+		err := row.Scan(&user.Email, &user.Forename, &user.Surname)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		} else if err != nil {
+			return nil, err
+		}
+
+		return service.webAuthnUser(user)
+	}
+
+	credential, err := service.WebAuthn.ValidateDiscoverableLogin(handler, *session, parsed)
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey login: %w: %w", ErrWebAuthnFailed, err)
+	}
+
+	err = service.used(credential)
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey login: %w", err)
+	}
+
+	return user, nil
+}
+
+// Record a successful sign in with a credential. A signature counter that
+// has gone backwards means the key may have been cloned, so it is refused
+func (service *WebAuthnService) used(credential *webauthn.Credential) error {
+	if credential.Authenticator.CloneWarning {
+		return fmt.Errorf("%w: signature counter went backwards", ErrWebAuthnFailed)
+	}
+
+	_, err := service.DB.Exec(`
+		UPDATE webauthn_credentials
+		SET sign_count = $2, backup_state = $3, last_used_at = NOW()
+		WHERE credential_id = $1;`, credential.ID,
+		int64(credential.Authenticator.SignCount), credential.Flags.BackupState)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (service *WebAuthnService) ByUserID(userID int) ([]WebAuthnCredential, error) {
+	rows, err := service.DB.Query(`
+		SELECT id, name, credential_id, public_key, attestation_type, transports,
+			aaguid, sign_count, backup_eligible, backup_state, created_at, last_used_at
+		FROM webauthn_credentials
+		WHERE user_id = $1
+		ORDER BY created_at;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("byuserid: %w", err)
+	}
+	defer rows.Close()
+
+	var credentials []WebAuthnCredential
+	for rows.Next() {
+		wc := WebAuthnCredential{
+			UserID: userID,
+		}
+		var transports string
+		var signCount int64
+		err = rows.Scan(&wc.ID, &wc.Name, &wc.Credential.ID, &wc.Credential.PublicKey,
+			&wc.Credential.AttestationType, &transports, &wc.Credential.Authenticator.AAGUID,
+			&signCount, &wc.Credential.Flags.BackupEligible, &wc.Credential.Flags.BackupState,
+			&wc.CreatedAt, &wc.LastUsedAt)
+		if err != nil {
+			return nil, fmt.Errorf("byuserid: %w", err)
+		}
+
+		wc.Credential.Authenticator.SignCount = uint32(signCount)
+		for _, t := range strings.Split(transports, ",") {
+			if t != "" {
+				wc.Credential.Transport = append(wc.Credential.Transport, protocol.AuthenticatorTransport(t))
+			}
+		}
+
+		credentials = append(credentials, wc)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("byuserid: %w", err)
+	}
+
+	return credentials, nil
+}
+
+// Whether the user has any credentials, in which case signing in with a
+// password needs one of them as a second factor
+func (service *WebAuthnService) Enabled(userID int) (bool, error) {
+	var enabled bool
+	row := service.DB.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM webauthn_credentials WHERE user_id = $1
+		);`, userID)
+
+	err := row.Scan(&enabled)
+	if err != nil {
+		return false, fmt.Errorf("enabled: %w", err)
+	}
+
+	return enabled, nil
+}
+
+func (service *WebAuthnService) Delete(userID, id int) error {
+	result, err := service.DB.Exec(`
+		DELETE FROM webauthn_credentials
+		WHERE id = $1 AND user_id = $2;`, id, userID)
+	if err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// Remove ceremonies that were started but never finished
+func (service *WebAuthnService) DeleteExpired() (int64, error) {
+	result, err := service.DB.Exec(`
+		DELETE FROM webauthn_ceremonies
+		WHERE expires_at < NOW();`)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired: %w", err)
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,581 @@
+package models
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+)
+
+const (
+	testRPID   = "share.example.com"
+	testOrigin = "https://share.example.com"
+)
+
+// Authenticator data flags
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+)
+
+// A software authenticator holding one ES256 credential, standing in for a
+// security key or a platform passkey. It answers whatever challenge it is
+// given, so tests can check what the service does with the answers
+type softAuthenticator struct {
+	t      *testing.T
+	origin string
+	rpID   string
+	key    *ecdsa.PrivateKey
+	id     []byte
+	// Set when registering, and sent back when signing in as passkeys do
+	userHandle []byte
+	signCount  uint32
+	// Whether the user unlocked the authenticator with a PIN or biometric
+	verified bool
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	_, err = crand.Read(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &softAuthenticator{
+		t:        t,
+		origin:   testOrigin,
+		rpID:     testRPID,
+		key:      key,
+		id:       id,
+		verified: true,
+	}
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func (a *softAuthenticator) authenticatorData(flags byte, attested []byte) []byte {
+	if a.verified {
+		flags |= flagUserVerified
+	}
+
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	data := append([]byte{}, rpIDHash[:]...)
+	data = append(data, flags|flagUserPresent)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	return append(data, attested...)
+}
+
+func (a *softAuthenticator) clientData(typ string, challenge []byte) []byte {
+	data, err := json.Marshal(map[string]any{
+		"type":        typ,
+		"challenge":   b64(challenge),
+		"origin":      a.origin,
+		"crossOrigin": false,
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return data
+}
+
+// The body the browser posts after navigator.credentials.create
+func (a *softAuthenticator) create(creation *protocol.CredentialCreation, userID int) []byte {
+	a.t.Helper()
+	a.userHandle = webAuthnUserHandle(userID)
+
+	point, err := a.key.PublicKey.ECDH()
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	raw := point.Bytes()
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  1,
+		XCoord: raw[1:33],
+		YCoord: raw[33:],
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	// AAGUID of zeros, then the credential ID and its public key
+	attested := make([]byte, 16)
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.id)))
+	attested = append(attested, a.id...)
+	attested = append(attested, publicKey...)
+
+	attestation, err := webauthncbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authenticatorData(flagAttested, attested),
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"id":    b64(a.id),
+		"rawId": b64(a.id),
+		"type":  "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    b64(a.clientData("webauthn.create", creation.Response.Challenge)),
+			"attestationObject": b64(attestation),
+		},
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return body
+}
+
+// The body the browser posts after navigator.credentials.get
+func (a *softAuthenticator) get(challenge []byte) []byte {
+	a.t.Helper()
+	a.signCount++
+
+	authData := a.authenticatorData(0, nil)
+	clientData := a.clientData("webauthn.get", challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+
+	signature, err := ecdsa.SignASN1(crand.Reader, a.key, digest[:])
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"id":    b64(a.id),
+		"rawId": b64(a.id),
+		"type":  "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    b64(clientData),
+			"authenticatorData": b64(authData),
+			"signature":         b64(signature),
+			"userHandle":        b64(a.userHandle),
+		},
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return body
+}
+
+func newTestWebAuthnService(t *testing.T) *WebAuthnService {
+	t.Helper()
+
+	db := testDB(t)
+	service, err := NewWebAuthnService(db, WebAuthnConfig{
+		RPID:      testRPID,
+		RPOrigins: []string{testOrigin},
+	})
+	if err != nil {
+		t.Fatalf("NewWebAuthnService() err = %v", err)
+	}
+	return service
+}
+
+// Register the authenticator's credential for user
+func registerSoftAuthenticator(t *testing.T, service *WebAuthnService, user *User, auth *softAuthenticator) *WebAuthnCredential {
+	t.Helper()
+
+	creation, token, err := service.BeginRegistration(user)
+	if err != nil {
+		t.Fatalf("BeginRegistration() err = %v", err)
+	}
+
+	credential, err := service.FinishRegistration(user, token, "Test key", bytes.NewReader(auth.create(creation, user.ID)))
+	if err != nil {
+		t.Fatalf("FinishRegistration() err = %v", err)
+	}
+	return credential
+}
+
+// Checks the software authenticator against the library as the service
+// configures it, which needs no database
+func TestSoftAuthenticator(t *testing.T) {
+	service, err := NewWebAuthnService(nil, WebAuthnConfig{
+		RPID:      testRPID,
+		RPOrigins: []string{testOrigin},
+	})
+	if err != nil {
+		t.Fatalf("NewWebAuthnService() err = %v", err)
+	}
+
+	user := &User{ID: 7, Email: "jo@example.com"}
+	auth := newSoftAuthenticator(t)
+	wu := webAuthnUser{user: user}
+
+	creation, session, err := service.WebAuthn.BeginRegistration(wu)
+	if err != nil {
+		t.Fatalf("BeginRegistration() err = %v", err)
+	}
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(auth.create(creation, user.ID)))
+	if err != nil {
+		t.Fatalf("parsing registration: %v", err)
+	}
+	credential, err := service.WebAuthn.CreateCredential(wu, *session, parsed)
+	if err != nil {
+		t.Fatalf("CreateCredential() err = %v", err)
+	}
+	if !bytes.Equal(credential.ID, auth.id) {
+		t.Errorf("credential ID = %x, want %x", credential.ID, auth.id)
+	}
+
+	wu.credentials = []WebAuthnCredential{{UserID: user.ID, Credential: *credential}}
+	assertion, session, err := service.WebAuthn.BeginLogin(wu)
+	if err != nil {
+		t.Fatalf("BeginLogin() err = %v", err)
+	}
+	assertionResponse, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(auth.get(assertion.Response.Challenge)))
+	if err != nil {
+		t.Fatalf("parsing assertion: %v", err)
+	}
+	_, err = service.WebAuthn.ValidateLogin(wu, *session, assertionResponse)
+	if err != nil {
+		t.Fatalf("ValidateLogin() err = %v", err)
+	}
+}
+
+func TestWebAuthnRegistration(t *testing.T) {
+	service := newTestWebAuthnService(t)
+	user := testUser(t, service.DB, "jo@example.com")
+
+	enabled, err := service.Enabled(user.ID)
+	if err != nil || enabled {
+		t.Fatalf("Enabled() before registering = %v, %v, want false", enabled, err)
+	}
+
+	auth := newSoftAuthenticator(t)
+	creation, token, err := service.BeginRegistration(user)
+	if err != nil {
+		t.Fatalf("BeginRegistration() err = %v", err)
+	}
+	body := auth.create(creation, user.ID)
+
+	credential, err := service.FinishRegistration(user, token, "  ", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("FinishRegistration() err = %v", err)
+	}
+	if credential.Name != "Passkey" {
+		t.Errorf("Name = %q, want the default Passkey", credential.Name)
+	}
+
+	// The ceremony is used up
+	_, err = service.FinishRegistration(user, token, "Again", bytes.NewReader(body))
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("FinishRegistration() replayed err = %v, want ErrNotFound", err)
+	}
+
+	credentials, err := service.ByUserID(user.ID)
+	if err != nil {
+		t.Fatalf("ByUserID() err = %v", err)
+	}
+	if len(credentials) != 1 || !bytes.Equal(credentials[0].Credential.ID, auth.id) {
+		t.Fatalf("ByUserID() = %+v, want the registered credential", credentials)
+	}
+
+	enabled, err = service.Enabled(user.ID)
+	if err != nil || !enabled {
+		t.Errorf("Enabled() after registering = %v, %v, want true", enabled, err)
+	}
+
+	// A registered credential is excluded so it isn't added twice
+	creation, _, err = service.BeginRegistration(user)
+	if err != nil {
+		t.Fatalf("BeginRegistration() err = %v", err)
+	}
+	if len(creation.Response.CredentialExcludeList) != 1 {
+		t.Errorf("exclude list has %d credentials, want 1", len(creation.Response.CredentialExcludeList))
+	}
+
+	err = service.Delete(user.ID, credentials[0].ID)
+	if err != nil {
+		t.Fatalf("Delete() err = %v", err)
+	}
+	enabled, err = service.Enabled(user.ID)
+	if err != nil || enabled {
+		t.Errorf("Enabled() after Delete = %v, %v, want false", enabled, err)
+	}
+}
+
+func TestWebAuthnRegistrationRefused(t *testing.T) {
+	service := newTestWebAuthnService(t)
+	user := testUser(t, service.DB, "jo@example.com")
+	other := testUser(t, service.DB, "sam@example.com")
+
+	tests := map[string]struct {
+		change func(auth *softAuthenticator)
+		// Finish as someone other than the user who began
+		user    *User
+		wantErr error
+	}{
+		"wrong origin": {
+			change:  func(auth *softAuthenticator) { auth.origin = "https://evil.example.com" },
+			wantErr: ErrWebAuthnFailed,
+		},
+		"wrong relying party": {
+			change:  func(auth *softAuthenticator) { auth.rpID = "evil.example.com" },
+			wantErr: ErrWebAuthnFailed,
+		},
+		"another user's ceremony": {
+			user:    other,
+			wantErr: ErrNotFound,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			auth := newSoftAuthenticator(t)
+			if tc.change != nil {
+				tc.change(auth)
+			}
+
+			creation, token, err := service.BeginRegistration(user)
+			if err != nil {
+				t.Fatalf("BeginRegistration() err = %v", err)
+			}
+
+			finishAs := user
+			if tc.user != nil {
+				finishAs = tc.user
+			}
+			_, err = service.FinishRegistration(finishAs, token, "Key", bytes.NewReader(auth.create(creation, user.ID)))
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("FinishRegistration() err = %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+
+	credentials, err := service.ByUserID(user.ID)
+	if err != nil {
+		t.Fatalf("ByUserID() err = %v", err)
+	}
+	if len(credentials) != 0 {
+		t.Errorf("%d credentials were saved, want none", len(credentials))
+	}
+}
+
+func TestWebAuthnSecondFactor(t *testing.T) {
+	service := newTestWebAuthnService(t)
+	user := testUser(t, service.DB, "jo@example.com")
+
+	_, _, err := service.BeginLogin(user)
+	if !errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("BeginLogin() without credentials err = %v, want ErrNoCredentials", err)
+	}
+
+	auth := newSoftAuthenticator(t)
+	registerSoftAuthenticator(t, service, user, auth)
+
+	// Security keys needn't be unlocked when they're the second factor
+	auth.verified = false
+	assertion, token, err := service.BeginLogin(user)
+	if err != nil {
+		t.Fatalf("BeginLogin() err = %v", err)
+	}
+	body := auth.get(assertion.Response.Challenge)
+
+	err = service.FinishLogin(user, token, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("FinishLogin() err = %v", err)
+	}
+
+	err = service.FinishLogin(user, token, bytes.NewReader(body))
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("FinishLogin() replayed err = %v, want ErrNotFound", err)
+	}
+
+	credentials, err := service.ByUserID(user.ID)
+	if err != nil {
+		t.Fatalf("ByUserID() err = %v", err)
+	}
+	if credentials[0].Credential.Authenticator.SignCount != auth.signCount || credentials[0].LastUsedAt == nil {
+		t.Errorf("credential after sign in = %+v, want sign count %d and a last used time",
+			credentials[0], auth.signCount)
+	}
+
+	tests := map[string]struct {
+		answer  func(challenge []byte) []byte
+		wantErr error
+	}{
+		"signed the wrong challenge": {
+			answer:  func([]byte) []byte { return auth.get([]byte("some other challenge")) },
+			wantErr: ErrWebAuthnFailed,
+		},
+		"another key": {
+			answer:  newSoftAuthenticator(t).get,
+			wantErr: ErrWebAuthnFailed,
+		},
+		"cloned key with an old counter": {
+			answer: func(challenge []byte) []byte {
+				clone := *auth
+				clone.signCount = 0
+				return clone.get(challenge)
+			},
+			wantErr: ErrWebAuthnFailed,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assertion, token, err := service.BeginLogin(user)
+			if err != nil {
+				t.Fatalf("BeginLogin() err = %v", err)
+			}
+
+			err = service.FinishLogin(user, token, bytes.NewReader(tc.answer(assertion.Response.Challenge)))
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("FinishLogin() err = %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestWebAuthnPasskeySignIn(t *testing.T) {
+	service := newTestWebAuthnService(t)
+	user := testUser(t, service.DB, "jo@example.com")
+
+	auth := newSoftAuthenticator(t)
+	registerSoftAuthenticator(t, service, user, auth)
+
+	assertion, token, err := service.BeginPasskeyLogin()
+	if err != nil {
+		t.Fatalf("BeginPasskeyLogin() err = %v", err)
+	}
+	body := auth.get(assertion.Response.Challenge)
+
+	got, err := service.FinishPasskeyLogin(token, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("FinishPasskeyLogin() err = %v", err)
+	}
+	if got.ID != user.ID || got.Email != user.Email {
+		t.Errorf("FinishPasskeyLogin() = %+v, want user %d", got, user.ID)
+	}
+
+	_, err = service.FinishPasskeyLogin(token, bytes.NewReader(body))
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("FinishPasskeyLogin() replayed err = %v, want ErrNotFound", err)
+	}
+
+	// A passkey stands in for the password too, so it has to be unlocked
+	auth.verified = false
+	assertion, token, err = service.BeginPasskeyLogin()
+	if err != nil {
+		t.Fatalf("BeginPasskeyLogin() err = %v", err)
+	}
+	_, err = service.FinishPasskeyLogin(token, bytes.NewReader(auth.get(assertion.Response.Challenge)))
+	if !errors.Is(err, ErrWebAuthnFailed) {
+		t.Errorf("FinishPasskeyLogin() without user verification err = %v, want ErrWebAuthnFailed", err)
+	}
+
+	// Nobody can claim to be another user with their own key
+	other := testUser(t, service.DB, "sam@example.com")
+	auth.verified = true
+	auth.userHandle = webAuthnUserHandle(other.ID)
+	assertion, token, err = service.BeginPasskeyLogin()
+	if err != nil {
+		t.Fatalf("BeginPasskeyLogin() err = %v", err)
+	}
+	_, err = service.FinishPasskeyLogin(token, bytes.NewReader(auth.get(assertion.Response.Challenge)))
+	if !errors.Is(err, ErrWebAuthnFailed) {
+		t.Errorf("FinishPasskeyLogin() with another user's handle err = %v, want ErrWebAuthnFailed", err)
+	}
+}
+
+// A ceremony can only be finished the way it was started
+func TestWebAuthnCeremonyPurpose(t *testing.T) {
+	service := newTestWebAuthnService(t)
+	user := testUser(t, service.DB, "jo@example.com")
+
+	auth := newSoftAuthenticator(t)
+	registerSoftAuthenticator(t, service, user, auth)
+
+	assertion, token, err := service.BeginLogin(user)
+	if err != nil {
+		t.Fatalf("BeginLogin() err = %v", err)
+	}
+	_, err = service.FinishPasskeyLogin(token, bytes.NewReader(auth.get(assertion.Response.Challenge)))
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("FinishPasskeyLogin() with a second factor ceremony err = %v, want ErrNotFound", err)
+	}
+
+	assertion, token, err = service.BeginPasskeyLogin()
+	if err != nil {
+		t.Fatalf("BeginPasskeyLogin() err = %v", err)
+	}
+	err = service.FinishLogin(user, token, bytes.NewReader(auth.get(assertion.Response.Challenge)))
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("FinishLogin() with a passkey ceremony err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestWebAuthnCeremonyExpiry(t *testing.T) {
+	service := newTestWebAuthnService(t)
+	user := testUser(t, service.DB, "jo@example.com")
+
+	auth := newSoftAuthenticator(t)
+	registerSoftAuthenticator(t, service, user, auth)
+
+	service.Duration = -time.Minute
+	assertion, token, err := service.BeginLogin(user)
+	if err != nil {
+		t.Fatalf("BeginLogin() err = %v", err)
+	}
+	_, current, err := service.BeginPasskeyLogin()
+	if err != nil {
+		t.Fatalf("BeginPasskeyLogin() err = %v", err)
+	}
+	service.Duration = DefaultCeremonyDuration
+	_, kept, err := service.BeginPasskeyLogin()
+	if err != nil {
+		t.Fatalf("BeginPasskeyLogin() err = %v", err)
+	}
+
+	err = service.FinishLogin(user, token, bytes.NewReader(auth.get(assertion.Response.Challenge)))
+	if !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("FinishLogin() after expiry err = %v, want ErrTokenExpired", err)
+	}
+
+	n, err := service.DeleteExpired()
+	if err != nil {
+		t.Fatalf("DeleteExpired() err = %v", err)
+	}
+	if n != 1 {
+		t.Errorf("DeleteExpired() removed %d, want 1", n)
+	}
+
+	_, err = service.FinishPasskeyLogin(current, bytes.NewReader(nil))
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("FinishPasskeyLogin() after DeleteExpired err = %v, want ErrNotFound", err)
+	}
+
+	// Unexpired ceremonies are left alone, and a bad response still uses
+	// the ceremony up
+	_, err = service.FinishPasskeyLogin(kept, bytes.NewReader([]byte("{}")))
+	if !errors.Is(err, ErrWebAuthnFailed) {
+		t.Errorf("FinishPasskeyLogin() with a bad response err = %v, want ErrWebAuthnFailed", err)
+	}
+}
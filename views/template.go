@@ -20,6 +20,10 @@ type public interface {
 	Public() string
 }
 
+type field interface {
+	Field() string
+}
+
 type Template struct {
 	htmlTpl *template.Template
 }
@@ -45,6 +49,9 @@ func ParseFS(fs fs.FS, patterns ...string) (Template, error) {
 			"errors": func() []string {
 				return nil
 			},
+			"fieldErrors": func(string) []string {
+				return nil
+			},
 		},
 	)
 
@@ -58,18 +65,23 @@ func ParseFS(fs fs.FS, patterns ...string) (Template, error) {
 	}, nil
 }
 
-func errMessages(errs ...error) []string {
+// Messages for the top of the page, and those for particular form fields
+func errMessages(errs ...error) ([]string, map[string][]string) {
 	var msgs []string
+	fieldMsgs := map[string][]string{}
 	for _, err := range errs {
+		var fieldErr field
 		var pubErr public
-		if errors.As(err, &pubErr) {
+		if errors.As(err, &fieldErr) && errors.As(err, &pubErr) {
+			fieldMsgs[fieldErr.Field()] = append(fieldMsgs[fieldErr.Field()], pubErr.Public())
+		} else if errors.As(err, &pubErr) {
 			msgs = append(msgs, pubErr.Public())
 		} else {
 			fmt.Println(err)
 			msgs = append(msgs, "Something went wrong...")
 		}
 	}
-	return msgs
+	return msgs, fieldMsgs
 }
 
 func (t Template) Execute(
@@ -84,7 +96,7 @@ func (t Template) Execute(
 			http.StatusInternalServerError)
 	}
 
-	errMsgs := errMessages(errs...)
+	errMsgs, fieldMsgs := errMessages(errs...)
 
 	tpl = tpl.Funcs(
 		template.FuncMap{
@@ -97,6 +109,9 @@ func (t Template) Execute(
 			"errors": func() []string {
 				return errMsgs
 			},
+			"fieldErrors": func(name string) []string {
+				return fieldMsgs[name]
+			},
 		},
 	)
 